@@ -0,0 +1,160 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpdoc
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/google/blueprint"
+	"github.com/google/blueprint/proptools"
+)
+
+// A SchemaProperty describes a property that can be set in a Blueprints file.
+type SchemaProperty struct {
+	// Name is the property name as it appears in Blueprints files.
+	Name string `json:"name"`
+	// Type is the Go type of the property struct field.
+	Type string `json:"type"`
+	// Optional is true if the field is a pointer, so that an unset property
+	// can be told apart from one set to the zero value.
+	Optional bool `json:"optional"`
+	// Properties describes the nested properties of struct properties.
+	Properties []SchemaProperty `json:"properties,omitempty"`
+}
+
+// PropertiesSchema returns a JSON array of SchemaProperty objects describing the
+// properties of the modules created by factory.  The factory is called once, and
+// the fields of the returned property structs are described in order, with
+// embedded structs flattened into their parent.  Fields tagged
+// blueprint:"mutated" cannot be set in Blueprints files and are omitted, and
+// nested structs with a filter tag only include the fields matching the filter.
+func PropertiesSchema(factory blueprint.ModuleFactory) ([]byte, error) {
+	_, propertyStructs := factory()
+
+	var props []SchemaProperty
+	seen := make(map[string]bool)
+	for _, s := range propertyStructs {
+		v := reflect.ValueOf(s)
+		if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+			return nil, fmt.Errorf("properties must be a pointer to a struct, got %T", s)
+		}
+
+		structProps, err := schemaProperties("", v.Elem(), "", "",
+			make(map[reflect.Type]bool))
+		if err != nil {
+			return nil, err
+		}
+
+		// Multiple property structs may contain the same property, describe
+		// it once.
+		for _, prop := range structProps {
+			if !seen[prop.Name] {
+				seen[prop.Name] = true
+				props = append(props, prop)
+			}
+		}
+	}
+
+	return json.MarshalIndent(props, "", "  ")
+}
+
+func schemaProperties(prefix string, structValue reflect.Value, filterKey, filterValue string,
+	visiting map[reflect.Type]bool) ([]SchemaProperty, error) {
+
+	var props []SchemaProperty
+
+	typ := structValue.Type()
+	for i := 0; i < structValue.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath != "" {
+			// The field is not exported so just skip it.
+			continue
+		}
+		if proptools.HasTag(field, "blueprint", "mutated") {
+			continue
+		}
+		if filterKey != "" && !proptools.HasTag(field, filterKey, filterValue) {
+			continue
+		}
+
+		name := proptools.PropertyNameForField(field.Name)
+		prop := SchemaProperty{
+			Name: name,
+			Type: field.Type.String(),
+		}
+
+		fieldValue := structValue.Field(i)
+		if fieldValue.Kind() == reflect.Interface {
+			if fieldValue.IsNil() {
+				return nil, fmt.Errorf("field %s contains a nil interface", prefix+name)
+			}
+			fieldValue = fieldValue.Elem()
+			prop.Type = fieldValue.Type().String()
+		}
+
+		if fieldValue.Kind() == reflect.Ptr {
+			prop.Optional = true
+			if fieldValue.Type().Elem().Kind() == reflect.Struct {
+				if fieldValue.IsNil() {
+					fieldValue = reflect.Zero(fieldValue.Type().Elem())
+				} else {
+					fieldValue = fieldValue.Elem()
+				}
+			}
+		}
+
+		if fieldValue.Kind() == reflect.Struct {
+			structType := fieldValue.Type()
+			if visiting[structType] {
+				// A recursive struct type, its properties are described by
+				// the enclosing property.
+				props = append(props, prop)
+				continue
+			}
+
+			nestedFilterKey, nestedFilterValue := filterKey, filterValue
+			if k, v, err := blueprint.HasFilter(field.Tag); err != nil {
+				return nil, err
+			} else if k != "" {
+				nestedFilterKey, nestedFilterValue = k, v
+			}
+
+			nestedPrefix := prefix + name + "."
+			if field.Anonymous {
+				nestedPrefix = prefix
+			}
+
+			visiting[structType] = true
+			nested, err := schemaProperties(nestedPrefix, fieldValue,
+				nestedFilterKey, nestedFilterValue, visiting)
+			delete(visiting, structType)
+			if err != nil {
+				return nil, err
+			}
+
+			if field.Anonymous {
+				props = append(props, nested...)
+				continue
+			}
+			prop.Properties = nested
+		}
+
+		props = append(props, prop)
+	}
+
+	return props, nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpdoc
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/google/blueprint"
+)
+
+type SchemaEmbeddedProps struct {
+	Enabled *bool
+}
+
+type schemaProps struct {
+	SchemaEmbeddedProps
+
+	Srcs []string
+
+	Target struct {
+		Host *struct {
+			Cflags []string
+		}
+	}
+
+	Filtered struct {
+		Visible string `android:"arch_variant"`
+		Hidden  string
+	} `blueprint:"filter(android:\"arch_variant\")"`
+
+	Mutated string `blueprint:"mutated"`
+}
+
+func schemaFactory() (blueprint.Module, []interface{}) {
+	return nil, []interface{}{&schemaProps{}}
+}
+
+func TestPropertiesSchema(t *testing.T) {
+	data, err := PropertiesSchema(schemaFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []SchemaProperty
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("invalid JSON %s: %s", data, err)
+	}
+
+	want := []SchemaProperty{
+		{Name: "enabled", Type: "*bool", Optional: true},
+		{Name: "srcs", Type: "[]string"},
+		{
+			Name: "target",
+			Type: "struct { Host *struct { Cflags []string } }",
+			Properties: []SchemaProperty{
+				{
+					Name:     "host",
+					Type:     "*struct { Cflags []string }",
+					Optional: true,
+					Properties: []SchemaProperty{
+						{Name: "cflags", Type: "[]string"},
+					},
+				},
+			},
+		},
+		{
+			Name: "filtered",
+			Type: `struct { Visible string "android:\"arch_variant\""; Hidden string }`,
+			Properties: []SchemaProperty{
+				{Name: "visible", Type: "string"},
+			},
+		},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected schema:\n%s", data)
+	}
+}
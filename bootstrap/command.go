@@ -16,6 +16,7 @@ package bootstrap
 
 import (
 	"bufio"
+	"bytes"
 	"flag"
 	"fmt"
 	"io"
@@ -36,6 +37,7 @@ var (
 	globFile       string
 	depFile        string
 	docFile        string
+	manifestFile   string
 	cpuprofile     string
 	memprofile     string
 	traceFile      string
@@ -56,6 +58,7 @@ func init() {
 	flag.StringVar(&NinjaBuildDir, "n", "", "the ninja builddir directory")
 	flag.StringVar(&depFile, "d", "", "the dependency file to output")
 	flag.StringVar(&docFile, "docs", "", "build documentation file to output")
+	flag.StringVar(&manifestFile, "manifest", "", "JSON description of the build statements to output")
 	flag.StringVar(&cpuprofile, "cpuprofile", "", "write cpu profile to file")
 	flag.StringVar(&traceFile, "trace", "", "write trace to file")
 	flag.StringVar(&memprofile, "memprofile", "", "write memory profile to file")
@@ -174,6 +177,8 @@ func Main(ctx *blueprint.Context, config interface{}, extraNinjaFileDeps ...stri
 	}
 	deps = append(deps, extraDeps...)
 
+	printWarnings(ctx.Warnings())
+
 	const outFilePermissions = 0666
 	var out io.Writer
 	var f *os.File
@@ -209,6 +214,19 @@ func Main(ctx *blueprint.Context, config interface{}, extraNinjaFileDeps ...stri
 		}
 	}
 
+	if manifestFile != "" {
+		buffer := &bytes.Buffer{}
+		err = ctx.WriteBuildManifest(buffer)
+		if err != nil {
+			fatalf("error writing build manifest contents: %s", err)
+		}
+
+		err = ioutil.WriteFile(manifestFile, buffer.Bytes(), outFilePermissions)
+		if err != nil {
+			fatalf("error writing %s: %s", manifestFile, err)
+		}
+	}
+
 	if globFile != "" {
 		buffer, errs := generateGlobNinjaFile(ctx.Globs)
 		if len(errs) > 0 {
@@ -268,3 +286,12 @@ func fatalErrors(errs []error) {
 	}
 	os.Exit(1)
 }
+
+func printWarnings(warnings []string) {
+	yellow := "\x1b[33m"
+	unyellow := "\x1b[0m"
+
+	for _, warning := range warnings {
+		fmt.Printf("%swarning:%s %s\n", yellow, unyellow, warning)
+	}
+}
@@ -17,6 +17,7 @@ package blueprint
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -80,6 +81,7 @@ type Context struct {
 	singletonInfo       []*singletonInfo
 	mutatorInfo         []*mutatorInfo
 	earlyMutatorInfo    []*mutatorInfo
+	configFinalizers    []func(config interface{}) error
 	variantMutatorNames []string
 
 	depsModified uint32 // positive if a mutator modified the dependencies
@@ -100,6 +102,40 @@ type Context struct {
 	globalPools     map[Pool]*poolDef
 	globalRules     map[Rule]*ruleDef
 
+	// set by RegisterModuleTypeAlias
+	moduleTypeAliases map[string]string
+
+	// set by RequireModuleType
+	requiredModuleTypes map[string][]string
+
+	// set during ParseBlueprintsFiles
+	parseDeprecations     []string // The parse warnings about deprecated entities.
+	parseDeprecationsLock sync.Mutex
+
+	// set by SetFailOnDeprecated
+	failOnDeprecated bool
+
+	// collects the warnings, replaced by SetDiagnostics
+	diagnostics *Diagnostics
+
+	// set by SetEmitDefaultDescriptions
+	emitDefaultDescriptions bool
+
+	// set by SetCheckUnusedRuleArgs
+	checkUnusedRuleArgs bool
+
+	// set by SetStrictVariableResolution
+	strictVariableResolution bool
+
+	// set by SetPoolOverride
+	poolOverrides map[Pool]int
+
+	// set by SetEmitPoolTargets
+	emitPoolTargets bool
+
+	// set by SetEmitSourceComments
+	emitSourceComments bool
+
 	// set during PrepareBuildActions
 	ninjaBuildDir      *ninjaString // The builddir special Ninja variable
 	requiredNinjaMajor int          // For the ninja_required_version variable
@@ -287,6 +323,7 @@ func newContext() *Context {
 	return &Context{
 		Context:            context.Background(),
 		moduleFactories:    make(map[string]ModuleFactory),
+		moduleTypeAliases:  make(map[string]string),
 		nameInterface:      NewSimpleNameInterface(),
 		moduleInfo:         make(map[Module]*moduleInfo),
 		globs:              make(map[string]GlobPath),
@@ -295,6 +332,7 @@ func newContext() *Context {
 		requiredNinjaMajor: 1,
 		requiredNinjaMinor: 7,
 		requiredNinjaMicro: 0,
+		diagnostics:        NewDiagnostics(),
 	}
 }
 
@@ -377,10 +415,123 @@ type ModuleFactory func() (m Module, propertyStructs []interface{})
 // The factory function may be called from multiple goroutines.  Any accesses
 // to global variables must be synchronized.
 func (c *Context) RegisterModuleType(name string, factory ModuleFactory) {
-	if _, present := c.moduleFactories[name]; present {
-		panic(errors.New("module type name is already registered"))
-	}
+	c.checkModuleTypeNotRegistered(name, factory)
 	c.moduleFactories[name] = factory
+	observeModuleType("module type", name, factory)
+}
+
+// observeModuleType reports the registration of a module type or an alias to
+// the registration observer, see SetRegistrationObserver.
+func observeModuleType(kind, name string, factory ModuleFactory) {
+	observeRegistration(kind, funcPkgPath(funcName(factory)), name)
+}
+
+// RegisterModuleTypeAlias registers alias as another name for the already
+// registered module type name, so that Blueprints files using a module type's
+// old name keep working after it is renamed.  Modules defined with the alias
+// are created by the factory of the original module type and have its type
+// name, and each use of the alias results in a warning returned by Warnings.
+//
+// The alias must not be the name of another module type or alias.
+func (c *Context) RegisterModuleTypeAlias(alias, name string) {
+	factory, present := c.moduleFactories[name]
+	if !present {
+		panic(fmt.Errorf("cannot alias %q to unregistered module type %q", alias, name))
+	}
+	c.checkModuleTypeNotRegistered(alias, factory)
+	c.moduleTypeAliases[alias] = name
+	observeModuleType("module type alias", alias, factory)
+}
+
+// CloneModuleType registers newName as a new module type that is created by the
+// factory of the already registered module type name.  Unlike an alias, modules
+// defined with the clone have the type name newName, so that variants of a
+// module type, for example host and target flavors, can be registered without
+// writing a factory for each.  A Context identifies module types by the names
+// they were registered with, so the original module type is passed by name.
+//
+// The new name must not be the name of another module type or alias.
+func (c *Context) CloneModuleType(name, newName string) {
+	factory, present := c.moduleFactories[name]
+	if !present {
+		panic(fmt.Errorf("cannot clone unregistered module type %q", name))
+	}
+	c.checkModuleTypeNotRegistered(newName, factory)
+	c.moduleFactories[newName] = factory
+	observeModuleType("module type", newName, factory)
+}
+
+// RequireModuleType declares that the registered module type name requires the
+// module type required, which may be registered later, for example by another
+// plugin.  The Blueprints files are only parsed once every required module type
+// has been registered, as a module type or an alias, otherwise
+// ParseBlueprintsFiles and ParseFileList return an error naming both types.
+func (c *Context) RequireModuleType(name, required string) {
+	if !c.isModuleTypeRegistered(name) {
+		panic(fmt.Errorf("cannot add a requirement to unregistered module type %q",
+			name))
+	}
+	if c.requiredModuleTypes == nil {
+		c.requiredModuleTypes = make(map[string][]string)
+	}
+	c.requiredModuleTypes[name] = append(c.requiredModuleTypes[name], required)
+}
+
+// checkRequiredModuleTypes returns an error for each module type required by
+// RequireModuleType that is not registered.
+func (c *Context) checkRequiredModuleTypes() []error {
+	var names []string
+	for name := range c.requiredModuleTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		for _, required := range c.requiredModuleTypes[name] {
+			if !c.isModuleTypeRegistered(required) {
+				errs = append(errs, fmt.Errorf("module type %q requires module "+
+					"type %q, which is not registered", name, required))
+			}
+		}
+	}
+	return errs
+}
+
+// checkModuleTypeNotRegistered panics if name is already the name of a module
+// type or alias, naming the packages of both factories so that the module type
+// that would be shadowed can be found.
+func (c *Context) checkModuleTypeNotRegistered(name string, factory ModuleFactory) {
+	registered, isFactory := c.moduleFactories[name]
+	if alias, isAlias := c.moduleTypeAliases[name]; isAlias {
+		registered, isFactory = c.moduleFactories[alias], true
+	}
+	if isFactory {
+		panic(fmt.Errorf("module type %q from package %q is already registered "+
+			"by package %q", name, funcPkgPath(funcName(factory)),
+			funcPkgPath(funcName(registered))))
+	}
+}
+
+func (c *Context) isModuleTypeRegistered(name string) bool {
+	_, isFactory := c.moduleFactories[name]
+	_, isAlias := c.moduleTypeAliases[name]
+	return isFactory || isAlias
+}
+
+// RegisterModuleTypeChecked is like RegisterModuleType, but it calls the
+// factory function once at registration and checks that every exported field
+// of the returned property structs has a kind that can be set from a
+// Blueprints file.  It panics with the module type name and the path of the
+// offending property if a field is not supported, instead of failing when a
+// module of the type is first parsed.
+func (c *Context) RegisterModuleTypeChecked(name string, factory ModuleFactory) {
+	_, propertyStructs := factory()
+	if err := validatePropertyStructs(propertyStructs); err != nil {
+		panic(fmt.Errorf("invalid properties for module type %q: %s", name, err))
+	}
+
+	c.RegisterModuleType(name, factory)
 }
 
 // A SingletonFactory function creates a new Singleton object.  See the
@@ -432,6 +583,70 @@ func (c *Context) RegisterPreSingletonType(name string, factory SingletonFactory
 	})
 }
 
+// RegisterConfigFinalizer registers a function that finishes setting up the
+// config object after the mutators have changed it.  The registered functions
+// are called in registration order by PrepareBuildActions, after the
+// dependencies are resolved and before the build actions of the modules and
+// singletons are generated, so all the VariableFunc, RuleFunc, and PoolFunc
+// functions called to generate the build actions see the finalized config
+// object.  An error returned by a finalizer stops PrepareBuildActions.
+//
+// The values that were computed before the finalizers ran, for example for the
+// build actions of the presingletons, are discarded, and the variables, rules,
+// and pools that they made live are evaluated again for the finalized config.
+// The build statements of the presingletons are resolved again too, so that
+// they use the rules that SelectRule and RspfileThreshold choose for the
+// finalized config.
+func (c *Context) RegisterConfigFinalizer(finalizer func(config interface{}) error) {
+	c.configFinalizers = append(c.configFinalizers, finalizer)
+}
+
+// finalizeConfig calls the config finalizers and evaluates the live variables,
+// rules, and pools and the build statements of the presingletons again for the
+// finalized config.
+func (c *Context) finalizeConfig(config interface{}) []error {
+	if len(c.configFinalizers) == 0 {
+		return nil
+	}
+
+	for _, finalizer := range c.configFinalizers {
+		err := finalizer(config)
+		if err != nil {
+			return []error{fmt.Errorf("error finalizing config: %s", err)}
+		}
+	}
+
+	clearConfigCaches()
+
+	err := c.liveGlobals.reevaluate()
+	if err != nil {
+		return []error{err}
+	}
+
+	// Like processLocalBuildActions, remove the live local definitions of
+	// the presingletons from the globals after making their build
+	// statements live again.
+	var errs []error
+	for _, info := range c.preSingletonInfo {
+		referer := "singleton " + info.name
+		for _, def := range info.actionDefs.buildDefs {
+			err := c.liveGlobals.ReAddBuildDefDeps(def, referer)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("while generating build actions for %s: %s",
+					referer, err))
+			}
+		}
+		for _, v := range info.actionDefs.variables {
+			c.liveGlobals.RemoveVariableIfLive(v)
+		}
+		for _, r := range info.actionDefs.rules {
+			c.liveGlobals.RemoveRuleIfLive(r)
+		}
+	}
+
+	return errs
+}
+
 func (c *Context) SetNameInterface(i NameInterface) {
 	c.nameInterface = i
 }
@@ -571,6 +786,51 @@ func (c *Context) SetAllowMissingDependencies(allowMissingDependencies bool) {
 	c.allowMissingDependencies = allowMissingDependencies
 }
 
+// SetDiagnostics sets the Diagnostics that collects the warnings found by the
+// Context, which are returned by Warnings, for example to collect the warnings
+// of several Contexts together.  Passing nil discards the warnings.  It should
+// be called before the Blueprints files are parsed.
+func (c *Context) SetDiagnostics(d *Diagnostics) {
+	c.diagnostics = d
+}
+
+// SetEmitDefaultDescriptions enables or disables writing a description made of
+// the rule name and the outputs of the build statement, for example
+// "cc $out", for the package-scoped rules that set no Description.  Ninja
+// prints the description of each build statement as it runs it, and falls back
+// to the whole command if there is none.
+func (c *Context) SetEmitDefaultDescriptions(emit bool) {
+	c.emitDefaultDescriptions = emit
+}
+
+// SetCheckUnusedRuleArgs sets whether PrepareBuildActions fails for the rules
+// created by StaticRule or RuleFunc that declare an argument that none of
+// their RuleParams fields use and that Ninja does not read either, which is
+// often a typo in the name of the argument.  It is disabled by default.  Each
+// rule is only checked if a build statement uses it.  It should be called
+// before ResolveDependencies.
+func (c *Context) SetCheckUnusedRuleArgs(check bool) {
+	c.checkUnusedRuleArgs = check
+}
+
+// SetStrictVariableResolution enables or disables strict variable resolution,
+// which is disabled by default.  In strict mode ResolveDependencies checks that
+// all the variables referenced by the values of static variables exist,
+// including the static variables that are not used by any build statement and
+// the values set by OverrideVariable.  It should be called before
+// ResolveDependencies.
+func (c *Context) SetStrictVariableResolution(strict bool) {
+	c.strictVariableResolution = strict
+}
+
+// SetFailOnDeprecated sets whether PrepareBuildActions fails when deprecated
+// entities are used, such as module type aliases and the variables created by
+// DeprecatedStaticVariable.  When enabled the warnings about them are also
+// returned as errors, all at once.
+func (c *Context) SetFailOnDeprecated(failOnDeprecated bool) {
+	c.failOnDeprecated = failOnDeprecated
+}
+
 func (c *Context) SetModuleListFile(listFile string) {
 	c.moduleListFile = listFile
 }
@@ -635,6 +895,11 @@ func (c *Context) ParseFileList(rootDir string, filePaths []string) (deps []stri
 		return nil, []error{fmt.Errorf("no paths provided to parse")}
 	}
 
+	errs = c.checkRequiredModuleTypes()
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
 	c.dependenciesReady = false
 
 	moduleCh := make(chan *moduleInfo)
@@ -1277,7 +1542,14 @@ func (c *Context) newModule(factory ModuleFactory) *moduleInfo {
 func (c *Context) processModuleDef(moduleDef *parser.Module,
 	relBlueprintsFile string) (*moduleInfo, []error) {
 
-	factory, ok := c.moduleFactories[moduleDef.Type]
+	typeName := moduleDef.Type
+	if name, isAlias := c.moduleTypeAliases[typeName]; isAlias {
+		c.addDeprecationWarning(fmt.Sprintf("%s: module type %q is deprecated, use %q",
+			moduleDef.TypePos, typeName, name))
+		typeName = name
+	}
+
+	factory, ok := c.moduleFactories[typeName]
 	if !ok {
 		if c.ignoreUnknownModuleTypes {
 			return nil, nil
@@ -1292,7 +1564,7 @@ func (c *Context) processModuleDef(moduleDef *parser.Module,
 	}
 
 	module := c.newModule(factory)
-	module.typeName = moduleDef.Type
+	module.typeName = typeName
 
 	module.relBlueprintsFile = relBlueprintsFile
 
@@ -1354,7 +1626,27 @@ func (c *Context) ResolveDependencies(config interface{}) (deps []string, errs [
 
 func (c *Context) resolveDependencies(ctx context.Context, config interface{}) (deps []string, errs []error) {
 	pprof.Do(ctx, pprof.Labels("blueprint", "ResolveDependencies"), func(ctx context.Context) {
+		clearConfigCaches()
+		errs = checkPackageNamespaces()
+		if len(errs) > 0 {
+			return
+		}
+		if caseInsensitiveNamesEnabled() {
+			errs = checkCaseInsensitiveNames()
+			if len(errs) > 0 {
+				return
+			}
+		}
+		if c.strictVariableResolution {
+			errs = checkStaticVariables()
+			if len(errs) > 0 {
+				return
+			}
+		}
+
 		c.liveGlobals = newLiveTracker(config)
+		c.liveGlobals.diagnostics = c.diagnostics
+		c.liveGlobals.checkUnusedRuleArgs = c.checkUnusedRuleArgs
 
 		deps, errs = c.generateSingletonBuildActions(config, c.preSingletonInfo, c.liveGlobals)
 		if len(errs) > 0 {
@@ -1916,6 +2208,11 @@ func (c *Context) PrepareBuildActions(config interface{}) (deps []string, errs [
 			deps = append(deps, extraDeps...)
 		}
 
+		errs = c.finalizeConfig(config)
+		if len(errs) > 0 {
+			return
+		}
+
 		var depsModules []string
 		depsModules, errs = c.generateModuleBuildActions(config, c.liveGlobals)
 		if len(errs) > 0 {
@@ -1931,6 +2228,10 @@ func (c *Context) PrepareBuildActions(config interface{}) (deps []string, errs [
 		deps = append(deps, depsModules...)
 		deps = append(deps, depsSingletons...)
 
+		if c.liveGlobals.hasValidations {
+			c.requireNinjaVersion(1, 11, 0)
+		}
+
 		if c.ninjaBuildDir != nil {
 			err := c.liveGlobals.addNinjaStringDeps(c.ninjaBuildDir)
 			if err != nil {
@@ -1946,11 +2247,17 @@ func (c *Context) PrepareBuildActions(config interface{}) (deps []string, errs [
 		// This will panic if it finds a problem since it's a programming error.
 		c.checkForVariableReferenceCycles(c.liveGlobals.variables, pkgNames)
 
+		if c.failOnDeprecated {
+			errs = c.deprecationErrors()
+			if len(errs) > 0 {
+				return
+			}
+		}
+
 		c.pkgNames = pkgNames
 		c.globalVariables = c.liveGlobals.variables
 		c.globalPools = c.liveGlobals.pools
 		c.globalRules = c.liveGlobals.rules
-
 		c.buildActionsReady = true
 	})
 
@@ -2353,7 +2660,7 @@ func (c *Context) generateModuleBuildActions(config interface{},
 		depsCh <- mctx.ninjaFileDeps
 
 		newErrs := c.processLocalBuildActions(&module.actionDefs,
-			&mctx.actionDefs, liveGlobals)
+			&mctx.actionDefs, liveGlobals, module.String())
 		if len(newErrs) > 0 {
 			errsCh <- newErrs
 			return true
@@ -2413,7 +2720,7 @@ func (c *Context) generateSingletonBuildActions(config interface{},
 		deps = append(deps, sctx.ninjaFileDeps...)
 
 		newErrs := c.processLocalBuildActions(&info.actionDefs,
-			&sctx.actionDefs, liveGlobals)
+			&sctx.actionDefs, liveGlobals, "singleton "+info.name)
 		errs = append(errs, newErrs...)
 		if len(errs) > maxErrors {
 			break
@@ -2424,7 +2731,7 @@ func (c *Context) generateSingletonBuildActions(config interface{},
 }
 
 func (c *Context) processLocalBuildActions(out, in *localBuildActions,
-	liveGlobals *liveTracker) []error {
+	liveGlobals *liveTracker, referer string) []error {
 
 	var errs []error
 
@@ -2432,9 +2739,12 @@ func (c *Context) processLocalBuildActions(out, in *localBuildActions,
 	// buildDefs to the live globals set.  This will end up adding the live
 	// locals to the set as well, but we'll take them out after.
 	for _, def := range in.buildDefs {
-		err := liveGlobals.AddBuildDefDeps(def)
+		err := liveGlobals.AddBuildDefDeps(def, referer)
 		if err != nil {
-			errs = append(errs, err)
+			// The variables, rules, and pools are evaluated when they are first
+			// made live, so name the module or singleton that referenced them.
+			errs = append(errs, fmt.Errorf("while generating build actions for %s: %s",
+				referer, err))
 		}
 	}
 
@@ -2678,6 +2988,15 @@ func (c *Context) makeUniquePackageNames(
 	pkgNames := make(map[*packageContext]string)
 	longPkgNames := make(map[*packageContext]bool)
 
+	// Packages can't use the namespaces set by PackageContext.SetNamespace as
+	// their short names.
+	namespaces := make(map[string]bool)
+	for _, pctx := range packageContexts {
+		if pctx.namespace != "" {
+			namespaces[pctx.namespace] = true
+		}
+	}
+
 	processPackage := func(pctx *packageContext) {
 		if pctx == nil {
 			// This is a built-in rule and has no package.
@@ -2688,8 +3007,16 @@ func (c *Context) makeUniquePackageNames(
 			return
 		}
 
+		if pctx.namespace != "" {
+			pkgNames[pctx] = pctx.namespace
+			return
+		}
+
 		otherPkg, present := pkgs[pctx.shortName]
-		if present {
+		if namespaces[pctx.shortName] {
+			longPkgNames[pctx] = true
+			pkgNames[pctx] = pctx.fullName
+		} else if present {
 			// Short name collision.  Both this package and the one that's
 			// already there need to use their full names.  We leave the short
 			// name in pkgNames for now so future collisions still get caught.
@@ -2721,10 +3048,17 @@ func (c *Context) makeUniquePackageNames(
 		pkgNames[pctx] = pctx.fullName
 	}
 
-	// Create deps list from calls to PackageContext.AddNinjaFileDeps
+	// Create deps list from calls to PackageContext.AddNinjaFileDeps, in
+	// package path order so that it doesn't depend on map iteration order.
+	pctxs := make([]*packageContext, 0, len(pkgNames))
+	for pctx := range pkgNames {
+		pctxs = append(pctxs, pctx)
+	}
+	sort.Slice(pctxs, func(i, j int) bool { return pctxs[i].pkgPath < pctxs[j].pkgPath })
+
 	deps := []string{}
-	for _, pkg := range pkgs {
-		deps = append(deps, pkg.ninjaFileDeps...)
+	for _, pctx := range pctxs {
+		deps = append(deps, pctx.ninjaFileDeps...)
 	}
 
 	return pkgNames, deps
@@ -2844,6 +3178,149 @@ func (c *Context) AllTargets() (map[string]string, error) {
 	return targets, nil
 }
 
+// A BuildSummary describes the Ninja definitions that WriteBuildFile would
+// write.  It is returned by Context.BuildSummary.
+type BuildSummary struct {
+	Packages []PackageSummary // The packages whose definitions are live, sorted by path.
+	Builds   int              // The number of build statements.
+	Outputs  []string         // The sorted outputs of all the build statements.
+}
+
+// A PackageSummary describes the Ninja definitions of a single package.  The
+// names are the sorted Ninja names that are written to the Ninja file.
+type PackageSummary struct {
+	PkgPath   string
+	Variables []string
+	Pools     []string
+	Rules     []string
+	Builds    int // The number of build statements that invoke the package's rules.
+}
+
+// BuildSummary returns a summary of the Ninja file that WriteBuildFile would
+// write, which allows the generated definitions to be checked without writing
+// the file.  It may only be called after a successful PrepareBuildActions, or
+// else ErrBuildActionsNotReady is returned.  Build statements that invoke the
+// built-in rules and the variables and rules local to a module or singleton are
+// only counted in Builds and Outputs.
+func (c *Context) BuildSummary() (*BuildSummary, error) {
+	if !c.buildActionsReady {
+		return nil, ErrBuildActionsNotReady
+	}
+
+	pkgs := make(map[*packageContext]*PackageSummary)
+	pkg := func(pctx *packageContext) *PackageSummary {
+		if pkgs[pctx] == nil {
+			pkgs[pctx] = &PackageSummary{PkgPath: pctx.pkgPath}
+		}
+		return pkgs[pctx]
+	}
+
+	for v := range c.globalVariables {
+		p := pkg(v.packageContext())
+		p.Variables = append(p.Variables, v.fullName(c.pkgNames))
+	}
+	for pool := range c.globalPools {
+		p := pkg(pool.packageContext())
+		p.Pools = append(p.Pools, pool.fullName(c.pkgNames))
+	}
+	for rule := range c.globalRules {
+		if pctx := rule.packageContext(); pctx != nil {
+			p := pkg(pctx)
+			p.Rules = append(p.Rules, rule.fullName(c.pkgNames))
+		}
+	}
+
+	summary := &BuildSummary{}
+	variables := c.buildVariables()
+
+	addBuildDefs := func(buildDefs []*buildDef) error {
+		for _, buildDef := range buildDefs {
+			summary.Builds++
+			if pctx := buildDef.Rule.packageContext(); pctx != nil {
+				pkg(pctx).Builds++
+			}
+			for _, output := range append(buildDef.Outputs, buildDef.ImplicitOutputs...) {
+				outputValue, err := output.Eval(variables)
+				if err != nil {
+					return err
+				}
+				summary.Outputs = append(summary.Outputs, outputValue)
+			}
+		}
+		return nil
+	}
+
+	for _, module := range c.moduleInfo {
+		err := addBuildDefs(module.actionDefs.buildDefs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, info := range c.singletonInfo {
+		err := addBuildDefs(info.actionDefs.buildDefs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, p := range pkgs {
+		sort.Strings(p.Variables)
+		sort.Strings(p.Pools)
+		sort.Strings(p.Rules)
+		summary.Packages = append(summary.Packages, *p)
+	}
+	sort.Slice(summary.Packages, func(i, j int) bool {
+		return summary.Packages[i].PkgPath < summary.Packages[j].PkgPath
+	})
+	sort.Strings(summary.Outputs)
+
+	return summary, nil
+}
+
+// Warnings returns the sorted distinct warnings that were found while parsing
+// Blueprints files, such as uses of module type aliases, and while generating
+// build actions, such as references to deprecated variables, as recorded by
+// the Diagnostics of the Context, see SetDiagnostics.  The warnings do not
+// prevent the Ninja file from being written.
+func (c *Context) Warnings() []string {
+	return c.diagnostics.Warnings()
+}
+
+func (c *Context) addParseWarning(warning string) {
+	c.diagnostics.Warningf("%s", warning)
+}
+
+// addDeprecationWarning adds a parse warning about a deprecated entity, which is
+// an error when SetFailOnDeprecated is enabled.
+func (c *Context) addDeprecationWarning(warning string) {
+	c.addParseWarning(warning)
+
+	c.parseDeprecationsLock.Lock()
+	defer c.parseDeprecationsLock.Unlock()
+	c.parseDeprecations = append(c.parseDeprecations, warning)
+}
+
+// deprecationErrors returns an error for each of the warnings about deprecated
+// entities found while parsing the Blueprints files and generating the build
+// actions, the ones found while parsing first.
+func (c *Context) deprecationErrors() []error {
+	c.parseDeprecationsLock.Lock()
+	deprecations := append([]string(nil), c.parseDeprecations...)
+	c.parseDeprecationsLock.Unlock()
+
+	sort.Strings(deprecations)
+
+	liveDeprecations := append([]string(nil), c.liveGlobals.deprecations...)
+	sort.Strings(liveDeprecations)
+	deprecations = append(deprecations, liveDeprecations...)
+
+	var errs []error
+	for _, deprecation := range deprecations {
+		errs = append(errs, errors.New(deprecation))
+	}
+	return errs
+}
+
 func (c *Context) NinjaBuildDir() (string, error) {
 	if c.ninjaBuildDir != nil {
 		return c.ninjaBuildDir.Eval(c.globalVariables)
@@ -2871,6 +3348,41 @@ func (c *Context) ModuleTypeFactories() map[string]ModuleFactory {
 	return ret
 }
 
+// A ModuleTypeInfo describes a module type registered with RegisterModuleType.
+type ModuleTypeInfo struct {
+	Name      string        // the module type name used in Blueprints files
+	Aliases   []string      // the names registered with RegisterModuleTypeAlias, sorted
+	Factory   ModuleFactory // the factory function of the module type
+	GoFactory string        // the full name of the Go factory function
+	PkgPath   string        // the path of the Go package defining the factory function
+}
+
+// RegisteredModuleTypes returns descriptions of all the module types registered
+// with the context, sorted by name.
+func (c *Context) RegisteredModuleTypes() []ModuleTypeInfo {
+	aliases := make(map[string][]string)
+	for alias, name := range c.moduleTypeAliases {
+		aliases[name] = append(aliases[name], alias)
+	}
+
+	ret := make([]ModuleTypeInfo, 0, len(c.moduleFactories))
+	for name, factory := range c.moduleFactories {
+		sort.Strings(aliases[name])
+		goFactory := funcName(factory)
+		ret = append(ret, ModuleTypeInfo{
+			Name:      name,
+			Aliases:   aliases[name],
+			Factory:   factory,
+			GoFactory: goFactory,
+			PkgPath:   funcPkgPath(goFactory),
+		})
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+
+	return ret
+}
+
 func (c *Context) ModuleName(logicModule Module) string {
 	module := c.moduleInfo[logicModule]
 	return module.Name()
@@ -3089,6 +3601,18 @@ func (c *Context) WriteBuildFile(w io.Writer) error {
 		if err != nil {
 			return
 		}
+
+		err = c.writeAlwaysRunTarget(nw)
+		if err != nil {
+			return
+		}
+
+		if c.emitPoolTargets {
+			err = c.writePoolTargets(nw)
+			if err != nil {
+				return
+			}
+		}
 	})
 
 	if err != nil {
@@ -3098,6 +3622,99 @@ func (c *Context) WriteBuildFile(w io.Writer) error {
 	return nil
 }
 
+// A manifestEntry is an entry in the JSON manifest written by
+// WriteBuildManifest, a build statement together with the module or singleton
+// that generated it.
+type manifestEntry struct {
+	Module    string `json:"module,omitempty"`
+	Variant   string `json:"variant,omitempty"`
+	Singleton string `json:"singleton,omitempty"`
+	*buildStatement
+}
+
+// buildVariables returns the values of the variables that the paths of the
+// build statements may reference: the global variables and the local variables
+// of the module or singleton that generated them.
+func (c *Context) buildVariables() map[Variable]*ninjaString {
+	variables := make(map[Variable]*ninjaString, len(c.globalVariables))
+	for v, value := range c.globalVariables {
+		variables[v] = value
+	}
+	addLocalVariables := func(defs *localBuildActions) {
+		for _, v := range defs.variables {
+			variables[v] = v.value_
+		}
+	}
+	for _, module := range c.moduleInfo {
+		addLocalVariables(&module.actionDefs)
+	}
+	for _, info := range c.singletonInfo {
+		addLocalVariables(&info.actionDefs)
+	}
+	return variables
+}
+
+// WriteBuildManifest writes a JSON description of the build statements in the
+// Ninja manifest written by WriteBuildFile to w, for tools that want to inspect
+// the build graph without parsing Ninja syntax.  It is a list of the build
+// statements of the modules and then of the singletons, in the same order as
+// in the Ninja manifest.  The paths are the plain paths that Ninja sees, with
+// the variables they reference expanded and the Ninja escape sequences undone,
+// while the variables and arguments of the build statements are written as in
+// the Ninja manifest, since they may reference rule arguments such as $out.
+// The phony targets written for
+// SetEmitPoolTargets and for AlwaysRun rules are not included.  If this is
+// called before PrepareBuildActions successfully completes then
+// ErrBuildActionsNotReady is returned.
+func (c *Context) WriteBuildManifest(w io.Writer) error {
+	if !c.buildActionsReady {
+		return ErrBuildActionsNotReady
+	}
+
+	entries := []manifestEntry{}
+
+	modules := make([]*moduleInfo, 0, len(c.moduleInfo))
+	for _, module := range c.moduleInfo {
+		modules = append(modules, module)
+	}
+	sort.Sort(moduleSorter{modules, c.nameInterface})
+
+	variables := c.buildVariables()
+
+	for _, module := range modules {
+		for _, buildDef := range module.actionDefs.buildDefs {
+			s, err := c.buildWithPoolOverride(buildDef).manifestStatement(c.pkgNames, variables)
+			if err != nil {
+				return fmt.Errorf("error expanding the paths of a build statement "+
+					"of %s: %s", module, err)
+			}
+			entries = append(entries, manifestEntry{
+				Module:         module.Name(),
+				Variant:        module.variantName,
+				buildStatement: s,
+			})
+		}
+	}
+
+	for _, info := range c.singletonInfo {
+		for _, buildDef := range info.actionDefs.buildDefs {
+			s, err := c.buildWithPoolOverride(buildDef).manifestStatement(c.pkgNames, variables)
+			if err != nil {
+				return fmt.Errorf("error expanding the paths of a build statement "+
+					"of singleton %s: %s", info.name, err)
+			}
+			entries = append(entries, manifestEntry{
+				Singleton:      info.name,
+				buildStatement: s,
+			})
+		}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(entries)
+}
+
 type pkgAssociation struct {
 	PkgName string
 	PkgPath string
@@ -3199,6 +3816,7 @@ func (c *Context) writeBuildDir(nw *ninjaWriter) error {
 
 type globalEntity interface {
 	fullName(pkgNames map[*packageContext]string) string
+	String() string
 }
 
 type globalEntitySorter struct {
@@ -3213,6 +3831,11 @@ func (s *globalEntitySorter) Len() int {
 func (s *globalEntitySorter) Less(i, j int) bool {
 	iName := s.entities[i].fullName(s.pkgNames)
 	jName := s.entities[j].fullName(s.pkgNames)
+	if iName == jName {
+		// Break ties so that the order is total and doesn't depend on the
+		// sort algorithm.
+		return s.entities[i].String() < s.entities[j].String()
+	}
 	return iName < jName
 }
 
@@ -3220,6 +3843,198 @@ func (s *globalEntitySorter) Swap(i, j int) {
 	s.entities[i], s.entities[j] = s.entities[j], s.entities[i]
 }
 
+// SetEmitSourceComments enables or disables the comments that name the Go
+// package that defined each package-scoped variable, pool, and rule written to
+// the Ninja file.  They are disabled by default to keep the Ninja file small.
+func (c *Context) SetEmitSourceComments(emit bool) {
+	c.emitSourceComments = emit
+}
+
+// writeSourceComment writes a comment naming the package with the given path
+// if source comments are enabled.
+func (c *Context) writeSourceComment(nw *ninjaWriter, pkgPath string, ok bool) error {
+	if !c.emitSourceComments || !ok {
+		return nil
+	}
+	return nw.Comment("defined in " + pkgPath)
+}
+
+// SetPoolOverride changes how pool is written to the Ninja file, which is
+// useful for debugging problems caused by the pool, such as a deadlock,
+// without modifying its definition.  If depth is positive the pool is written
+// with that depth instead of its own.  Otherwise the rules and build statements
+// that use the pool are written without a pool assignment, so a build
+// statement that sets the pool uses the pool of its rule, if any.  The depth of
+// a built-in pool, such as Console, cannot be overridden, but its assignments
+// can be omitted.
+//
+// The override applies to all the Ninja files written by the Context after the
+// call, until it is removed by ClearPoolOverrides.
+func (c *Context) SetPoolOverride(pool Pool, depth int) {
+	if _, ok := pool.(*builtinPool); ok && depth > 0 {
+		panic(fmt.Errorf("cannot override the depth of built-in pool %s", pool))
+	}
+	if c.poolOverrides == nil {
+		c.poolOverrides = make(map[Pool]int)
+	}
+	c.poolOverrides[pool] = depth
+}
+
+// ClearPoolOverrides removes all the overrides set by SetPoolOverride.
+func (c *Context) ClearPoolOverrides() {
+	c.poolOverrides = nil
+}
+
+// isPoolOmitted returns true if the assignments of pool are omitted by
+// SetPoolOverride.
+func (c *Context) isPoolOmitted(pool Pool) bool {
+	depth, ok := c.poolOverrides[pool]
+	return ok && depth <= 0
+}
+
+// ruleWithPoolOverride returns def without its pool assignment if it is
+// omitted by SetPoolOverride.
+func (c *Context) ruleWithPoolOverride(def *ruleDef) *ruleDef {
+	if def.Pool == nil || !c.isPoolOmitted(def.Pool) {
+		return def
+	}
+	withoutPool := *def
+	withoutPool.Pool = nil
+	return &withoutPool
+}
+
+// buildWithPoolOverride returns def without its pool assignment if it is
+// omitted by SetPoolOverride.
+func (c *Context) buildWithPoolOverride(def *buildDef) *buildDef {
+	if def.Pool == nil || !c.isPoolOmitted(def.Pool) {
+		return def
+	}
+	withoutPool := *def
+	withoutPool.Pool = nil
+	return &withoutPool
+}
+
+// withDefaultDescription returns def with a description synthesized from the
+// name of rule if default descriptions are enabled and def has none.
+func (c *Context) withDefaultDescription(rule Rule, def *ruleDef) (*ruleDef, error) {
+	if !c.emitDefaultDescriptions || def.Variables["description"] != nil {
+		return def, nil
+	}
+
+	description, err := parseNinjaString(rule.scope(), rule.name()+" $out")
+	if err != nil {
+		return nil, err
+	}
+
+	withDescription := *def
+	withDescription.Variables = make(map[string]*ninjaString, len(def.Variables)+1)
+	for name, value := range def.Variables {
+		withDescription.Variables[name] = value
+	}
+	withDescription.Variables["description"] = description
+
+	return &withDescription, nil
+}
+
+// SetEmitPoolTargets enables or disables writing a phony target for each
+// package-scoped pool, named like the pool, that depends on the outputs of the
+// build statements that run in the pool, so that, for example, everything in a
+// link pool can be built with a single Ninja target.  A build statement runs in
+// the pool it sets, or in the pool of its rule if it sets none, as amended by
+// SetPoolOverride.  The pools that no build statement runs in are skipped.
+func (c *Context) SetEmitPoolTargets(emit bool) {
+	c.emitPoolTargets = emit
+}
+
+// writeAlwaysRunTarget writes the phony target that the build statements of
+// rules with AlwaysRun set depend on, if there are any.
+func (c *Context) writeAlwaysRunTarget(nw *ninjaWriter) error {
+	usesAlwaysRun := func(defs *localBuildActions) bool {
+		for _, buildDef := range defs.buildDefs {
+			if buildDef.RuleDef != nil && buildDef.RuleDef.AlwaysRun {
+				return true
+			}
+		}
+		return false
+	}
+
+	found := false
+	for _, module := range c.moduleInfo {
+		found = found || usesAlwaysRun(&module.actionDefs)
+	}
+	for _, info := range c.singletonInfo {
+		found = found || usesAlwaysRun(&info.actionDefs)
+	}
+	if !found {
+		return nil
+	}
+
+	err := nw.Comment("Always dirty dependency of the build statements of AlwaysRun rules")
+	if err != nil {
+		return err
+	}
+	err = nw.Build("", "phony", []string{alwaysRunTarget}, nil, nil, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return nw.BlankLine()
+}
+
+// writePoolTargets writes the phony targets of SetEmitPoolTargets.
+func (c *Context) writePoolTargets(nw *ninjaWriter) error {
+	members := make(map[Pool][]string)
+	addMembers := func(defs *localBuildActions) {
+		for _, buildDef := range defs.buildDefs {
+			pool := buildDef.Pool
+			if pool == nil || c.isPoolOmitted(pool) {
+				pool = nil
+				if buildDef.RuleDef != nil && buildDef.RuleDef.Pool != nil &&
+					!c.isPoolOmitted(buildDef.RuleDef.Pool) {
+					pool = buildDef.RuleDef.Pool
+				}
+			}
+			if _, ok := c.globalPools[pool]; !ok {
+				continue
+			}
+			members[pool] = append(members[pool],
+				valueList(buildDef.Outputs, c.pkgNames, outputEscaper)...)
+		}
+	}
+	for _, module := range c.moduleInfo {
+		addMembers(&module.actionDefs)
+	}
+	for _, info := range c.singletonInfo {
+		addMembers(&info.actionDefs)
+	}
+
+	pools := make([]globalEntity, 0, len(members))
+	for pool := range members {
+		pools = append(pools, pool)
+	}
+	sort.Sort(&globalEntitySorter{c.pkgNames, pools})
+
+	if len(pools) > 0 {
+		err := nw.Comment("Outputs of the build statements in each pool")
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, entity := range pools {
+		pool := entity.(Pool)
+		outputs := members[pool]
+		sort.Strings(outputs)
+
+		err := nw.Build("", Phony.fullName(c.pkgNames),
+			[]string{pool.fullName(c.pkgNames)}, nil, outputs, nil, nil, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (c *Context) writeGlobalVariables(nw *ninjaWriter) error {
 	visited := make(map[Variable]bool)
 
@@ -3238,7 +4053,13 @@ func (c *Context) writeGlobalVariables(nw *ninjaWriter) error {
 			}
 		}
 
-		err := nw.Assign(v.fullName(c.pkgNames), value.Value(c.pkgNames))
+		pkgPath, ok := VariablePackage(v)
+		err := c.writeSourceComment(nw, pkgPath, ok)
+		if err != nil {
+			return err
+		}
+
+		err = nw.Assign(v.fullName(c.pkgNames), value.Value(c.pkgNames))
 		if err != nil {
 			return err
 		}
@@ -3283,7 +4104,19 @@ func (c *Context) writeGlobalPools(nw *ninjaWriter) error {
 		pool := entity.(Pool)
 		name := pool.fullName(c.pkgNames)
 		def := c.globalPools[pool]
-		err := def.WriteTo(nw, name)
+		if depth := c.poolOverrides[pool]; depth > 0 {
+			overridden := *def
+			overridden.Depth = depth
+			def = &overridden
+		}
+
+		pkgPath, ok := PoolPackage(pool)
+		err := c.writeSourceComment(nw, pkgPath, ok)
+		if err != nil {
+			return err
+		}
+
+		err = def.WriteTo(nw, name)
 		if err != nil {
 			return err
 		}
@@ -3308,8 +4141,18 @@ func (c *Context) writeGlobalRules(nw *ninjaWriter) error {
 	for _, entity := range globalRules {
 		rule := entity.(Rule)
 		name := rule.fullName(c.pkgNames)
-		def := c.globalRules[rule]
-		err := def.WriteTo(nw, name, c.pkgNames)
+		def, err := c.withDefaultDescription(rule, c.globalRules[rule])
+		if err != nil {
+			return err
+		}
+
+		pkgPath, ok := RulePackage(rule)
+		err = c.writeSourceComment(nw, pkgPath, ok)
+		if err != nil {
+			return err
+		}
+
+		err = c.ruleWithPoolOverride(def).WriteTo(nw, name, c.pkgNames)
 		if err != nil {
 			return err
 		}
@@ -3530,7 +4373,7 @@ func (c *Context) writeLocalBuildActions(nw *ninjaWriter,
 			panic(err)
 		}
 
-		err = def.WriteTo(nw, name, c.pkgNames)
+		err = c.ruleWithPoolOverride(def).WriteTo(nw, name, c.pkgNames)
 		if err != nil {
 			return err
 		}
@@ -3543,12 +4386,12 @@ func (c *Context) writeLocalBuildActions(nw *ninjaWriter,
 
 	// Write the build definitions.
 	for _, buildDef := range defs.buildDefs {
-		err := buildDef.WriteTo(nw, c.pkgNames)
+		err := c.buildWithPoolOverride(buildDef).WriteTo(nw, c.pkgNames)
 		if err != nil {
 			return err
 		}
 
-		if len(buildDef.Args) > 0 {
+		if len(buildDef.Args) > 0 || len(buildDef.LocalVariables) > 0 {
 			err = nw.BlankLine()
 			if err != nil {
 				return err
@@ -3607,6 +4450,17 @@ func funcName(f interface{}) string {
 	return runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name()
 }
 
+// funcPkgPath returns the package path part of a full Go function name as
+// returned by funcName, for example "github.com/google/blueprint" for
+// "github.com/google/blueprint.(*Context).ModuleName".
+func funcPkgPath(name string) string {
+	slash := strings.LastIndex(name, "/")
+	if dot := strings.Index(name[slash+1:], "."); dot >= 0 {
+		return name[:slash+1+dot]
+	}
+	return name
+}
+
 var fileHeaderTemplate = `******************************************************************************
 ***            This file is generated and should not be edited             ***
 ******************************************************************************
@@ -508,3 +508,655 @@ func TestParseFailsForModuleWithoutName(t *testing.T) {
 		t.Errorf("Incorrect errors; expected:\n%s\ngot:\n%s", expectedErrs, errs)
 	}
 }
+
+func TestRegisterModuleTypeChecked(t *testing.T) {
+	ctx := NewContext()
+	ctx.RegisterModuleTypeChecked("foo_module", newFooModule)
+	if _, ok := ctx.moduleFactories["foo_module"]; !ok {
+		t.Errorf("foo_module was not registered")
+	}
+
+	testCases := []struct {
+		properties interface{}
+		err        string
+	}{
+		{
+			properties: &struct {
+				Nested struct {
+					Flags map[string]string
+				}
+			}{},
+			err: "unsupported kind for field nested.flags: map",
+		},
+		{
+			properties: &struct {
+				Nested *struct {
+					Srcs []int
+				}
+			}{},
+			err: "field nested.srcs is a non-string slice",
+		},
+		{
+			properties: &struct {
+				Count int
+			}{},
+			err: `int field count must be tagged blueprint:"mutated"`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		properties := testCase.properties
+		func() {
+			defer func() {
+				want := `invalid properties for module type "bad_module": ` + testCase.err
+				r := recover()
+				if err, ok := r.(error); !ok || err.Error() != want {
+					t.Errorf("expected panic %q, got %v", want, r)
+				}
+			}()
+
+			ctx.RegisterModuleTypeChecked("bad_module", func() (Module, []interface{}) {
+				return &fooModule{}, []interface{}{properties}
+			})
+		}()
+	}
+}
+
+func TestRegisterModuleTypeAlias(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Blueprints": []byte(`
+			old_foo_module {
+			    name: "A",
+			}
+		`),
+	})
+
+	ctx.RegisterModuleType("foo_module", newFooModule)
+	ctx.RegisterModuleTypeAlias("old_foo_module", "foo_module")
+	_, errs := ctx.ParseBlueprintsFiles("Blueprints")
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+
+	a := ctx.modulesFromName("A", nil)[0]
+	if a.typeName != "foo_module" {
+		t.Errorf("expected type name %q, got %q", "foo_module", a.typeName)
+	}
+
+	want := []string{`Blueprints:2:4: module type "old_foo_module" is deprecated, use "foo_module"`}
+	if warnings := ctx.Warnings(); !reflect.DeepEqual(warnings, want) {
+		t.Errorf("expected warnings %q, got %q", want, warnings)
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("expected a panic registering an alias with an existing name")
+			}
+		}()
+		ctx.RegisterModuleTypeAlias("foo_module", "foo_module")
+	}()
+}
+
+func TestCloneModuleType(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Blueprints": []byte(`
+			foo_module {
+			    name: "A",
+			}
+
+			host_foo_module {
+			    name: "B",
+			}
+		`),
+	})
+
+	ctx.RegisterModuleType("foo_module", newFooModule)
+	ctx.CloneModuleType("foo_module", "host_foo_module")
+	_, errs := ctx.ParseBlueprintsFiles("Blueprints")
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+
+	a := ctx.modulesFromName("A", nil)[0]
+	b := ctx.modulesFromName("B", nil)[0]
+	if a.typeName != "foo_module" {
+		t.Errorf("expected type name %q, got %q", "foo_module", a.typeName)
+	}
+	if b.typeName != "host_foo_module" {
+		t.Errorf("expected type name %q, got %q", "host_foo_module", b.typeName)
+	}
+	if _, ok := b.logicModule.(*fooModule); !ok {
+		t.Errorf("expected B to be a *fooModule, got %T", b.logicModule)
+	}
+
+	for _, names := range [][2]string{
+		{"foo_module", "host_foo_module"},
+		{"bar_module", "host_bar_module"},
+	} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("expected a panic cloning %q as %q", names[0], names[1])
+				}
+			}()
+			ctx.CloneModuleType(names[0], names[1])
+		}()
+	}
+}
+
+func TestDuplicateModuleType(t *testing.T) {
+	ctx := NewContext()
+	ctx.RegisterModuleType("foo_module", newFooModule)
+	ctx.RegisterModuleTypeAlias("old_foo_module", "foo_module")
+
+	for _, name := range []string{"foo_module", "old_foo_module"} {
+		func() {
+			defer func() {
+				err, ok := recover().(error)
+				want := `module type "` + name + `" from package "github.com/google/blueprint" ` +
+					`is already registered by package "github.com/google/blueprint"`
+				if !ok || err.Error() != want {
+					t.Errorf("expected panic %q, got %v", want, err)
+				}
+			}()
+			ctx.RegisterModuleType(name, newBarModule)
+		}()
+	}
+}
+
+func TestRequireModuleType(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Blueprints": []byte(`
+			foo_module {
+			    name: "A",
+			}
+		`),
+	})
+
+	ctx.RegisterModuleType("foo_module", newFooModule)
+	ctx.RequireModuleType("foo_module", "bar_module")
+	ctx.RequireModuleType("foo_module", "old_bar_module")
+	ctx.RequireModuleType("foo_module", "baz_module")
+
+	_, errs := ctx.ParseBlueprintsFiles("Blueprints")
+	want := []string{
+		`module type "foo_module" requires module type "bar_module", which is not registered`,
+		`module type "foo_module" requires module type "old_bar_module", which is not registered`,
+		`module type "foo_module" requires module type "baz_module", which is not registered`,
+	}
+	var g []string
+	for _, err := range errs {
+		g = append(g, err.Error())
+	}
+	if !reflect.DeepEqual(g, want) {
+		t.Errorf("incorrect errors:\nwant: %q\n got: %q", want, g)
+	}
+
+	// The required module types may be registered after the requirement.
+	ctx.RegisterModuleType("bar_module", newBarModule)
+	ctx.RegisterModuleTypeAlias("old_bar_module", "bar_module")
+	ctx.RegisterModuleType("baz_module", newBarModule)
+	_, errs = ctx.ParseBlueprintsFiles("Blueprints")
+	if len(errs) > 0 {
+		t.Errorf("unexpected parse errors: %v", errs)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("expected a panic adding a requirement to an unregistered module type")
+		}
+	}()
+	ctx.RequireModuleType("qux_module", "foo_module")
+}
+
+func TestRegisteredModuleTypes(t *testing.T) {
+	ctx := newContext()
+	ctx.RegisterModuleType("foo_module", newFooModule)
+	ctx.RegisterModuleType("bar_module", newBarModule)
+	ctx.RegisterModuleTypeAlias("old_foo_module", "foo_module")
+	ctx.RegisterModuleTypeAlias("older_foo_module", "foo_module")
+
+	moduleTypes := ctx.RegisteredModuleTypes()
+	if len(moduleTypes) != 2 {
+		t.Fatalf("expected 2 module types, got %d", len(moduleTypes))
+	}
+
+	bar, foo := moduleTypes[0], moduleTypes[1]
+	if bar.Name != "bar_module" || foo.Name != "foo_module" {
+		t.Errorf("expected bar_module and foo_module, got %q and %q", bar.Name, foo.Name)
+	}
+	if bar.Aliases != nil {
+		t.Errorf("expected no aliases for bar_module, got %q", bar.Aliases)
+	}
+	if want := []string{"old_foo_module", "older_foo_module"}; !reflect.DeepEqual(foo.Aliases, want) {
+		t.Errorf("expected aliases %q for foo_module, got %q", want, foo.Aliases)
+	}
+	if want := "github.com/google/blueprint.newFooModule"; foo.GoFactory != want {
+		t.Errorf("expected Go factory %q, got %q", want, foo.GoFactory)
+	}
+	if want := "github.com/google/blueprint"; foo.PkgPath != want {
+		t.Errorf("expected package path %q, got %q", want, foo.PkgPath)
+	}
+}
+
+var (
+	pctxDepsZ = NewPackageContext("github.com/google/blueprint/deps_z/pkg")
+	pctxDepsA = NewPackageContext("github.com/google/blueprint/deps_a/pkg")
+
+	depsZVar = pctxDepsZ.StaticVariable("depsZVar", "z")
+	depsAVar = pctxDepsA.StaticVariable("depsAVar", "a")
+)
+
+func init() {
+	pctxDepsZ.AddNinjaFileDeps("z.go")
+	pctxDepsA.AddNinjaFileDeps("a.go")
+}
+
+func TestMakeUniquePackageNamesDeps(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		live := newLiveTracker(nil)
+		live.variables[depsZVar] = simpleNinjaString("z")
+		live.variables[depsAVar] = simpleNinjaString("a")
+
+		ctx := newContext()
+		pkgNames, deps := ctx.makeUniquePackageNames(live)
+
+		// The packages share the short name "pkg", so the deps of both must be
+		// reported, in package path order.
+		if want := []string{"a.go", "z.go"}; !reflect.DeepEqual(deps, want) {
+			t.Fatalf("expected deps %q, got %q", want, deps)
+		}
+		if len(pkgNames) != 2 || pkgNames[pctxDepsA.(*packageContext)] == "pkg" {
+			t.Fatalf("expected full package names, got %v", pkgNames)
+		}
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Blueprints": []byte(`
+			old_test_module {
+			    name: "A",
+			}
+		`),
+	})
+	ctx.RegisterModuleType("test_module", func() (Module, []interface{}) {
+		m := &pctxTestModule{generate: func(ctx ModuleContext) {
+			ctx.Build(pctxTest, BuildParams{
+				Rule:    pctxTestRule,
+				Outputs: []string{"${deprecatedVar}/out"},
+			})
+		}}
+		return m, []interface{}{&m.SimpleName.Properties}
+	})
+	ctx.RegisterModuleTypeAlias("old_test_module", "test_module")
+
+	diagnostics := NewDiagnostics()
+	ctx.SetDiagnostics(diagnostics)
+
+	_, errs := ctx.ParseBlueprintsFiles("Blueprints")
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+
+	// The same warnings are found by each call to PrepareBuildActions, but
+	// they are only recorded once.
+	for i := 0; i < 2; i++ {
+		_, errs = ctx.PrepareBuildActions(nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+	}
+
+	want := []string{
+		`Blueprints:2:4: module type "old_test_module" is deprecated, use "test_module"`,
+		`variable ${pctx_test.deprecatedVar} is deprecated, use ${pctx_test.newVar} (referenced by module "A")`,
+	}
+	if g := diagnostics.Warnings(); !reflect.DeepEqual(g, want) {
+		t.Errorf("incorrect warnings:\nwant: %q\n got: %q", want, g)
+	}
+	if g := ctx.Warnings(); !reflect.DeepEqual(g, want) {
+		t.Errorf("incorrect Context warnings:\nwant: %q\n got: %q", want, g)
+	}
+
+	var nilDiagnostics *Diagnostics
+	nilDiagnostics.Warningf("discarded")
+	if g := nilDiagnostics.Warnings(); g != nil {
+		t.Errorf("expected no warnings, got %q", g)
+	}
+}
+
+// ninjaStatements splits the Ninja file out into its statements, keyed by
+// their first line. Each statement includes its indented lines and the comment
+// lines directly before it.
+func ninjaStatements(out string) map[string]string {
+	statements := make(map[string]string)
+	var comments, key string
+	for _, line := range strings.SplitAfter(out, "\n") {
+		switch {
+		case strings.TrimSpace(line) == "":
+			comments, key = "", ""
+		case strings.HasPrefix(line, "#"):
+			comments += line
+			key = ""
+		case strings.HasPrefix(line, " "):
+			if key != "" {
+				statements[key] += line
+			}
+		default:
+			key = strings.TrimSuffix(line, "\n")
+			statements[key] = comments + line
+			comments = ""
+		}
+	}
+	return statements
+}
+
+// checkNinjaStatements checks the statements of the Ninja file out against
+// want, where an empty statement must not appear in out.
+func checkNinjaStatements(t *testing.T, out string, want map[string]string) {
+	t.Helper()
+	statements := ninjaStatements(out)
+	for key, w := range want {
+		if g := statements[key]; g != w {
+			t.Errorf("incorrect statement %q:\nwant: %q\n got: %q\noutput:\n%s", key, w, g, out)
+		}
+	}
+}
+
+func TestPoolOverride(t *testing.T) {
+	generate := func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestPoolRule,
+			Outputs: []string{"default"},
+		})
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestPoolRule,
+			Pool:    Console,
+			Outputs: []string{"console"},
+		})
+	}
+
+	const (
+		pool    = "pool g.pctx_test.pctxTestPool"
+		rule    = "rule g.pctx_test.pctxTestPoolRule"
+		console = "build console: g.pctx_test.pctxTestPoolRule"
+	)
+	defaults := map[string]string{
+		pool:    pool + "\n    depth = 2\n",
+		rule:    rule + "\n    pool = g.pctx_test.pctxTestPool\n    command = cp ${in} ${out}\n",
+		console: console + "\n    pool = console\n",
+	}
+
+	testCases := []struct {
+		name  string
+		setup func(ctx *Context)
+		want  map[string]string
+	}{
+		{
+			name:  "none",
+			setup: func(ctx *Context) {},
+			want:  defaults,
+		},
+		{
+			name: "depth",
+			setup: func(ctx *Context) {
+				ctx.SetPoolOverride(pctxTestPool, 8)
+			},
+			want: map[string]string{
+				pool:    pool + "\n    depth = 8\n",
+				rule:    defaults[rule],
+				console: defaults[console],
+			},
+		},
+		{
+			name: "omitted",
+			setup: func(ctx *Context) {
+				ctx.SetPoolOverride(pctxTestPool, 0)
+				ctx.SetPoolOverride(Console, 0)
+			},
+			want: map[string]string{
+				pool:    defaults[pool],
+				rule:    rule + "\n    command = cp ${in} ${out}\n",
+				console: console + "\n",
+			},
+		},
+		{
+			name: "cleared",
+			setup: func(ctx *Context) {
+				ctx.SetPoolOverride(pctxTestPool, 8)
+				ctx.SetPoolOverride(Console, 0)
+				ctx.ClearPoolOverrides()
+			},
+			want: defaults,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, _ := writePctxTest(t, nil, generate)
+			tc.setup(ctx)
+			checkNinjaStatements(t, writeBuildFile(t, ctx), tc.want)
+		})
+	}
+
+	if g, _ := pctxTestPool.def(nil); g.Depth != 2 {
+		t.Errorf("expected the pool definition to keep depth 2, got %d", g.Depth)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("expected a panic overriding the depth of the console pool")
+		}
+	}()
+	NewContext().SetPoolOverride(Console, 2)
+}
+
+func TestEmitPoolTargets(t *testing.T) {
+	generate := func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestPoolRule,
+			Outputs: []string{"rule_pool"},
+		})
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestRule,
+			Pool:    pctxTestPool,
+			Outputs: []string{"build_pool"},
+		})
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestPoolRule,
+			Pool:    Console,
+			Outputs: []string{"console"},
+		})
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestRule,
+			Outputs: []string{"no_pool"},
+		})
+	}
+
+	const target = "build g.pctx_test.pctxTestPool: phony build_pool rule_pool"
+
+	testCases := []struct {
+		name  string
+		setup func(ctx *Context)
+		want  map[string]string
+	}{
+		{
+			name:  "disabled",
+			setup: func(ctx *Context) {},
+			want:  map[string]string{target: ""},
+		},
+		{
+			name: "enabled",
+			setup: func(ctx *Context) {
+				ctx.SetEmitPoolTargets(true)
+			},
+			want: map[string]string{
+				target: "# Outputs of the build statements in each pool\n" + target + "\n",
+			},
+		},
+		{
+			// The build statements whose pool assignments are omitted do not
+			// run in the pool.
+			name: "omitted",
+			setup: func(ctx *Context) {
+				ctx.SetEmitPoolTargets(true)
+				ctx.SetPoolOverride(pctxTestPool, 0)
+			},
+			want: map[string]string{target: ""},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, _ := writePctxTest(t, nil, generate)
+			tc.setup(ctx)
+			out := writeBuildFile(t, ctx)
+			checkNinjaStatements(t, out, tc.want)
+
+			// The console pool has no phony target.
+			var phony []string
+			for key := range ninjaStatements(out) {
+				if strings.Contains(key, ": phony ") {
+					phony = append(phony, key)
+				}
+			}
+			wantPhony := 0
+			if tc.want[target] != "" {
+				wantPhony = 1
+			}
+			if len(phony) != wantPhony {
+				t.Errorf("want %d phony targets, got %q in output:\n%s", wantPhony, phony, out)
+			}
+		})
+	}
+}
+
+func TestEmitDefaultDescriptions(t *testing.T) {
+	generate := func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestPoolRule,
+			Outputs: []string{"out"},
+		})
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    Touch,
+			Outputs: []string{"stamp"},
+		})
+	}
+
+	const (
+		rule  = "rule g.pctx_test.pctxTestPoolRule"
+		touch = "rule touch"
+	)
+
+	testCases := []struct {
+		name    string
+		enabled bool
+		want    map[string]string
+	}{
+		{
+			name: "disabled",
+			want: map[string]string{
+				rule: rule + "\n    pool = g.pctx_test.pctxTestPool\n" +
+					"    command = cp ${in} ${out}\n",
+				// The built-in touch rule has its own description.
+				touch: touch + "\n    command = touch ${out}\n    description = touch ${out}\n",
+			},
+		},
+		{
+			name:    "enabled",
+			enabled: true,
+			want: map[string]string{
+				rule: rule + "\n    pool = g.pctx_test.pctxTestPool\n" +
+					"    command = cp ${in} ${out}\n    description = pctxTestPoolRule ${out}\n",
+				touch: touch + "\n    command = touch ${out}\n    description = touch ${out}\n",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, _ := writePctxTest(t, nil, generate)
+			ctx.SetEmitDefaultDescriptions(tc.enabled)
+			checkNinjaStatements(t, writeBuildFile(t, ctx), tc.want)
+		})
+	}
+}
+
+func TestEmitSourceComments(t *testing.T) {
+	generate := func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestPoolRule,
+			Inputs:  []string{"${dynBase}"},
+			Outputs: []string{"out"},
+		})
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    Touch,
+			Outputs: []string{"stamp"},
+		})
+	}
+
+	const (
+		comment  = "# defined in github.com/google/blueprint/pctx_test\n"
+		variable = "g.pctx_test.dynBase = -O2"
+		pool     = "pool g.pctx_test.pctxTestPool"
+		rule     = "rule g.pctx_test.pctxTestPoolRule"
+		touch    = "rule touch"
+	)
+	statements := map[string]string{
+		variable: variable + "\n",
+		pool:     pool + "\n    depth = 2\n",
+		rule:     rule + "\n    pool = g.pctx_test.pctxTestPool\n    command = cp ${in} ${out}\n",
+		touch:    touch + "\n    command = touch ${out}\n    description = touch ${out}\n",
+	}
+
+	testCases := []struct {
+		name    string
+		enabled bool
+		want    map[string]string
+	}{
+		{
+			name: "disabled",
+			want: statements,
+		},
+		{
+			name:    "enabled",
+			enabled: true,
+			want: map[string]string{
+				variable: comment + statements[variable],
+				pool:     comment + statements[pool],
+				rule:     comment + statements[rule],
+				// The built-in touch rule does not belong to a package.
+				touch: statements[touch],
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, _ := writePctxTest(t, nil, generate)
+			ctx.SetEmitSourceComments(tc.enabled)
+			checkNinjaStatements(t, writeBuildFile(t, ctx), tc.want)
+		})
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// A Diagnostics collects the non-fatal warnings that are found while parsing
+// Blueprints files and generating build actions.  Each distinct warning is
+// recorded once, and the warnings are returned in sorted order so that they do
+// not depend on the order in which modules are processed.
+//
+// Each Context records its warnings in its own Diagnostics, which are returned
+// by Context.Warnings, see Context.SetDiagnostics for sharing one.  All the
+// methods of a nil *Diagnostics may be called and the warnings passed to it are
+// discarded.
+type Diagnostics struct {
+	lock     sync.Mutex
+	warnings map[string]bool
+}
+
+// NewDiagnostics returns an empty Diagnostics.
+func NewDiagnostics() *Diagnostics {
+	return &Diagnostics{
+		warnings: make(map[string]bool),
+	}
+}
+
+// Warningf records a warning.  It may be called concurrently.
+func (d *Diagnostics) Warningf(format string, args ...interface{}) {
+	if d == nil {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.warnings[fmt.Sprintf(format, args...)] = true
+}
+
+// Warnings returns the sorted distinct warnings that have been recorded.
+func (d *Diagnostics) Warnings() []string {
+	if d == nil {
+		return nil
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	warnings := make([]string, 0, len(d.warnings))
+	for warning := range d.warnings {
+		warnings = append(warnings, warning)
+	}
+	sort.Strings(warnings)
+
+	return warnings
+}
@@ -14,7 +14,11 @@
 
 package blueprint
 
-import "sync"
+import (
+	"fmt"
+	"sync"
+	"time"
+)
 
 // A liveTracker tracks the values of live variables, rules, and pools.  An
 // entity is made "live" when it is referenced directly or indirectly by a build
@@ -27,6 +31,17 @@ type liveTracker struct {
 	variables map[Variable]*ninjaString
 	pools     map[Pool]*poolDef
 	rules     map[Rule]*ruleDef
+
+	rspfileRules map[Rule]Rule // The variants of rules with an RspfileThreshold.
+
+	hasValidations bool // Whether a build statement has Validations, which need Ninja 1.11.
+
+	deprecations []string        // The warnings about references to deprecated entities.
+	warned       map[string]bool // Used to report each warning only once.
+
+	diagnostics *Diagnostics // Receives the warnings.
+
+	checkUnusedRuleArgs bool // set by Context.SetCheckUnusedRuleArgs
 }
 
 func newLiveTracker(config interface{}) *liveTracker {
@@ -35,19 +50,100 @@ func newLiveTracker(config interface{}) *liveTracker {
 		variables: make(map[Variable]*ninjaString),
 		pools:     make(map[Pool]*poolDef),
 		rules:     make(map[Rule]*ruleDef),
+		warned:    make(map[string]bool),
+
+		rspfileRules: make(map[Rule]Rule),
 	}
 }
 
-func (l *liveTracker) AddBuildDefDeps(def *buildDef) error {
+// AddBuildDefDeps makes everything referenced by def live.  The referer
+// argument describes where the build statement was defined and is used in
+// warnings.
+func (l *liveTracker) AddBuildDefDeps(def *buildDef, referer string) error {
 	l.Lock()
 	defer l.Unlock()
 
+	l.checkDeprecatedRefs(referer, def.Outputs...)
+	l.checkDeprecatedRefs(referer, def.ImplicitOutputs...)
+	l.checkDeprecatedRefs(referer, def.Inputs...)
+	l.checkDeprecatedRefs(referer, def.Implicits...)
+	l.checkDeprecatedRefs(referer, def.OrderOnly...)
+	l.checkDeprecatedRefs(referer, def.Validations...)
+	for _, value := range def.Variables {
+		l.checkDeprecatedRefs(referer, value)
+	}
+	for _, value := range def.Args {
+		l.checkDeprecatedRefs(referer, value)
+	}
+	for _, value := range def.LocalVariables {
+		l.checkDeprecatedRefs(referer, value)
+	}
+
+	if def.UnresolvedRule == nil {
+		def.UnresolvedRule, def.UnresolvedArgs = def.Rule, def.Args
+	}
+
+	if sr, ok := def.Rule.(*selectedRule); ok {
+		rule, err := sr.selectRule(l.config, def)
+		if err != nil {
+			return err
+		}
+		def.Rule = rule
+	}
+
 	ruleDef, err := l.addRule(def.Rule)
 	if err != nil {
 		return err
 	}
+
+	if ruleDef != nil && ruleDef.RspfileThreshold > 0 &&
+		def.InputsLength > ruleDef.RspfileThreshold {
+
+		rspRule, ok := l.rspfileRules[def.Rule]
+		if !ok {
+			variant := &rspfileRule{def.Rule}
+			err = variant.checkNameCollision()
+			if err != nil {
+				return err
+			}
+			rspRule = variant
+			l.rspfileRules[def.Rule] = rspRule
+		}
+		def.Rule = rspRule
+
+		ruleDef, err = l.addRule(rspRule)
+		if err != nil {
+			return err
+		}
+	}
 	def.RuleDef = ruleDef
 
+	err = def.checkOutputExtension()
+	if err != nil {
+		return err
+	}
+
+	if ruleDef != nil && len(ruleDef.ArgDefaults) > 0 {
+		// Copy the args so that UnresolvedArgs keeps only the given ones.
+		args := make(map[Variable]*ninjaString, len(def.Args)+len(ruleDef.ArgDefaults))
+		for argVar, value := range def.Args {
+			args[argVar] = value
+		}
+		for argVar, value := range ruleDef.ArgDefaults {
+			if _, ok := args[argVar]; !ok {
+				args[argVar] = value
+			}
+		}
+		def.Args = args
+	}
+
+	if def.Pool != nil {
+		err = l.addPool(def.Pool)
+		if err != nil {
+			return err
+		}
+	}
+
 	err = l.addNinjaStringListDeps(def.Outputs)
 	if err != nil {
 		return err
@@ -68,6 +164,14 @@ func (l *liveTracker) AddBuildDefDeps(def *buildDef) error {
 		return err
 	}
 
+	err = l.addNinjaStringListDeps(def.Validations)
+	if err != nil {
+		return err
+	}
+	if len(def.Validations) > 0 {
+		l.hasValidations = true
+	}
+
 	for _, value := range def.Variables {
 		err = l.addNinjaStringDeps(value)
 		if err != nil {
@@ -82,13 +186,20 @@ func (l *liveTracker) AddBuildDefDeps(def *buildDef) error {
 		}
 	}
 
+	for _, value := range def.LocalVariables {
+		err = l.addNinjaStringDeps(value)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 func (l *liveTracker) addRule(r Rule) (def *ruleDef, err error) {
 	def, ok := l.rules[r]
 	if !ok {
-		def, err = r.def(l.config)
+		def, err = l.ruleDef(r)
 		if err == errRuleIsBuiltin {
 			// No need to do anything for built-in rules.
 			return nil, nil
@@ -97,6 +208,13 @@ func (l *liveTracker) addRule(r Rule) (def *ruleDef, err error) {
 			return nil, err
 		}
 
+		if l.checkUnusedRuleArgs {
+			err = checkRuleArgUsage(r, def)
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		if def.Pool != nil {
 			err = l.addPool(def.Pool)
 			if err != nil {
@@ -121,16 +239,88 @@ func (l *liveTracker) addRule(r Rule) (def *ruleDef, err error) {
 			}
 		}
 
+		for _, value := range def.ArgDefaults {
+			err = l.addNinjaStringDeps(value)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		referer := "rule " + r.String()
+		l.checkDeprecatedRefs(referer, def.CommandDeps...)
+		l.checkDeprecatedRefs(referer, def.CommandOrderOnly...)
+		for _, value := range def.Variables {
+			l.checkDeprecatedRefs(referer, value)
+		}
+		for _, value := range def.ArgDefaults {
+			l.checkDeprecatedRefs(referer, value)
+		}
+
 		l.rules[r] = def
 	}
 
 	return
 }
 
+// reevaluate computes the values of all the live variables again, for example
+// after the config object has changed.  The live rules and pools are dropped,
+// because only build statements make them live, and the build statements
+// choose their rules for the config, so ReAddBuildDefDeps makes them live
+// again.
+func (l *liveTracker) reevaluate() error {
+	l.Lock()
+	defer l.Unlock()
+
+	variables := l.variables
+	l.variables = make(map[Variable]*ninjaString)
+	l.pools = make(map[Pool]*poolDef)
+	l.rules = make(map[Rule]*ruleDef)
+
+	for v := range variables {
+		err := l.addVariable(v)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReAddBuildDefDeps restores the Rule and Args of def from before
+// AddBuildDefDeps resolved them and makes everything referenced by def live
+// again, for example after reevaluate.
+func (l *liveTracker) ReAddBuildDefDeps(def *buildDef, referer string) error {
+	def.Rule, def.Args = def.UnresolvedRule, def.UnresolvedArgs
+	return l.AddBuildDefDeps(def, referer)
+}
+
+// ruleDef, poolDef and variableValue evaluate a live rule, pool or variable for
+// the config, recording the time they take when profiling is enabled.
+func (l *liveTracker) ruleDef(r Rule) (*ruleDef, error) {
+	if profiling() {
+		defer ruleDefsProfile.record(time.Now())
+	}
+	return r.def(l.config)
+}
+
+func (l *liveTracker) poolDef(p Pool) (*poolDef, error) {
+	if profiling() {
+		defer poolDefsProfile.record(time.Now())
+	}
+	return p.def(l.config)
+}
+
+func (l *liveTracker) variableValue(v Variable) (*ninjaString, error) {
+	if profiling() {
+		defer variableValuesProfile.record(time.Now())
+	}
+	return v.value(l.config)
+}
+
 func (l *liveTracker) addPool(p Pool) error {
 	_, ok := l.pools[p]
 	if !ok {
-		def, err := p.def(l.config)
+		def, err := l.poolDef(p)
 		if err == errPoolIsBuiltin {
 			// No need to do anything for built-in rules.
 			return nil
@@ -148,7 +338,7 @@ func (l *liveTracker) addPool(p Pool) error {
 func (l *liveTracker) addVariable(v Variable) error {
 	_, ok := l.variables[v]
 	if !ok {
-		value, err := v.value(l.config)
+		value, err := l.variableValue(v)
 		if err == errVariableIsArg {
 			// This variable is a placeholder for an argument that can be passed
 			// to a rule.  It has no value and thus doesn't reference any other
@@ -161,6 +351,8 @@ func (l *liveTracker) addVariable(v Variable) error {
 
 		l.variables[v] = value
 
+		l.checkDeprecatedRefs("variable "+v.String(), value)
+
 		err = l.addNinjaStringDeps(value)
 		if err != nil {
 			return err
@@ -190,6 +382,39 @@ func (l *liveTracker) addNinjaStringDeps(str *ninjaString) error {
 	return nil
 }
 
+// checkDeprecatedRefs records a warning for each deprecated variable that is
+// referenced directly by one of strs.  Each warning is only recorded once per
+// referer.
+func (l *liveTracker) checkDeprecatedRefs(referer string, strs ...*ninjaString) {
+	for _, str := range strs {
+		for _, v := range str.variables {
+			sv, ok := v.(*staticVariable)
+			if !ok {
+				continue
+			}
+			msg := sv.deprecationWarning()
+			if msg == "" {
+				continue
+			}
+			msg = fmt.Sprintf("%s (referenced by %s)", msg, referer)
+			if l.warn(msg) {
+				l.deprecations = append(l.deprecations, msg)
+			}
+		}
+	}
+}
+
+// warn records a warning unless it was already recorded, and returns whether
+// it was recorded.
+func (l *liveTracker) warn(msg string) bool {
+	if l.warned[msg] {
+		return false
+	}
+	l.warned[msg] = true
+	l.diagnostics.Warningf("%s", msg)
+	return true
+}
+
 func (l *liveTracker) RemoveVariableIfLive(v Variable) bool {
 	l.Lock()
 	defer l.Unlock()
@@ -14,6 +14,54 @@
 
 package blueprint
 
+import (
+	"fmt"
+	"sync"
+)
+
+// nameTransformer is set by SetNameTransformer.  It is read while the Ninja
+// file is written, so it is guarded by nameTransformerLock.
+var (
+	nameTransformerLock sync.RWMutex
+	nameTransformer     func(string) string
+)
+
+// SetNameTransformer sets a function that is applied to the full names of all
+// the variables, rules, and pools defined by packages, modules, and singletons
+// when they are written to the Ninja file, for example to add a prefix to all
+// of them.  Every reference to a name uses the transformed name.  The names of
+// Ninja's built-in rules and pools, and of the arguments of rules, are not
+// transformed.  The function must return valid Ninja names and may be called
+// concurrently.  Passing nil disables the transformation.
+//
+// It must be called before the Context methods that generate build actions.
+func SetNameTransformer(transform func(string) string) {
+	nameTransformerLock.Lock()
+	defer nameTransformerLock.Unlock()
+	nameTransformer = transform
+}
+
+// transformNinjaName applies the function set by SetNameTransformer to name.
+// It panics if the transformed name is not a valid Ninja name.
+func transformNinjaName(name string) string {
+	nameTransformerLock.RLock()
+	transform := nameTransformer
+	nameTransformerLock.RUnlock()
+	if transform == nil {
+		return name
+	}
+
+	transformed := transform(name)
+	if transformed == "" {
+		panic(fmt.Errorf("name transformer returned an empty name for %q", name))
+	}
+	if err := validateNinjaName(transformed); err != nil {
+		panic(fmt.Errorf("name transformer returned an invalid name for %q: %s",
+			name, err))
+	}
+	return transformed
+}
+
 func packageNamespacePrefix(packageName string) string {
 	return "g." + packageName + "."
 }
@@ -20,6 +20,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/google/blueprint/proptools"
 )
 
 // A Deps value indicates the dependency file format that Ninja should expect to
@@ -49,11 +51,28 @@ func (d Deps) String() string {
 // definition.
 type PoolParams struct {
 	Comment string // The comment that will appear above the definition.
-	Depth   int    // The Ninja pool depth.
+	Depth   int    // The Ninja pool depth, which must be at least 1.
 }
 
 // A RuleParams object contains the set of parameters that make up a Ninja rule
 // definition.
+//
+// Generator makes the rule a generator rule, which is written with "generator =
+// true": Ninja does not remove its outputs when cleaning and does not rebuild
+// them when only the command changes.  A generator rule only runs in the pool
+// set by its Pool field.  It is not given the default pool set by
+// PackageContext.SetPackageDefaultPool.  Phony can't be a generator rule.  A
+// phony build statement that depends on the manifest can be used to give the
+// outputs of a generator rule another name.
+//
+// Ninja allows Restat to be combined with all the other fields, including
+// Generator, so that a generator rule can skip regenerating the dependents of
+// a manifest that did not change.
+//
+// The string fields are parsed like Command, so they may only reference the
+// rule's arguments, Ninja's built-in variables such as $out, and the variables
+// visible within the package that defined the rule.  See
+// Context.SetEmitDefaultDescriptions for rules without a Description.
 type RuleParams struct {
 	// These fields correspond to a Ninja variable of the same name.
 	Command        string // The command that Ninja will run for the rule.
@@ -61,7 +80,7 @@ type RuleParams struct {
 	Deps           Deps   // The format of the dependency file.
 	Description    string // The description that Ninja will print for the rule.
 	Generator      bool   // Whether the rule generates the Ninja manifest file.
-	Pool           Pool   // The Ninja pool to which the rule belongs.
+	Pool           Pool   // The Ninja pool used by builds of the rule that don't set their own.
 	Restat         bool   // Whether Ninja should re-stat the rule's outputs.
 	Rspfile        string // The response file.
 	RspfileContent string // The response file content.
@@ -70,6 +89,59 @@ type RuleParams struct {
 	CommandDeps      []string // Command-specific implicit dependencies to prepend to builds
 	CommandOrderOnly []string // Command-specific order-only dependencies to prepend to builds
 	Comment          string   // The comment that will appear above the definition.
+
+	// RspfileThreshold, if positive, makes the build statements whose Inputs
+	// are longer than RspfileThreshold bytes, as written in their BuildParams,
+	// pass their inputs to the command through a response file.  Those build
+	// statements use a variant of the rule, named like the rule with a
+	// ".rsp" suffix, whose Command has each ${in} replaced by @${out}.rsp,
+	// with Rspfile set to ${out}.rsp and
+	// RspfileContent set to ${in}, so the command must accept the @file
+	// syntax.  Both variants share the Depfile and Deps settings, which are
+	// not affected by the response file.  It cannot be used together with
+	// Rspfile or RspfileContent, and the package may not define another rule
+	// with the name of the variant.
+	RspfileThreshold int
+
+	// PassthroughEnv lists the environment variables that are forwarded to the
+	// command with the values they have when the Ninja file is generated.  The
+	// command is written to the Ninja file after an export of each of them that
+	// is set, as in "export FOO='value' && <command>", and they are recorded by
+	// EnvDeps like the environment variables read by EnvVariables.  The names
+	// must be valid shell variable names.  The exported variables are only seen
+	// by the command, Rspfile and RspfileContent are expanded by Ninja and cannot
+	// reference them.  The command of the variant used for RspfileThreshold
+	// exports them too.
+	PassthroughEnv []string
+
+	// OutputExtension, if set, is the extension that all the explicit outputs
+	// of the build statements using the rule must have, such as ".pb.go".  An
+	// output is checked as it is written in BuildParams.Outputs, so it must end
+	// with the extension itself rather than with a variable reference, and a
+	// mismatch fails the build statement with the rule name and the output.  It
+	// may not contain '$' characters.
+	OutputExtension string
+
+	// AlwaysRun makes the build statements using the rule run on every build,
+	// for example to write a timestamp.  Each of them gets an implicit
+	// dependency on a phony target without inputs, which Ninja always
+	// considers dirty because no file exists for it, and so do the build
+	// statements that depend on their outputs, directly or not.  It cannot
+	// be used together with Restat, which could make those build statements
+	// up to date again.  It may be used with Generator, but then the rule
+	// must not write the Ninja file itself, which Ninja would regenerate
+	// forever.  The Phony rule has no RuleParams.  A phony build statement
+	// is dirty whenever one of its inputs is the output of an AlwaysRun rule.
+	// The name of the phony target, "_blueprint_always_run", is reserved and
+	// cannot be an output of a build statement.
+	AlwaysRun bool
+}
+
+// A RuleSegment is a labeled part of the command of a rule created by
+// SegmentedRule.
+type RuleSegment struct {
+	Name    string // The name of the segment, used in errors.
+	Command string // The part of the command, which may reference variables and arguments.
 }
 
 // A BuildParams object contains the set of parameters that make up a Ninja
@@ -82,12 +154,15 @@ type BuildParams struct {
 	Deps            Deps              // The format of the dependency file.
 	Description     string            // The description that Ninja will print for the build.
 	Rule            Rule              // The rule to invoke.
+	Pool            Pool              // The Ninja pool to use instead of the rule's pool.
 	Outputs         []string          // The list of explicit output targets.
 	ImplicitOutputs []string          // The list of implicit output targets.
 	Inputs          []string          // The list of explicit input dependencies.
 	Implicits       []string          // The list of implicit input dependencies.
 	OrderOnly       []string          // The list of order-only dependencies.
+	Validations     []string          // The list of validations (Ninja 1.11), built but not dependencies.
 	Args            map[string]string // The variable/value pairs to set.
+	LocalVariables  map[string]string // The variables to shadow for this build only.
 	Optional        bool              // Skip outputting a default statement
 }
 
@@ -101,6 +176,11 @@ type poolDef struct {
 func parsePoolParams(scope scope, params *PoolParams) (*poolDef,
 	error) {
 
+	err := validatePoolDepth(params.Depth)
+	if err != nil {
+		return nil, err
+	}
+
 	def := &poolDef{
 		Comment: params.Comment,
 		Depth:   params.Depth,
@@ -109,6 +189,13 @@ func parsePoolParams(scope scope, params *PoolParams) (*poolDef,
 	return def, nil
 }
 
+func validatePoolDepth(depth int) error {
+	if depth < 1 {
+		return fmt.Errorf("pool depth must be at least 1, got %d", depth)
+	}
+	return nil
+}
+
 func (p *poolDef) WriteTo(nw *ninjaWriter, name string) error {
 	if p.Comment != "" {
 		err := nw.Comment(p.Comment)
@@ -133,6 +220,41 @@ type ruleDef struct {
 	Comment          string
 	Pool             Pool
 	Variables        map[string]*ninjaString
+	RspfileThreshold int
+	PassthroughEnv   []string
+	OutputExtension  string
+	AlwaysRun        bool
+	ArgDefaults      map[Variable]*ninjaString // Written to the build statements that don't set them.
+}
+
+// poolNotVisibleError returns the error for a Pool param that is not visible in
+// the scope it is used in, which suggests importing the package that defined
+// the pool.
+func poolNotVisibleError(pool Pool) error {
+	if pkgPath, ok := PoolPackage(pool); ok {
+		return fmt.Errorf("Pool %s is not visible in this scope, it is "+
+			"defined by package %q which must be imported to use it", pool, pkgPath)
+	}
+	return fmt.Errorf("Pool %s is not visible in this scope", pool)
+}
+
+// validateRuleDepsParams returns an error if the Depfile and Deps fields of
+// params are inconsistent.  GCC style dependencies are read from the depfile,
+// which must therefore be set.  MSVC style dependencies are parsed from the
+// command output, so the depfile is optional for them.
+func validateRuleDepsParams(params *RuleParams) error {
+	switch params.Deps {
+	case DepsNone:
+		if params.Depfile != "" {
+			return fmt.Errorf("Depfile is set but Deps is not, did you mean " +
+				"to use DepsGCC?")
+		}
+	case DepsGCC:
+		if params.Depfile == "" {
+			return fmt.Errorf("Deps is DepsGCC but Depfile is not set")
+		}
+	}
+	return nil
 }
 
 func parseRuleParams(scope scope, params *RuleParams) (*ruleDef,
@@ -149,8 +271,13 @@ func parseRuleParams(scope scope, params *RuleParams) (*ruleDef,
 			"specified")
 	}
 
+	err := validateRuleDepsParams(params)
+	if err != nil {
+		return nil, err
+	}
+
 	if r.Pool != nil && !scope.IsPoolVisible(r.Pool) {
-		return nil, fmt.Errorf("Pool %s is not visible in this scope", r.Pool)
+		return nil, poolNotVisibleError(r.Pool)
 	}
 
 	value, err := parseNinjaString(scope, params.Command)
@@ -204,6 +331,42 @@ func parseRuleParams(scope scope, params *RuleParams) (*ruleDef,
 		r.Variables["rspfile_content"] = value
 	}
 
+	if params.RspfileThreshold > 0 {
+		if params.Rspfile != "" || params.RspfileContent != "" {
+			return nil, fmt.Errorf("RspfileThreshold cannot be used with " +
+				"Rspfile or RspfileContent")
+		}
+
+		inVar, err := scope.LookupVariable("in")
+		if err != nil {
+			return nil, err
+		}
+		if !r.Variables["command"].referencesVariable(inVar) {
+			return nil, fmt.Errorf("RspfileThreshold is set but Command does " +
+				"not reference ${in}")
+		}
+
+		r.RspfileThreshold = params.RspfileThreshold
+	}
+
+	err = validatePassthroughEnv(params)
+	if err != nil {
+		return nil, err
+	}
+	r.PassthroughEnv = append([]string(nil), params.PassthroughEnv...)
+
+	err = validateOutputExtension(params)
+	if err != nil {
+		return nil, err
+	}
+	r.OutputExtension = params.OutputExtension
+
+	err = validateAlwaysRun(params)
+	if err != nil {
+		return nil, err
+	}
+	r.AlwaysRun = params.AlwaysRun
+
 	r.CommandDeps, err = parseNinjaStrings(scope, params.CommandDeps)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing CommandDeps param: %s", err)
@@ -217,6 +380,137 @@ func parseRuleParams(scope scope, params *RuleParams) (*ruleDef,
 	return r, nil
 }
 
+// ninjaRuleBindings contains the names of the variables that Ninja itself reads
+// from the scope of a build statement.  A rule argument with one of these names
+// is used even if the rule's params never reference it.
+var ninjaRuleBindings = map[string]bool{
+	"command":          true,
+	"depfile":          true,
+	"deps":             true,
+	"description":      true,
+	"dyndep":           true,
+	"generator":        true,
+	"msvc_deps_prefix": true,
+	"pool":             true,
+	"restat":           true,
+	"rspfile":          true,
+	"rspfile_content":  true,
+}
+
+// parseArgDefaults parses the default values of a rule's arguments, keyed by
+// the argument variables of ruleScope.  The values are parsed in pkgScope, the
+// scope of the rule's package, so they may reference the package-scoped
+// variables that the arguments shadow but not the arguments themselves.
+func parseArgDefaults(pkgScope, ruleScope scope,
+	defaults map[string]string) (map[Variable]*ninjaString, error) {
+
+	if len(defaults) == 0 {
+		return nil, nil
+	}
+
+	names := make([]string, 0, len(defaults))
+	for name := range defaults {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ret := make(map[Variable]*ninjaString, len(defaults))
+	for _, name := range names {
+		argVar, err := ruleScope.LookupVariable(name)
+		if err != nil {
+			// This shouldn't happen.
+			return nil, fmt.Errorf("argument lookup error: %s", err)
+		}
+
+		value, err := parseNinjaString(pkgScope, defaults[name])
+		if err != nil {
+			return nil, fmt.Errorf("error parsing default value of argument %q: %s",
+				name, err)
+		}
+		ret[argVar] = value
+	}
+
+	return ret, nil
+}
+
+// validateRuleArgUsage returns an error if any of argNames is neither
+// referenced by the rule definition nor read by Ninja.  Names that are
+// referenced but are neither arguments nor visible variables have already been
+// rejected when the rule's params were parsed.
+func validateRuleArgUsage(def *ruleDef, scope scope, argNames map[string]bool) error {
+	referenced := make(map[Variable]bool)
+	addRefs := func(strs ...*ninjaString) {
+		for _, str := range strs {
+			for _, v := range str.variables {
+				referenced[v] = true
+			}
+		}
+	}
+	for _, value := range def.Variables {
+		addRefs(value)
+	}
+	addRefs(def.CommandDeps...)
+	addRefs(def.CommandOrderOnly...)
+
+	var unused []string
+	for argName := range argNames {
+		if ninjaRuleBindings[argName] {
+			continue
+		}
+
+		// An argument that shadows a package-scoped variable is looked up as
+		// that variable.
+		v, err := scope.LookupVariable(argName)
+		if err != nil {
+			return err
+		}
+		if !referenced[v] {
+			unused = append(unused, argName)
+		}
+	}
+
+	if len(unused) > 0 {
+		sort.Strings(unused)
+		return fmt.Errorf("unused arguments %q", unused)
+	}
+
+	return nil
+}
+
+// rspfileVariant returns the definition of the variant of a rule with an
+// RspfileThreshold that passes ${in} to the command through a response file.
+// The scope is used to look up the rule's built-in arguments.
+func (r *ruleDef) rspfileVariant(scope scope) (*ruleDef, error) {
+	inVar, err := scope.LookupVariable("in")
+	if err != nil {
+		return nil, err
+	}
+	outVar, err := scope.LookupVariable("out")
+	if err != nil {
+		return nil, err
+	}
+
+	variant := *r
+	variant.RspfileThreshold = 0
+	variant.Variables = make(map[string]*ninjaString, len(r.Variables)+2)
+	for name, value := range r.Variables {
+		variant.Variables[name] = value
+	}
+
+	atRspfile := &ninjaString{strings: []string{"@", ".rsp"}, variables: []Variable{outVar}}
+	variant.Variables["command"] = r.Variables["command"].replaceVariable(inVar, atRspfile)
+	variant.Variables["rspfile"] = &ninjaString{
+		strings:   []string{"", ".rsp"},
+		variables: []Variable{outVar},
+	}
+	variant.Variables["rspfile_content"] = &ninjaString{
+		strings:   []string{"", ""},
+		variables: []Variable{inVar},
+	}
+
+	return &variant, nil
+}
+
 func (r *ruleDef) WriteTo(nw *ninjaWriter, name string,
 	pkgNames map[*packageContext]string) error {
 
@@ -239,7 +533,7 @@ func (r *ruleDef) WriteTo(nw *ninjaWriter, name string,
 		}
 	}
 
-	err = writeVariables(nw, r.Variables, pkgNames)
+	err = writeVariables(nw, r.writtenVariables(), pkgNames)
 	if err != nil {
 		return err
 	}
@@ -247,19 +541,143 @@ func (r *ruleDef) WriteTo(nw *ninjaWriter, name string,
 	return nil
 }
 
+// writtenVariables returns the variables that the rule is written to the Ninja
+// file with, which are its Variables with the PassthroughEnv exports added to
+// the command.
+func (r *ruleDef) writtenVariables() map[string]*ninjaString {
+	if len(r.PassthroughEnv) == 0 {
+		return r.Variables
+	}
+
+	variables := make(map[string]*ninjaString, len(r.Variables))
+	for name, value := range r.Variables {
+		variables[name] = value
+	}
+	variables["command"] = passthroughEnvCommand(r.PassthroughEnv,
+		r.Variables["command"])
+	return variables
+}
+
+// validatePassthroughEnv returns an error if the PassthroughEnv param lists an
+// invalid name, or the same name more than once.
+func validatePassthroughEnv(params *RuleParams) error {
+	seen := make(map[string]bool, len(params.PassthroughEnv))
+	for _, name := range params.PassthroughEnv {
+		err := validateEnvName(name)
+		if err != nil {
+			return fmt.Errorf("error parsing PassthroughEnv param: %s", err)
+		}
+		if seen[name] {
+			return fmt.Errorf("PassthroughEnv param lists %q more than once", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// validateOutputExtension returns an error if the OutputExtension param cannot
+// be compared with the outputs as they are written.
+func validateOutputExtension(params *RuleParams) error {
+	if strings.ContainsRune(params.OutputExtension, '$') {
+		return fmt.Errorf("OutputExtension param %q contains a '$' character",
+			params.OutputExtension)
+	}
+	return nil
+}
+
+// validateAlwaysRun returns an error if the AlwaysRun param is combined with
+// the Restat param.
+func validateAlwaysRun(params *RuleParams) error {
+	if params.AlwaysRun && params.Restat {
+		return fmt.Errorf("AlwaysRun cannot be used with Restat")
+	}
+	return nil
+}
+
+// alwaysRunTarget is the phony target without inputs that the build statements
+// of the rules with AlwaysRun set depend on.  It is reserved, so no other build
+// statement may output it.
+const alwaysRunTarget = "_blueprint_always_run"
+
+// checkOutputExtension returns an error if one of the explicit outputs of b
+// does not end with the OutputExtension of its rule.
+func (b *buildDef) checkOutputExtension() error {
+	if b.RuleDef == nil || b.RuleDef.OutputExtension == "" {
+		return nil
+	}
+
+	ext := b.RuleDef.OutputExtension
+	for _, output := range b.Outputs {
+		if !strings.HasSuffix(output.strings[len(output.strings)-1], ext) {
+			return fmt.Errorf("output %q of rule %s does not have the extension %q",
+				output.Value(nil), b.Rule, ext)
+		}
+	}
+	return nil
+}
+
+// validateEnvName returns an error if name is not a valid shell variable name.
+func validateEnvName(name string) error {
+	for i, r := range name {
+		valid := r == '_' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') ||
+			(i > 0 && '0' <= r && r <= '9')
+		if !valid {
+			return fmt.Errorf("%q is not a valid environment variable name", name)
+		}
+	}
+	if name == "" {
+		return fmt.Errorf("empty environment variable name")
+	}
+	return nil
+}
+
+// passthroughEnvCommand returns command preceded by an export of the current
+// value of each of the environment variables in names that is set, see
+// RuleParams.PassthroughEnv.
+func passthroughEnvCommand(names []string, command *ninjaString) *ninjaString {
+	var exports []string
+	for _, name := range names {
+		value, set := lookupEnvDep(name)
+		if set {
+			value = strings.Replace(proptools.NinjaEscape(value), "'", `'\''`, -1)
+			exports = append(exports, name+"='"+value+"'")
+		}
+	}
+	if len(exports) == 0 {
+		return command
+	}
+
+	prefix := "export " + strings.Join(exports, " ") + " && "
+	result := &ninjaString{
+		strings:   append([]string(nil), command.strings...),
+		variables: command.variables,
+	}
+	result.strings[0] = prefix + result.strings[0]
+	return result
+}
+
 // A buildDef describes a build target definition.
 type buildDef struct {
 	Comment         string
 	Rule            Rule
 	RuleDef         *ruleDef
+	Pool            Pool
 	Outputs         []*ninjaString
 	ImplicitOutputs []*ninjaString
 	Inputs          []*ninjaString
 	Implicits       []*ninjaString
 	OrderOnly       []*ninjaString
+	Validations     []*ninjaString
 	Args            map[Variable]*ninjaString
+	LocalVariables  map[Variable]*ninjaString
 	Variables       map[string]*ninjaString
 	Optional        bool
+	InputsLength    int // The length of the Inputs param, used for RspfileThreshold.
+
+	// The Rule and Args before AddBuildDefDeps resolved them for the config,
+	// kept to resolve them again for a finalized config.
+	UnresolvedRule Rule
+	UnresolvedArgs map[Variable]*ninjaString
 }
 
 func parseBuildParams(scope scope, params *BuildParams) (*buildDef,
@@ -284,6 +702,13 @@ func parseBuildParams(scope scope, params *BuildParams) (*buildDef,
 		return nil, fmt.Errorf("Rule %s is not visible in this scope", rule)
 	}
 
+	if params.Pool != nil {
+		if !scope.IsPoolVisible(params.Pool) {
+			return nil, poolNotVisibleError(params.Pool)
+		}
+		b.Pool = params.Pool
+	}
+
 	if len(params.Outputs) == 0 {
 		return nil, errors.New("Outputs param has no elements")
 	}
@@ -299,10 +724,20 @@ func parseBuildParams(scope scope, params *BuildParams) (*buildDef,
 		return nil, fmt.Errorf("error parsing ImplicitOutputs param: %s", err)
 	}
 
+	for _, outputs := range [][]string{params.Outputs, params.ImplicitOutputs} {
+		for _, output := range outputs {
+			if output == alwaysRunTarget {
+				return nil, fmt.Errorf("output %q is reserved for the dependency "+
+					"of the AlwaysRun rules", output)
+			}
+		}
+	}
+
 	b.Inputs, err = parseNinjaStrings(scope, params.Inputs)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing Inputs param: %s", err)
 	}
+	b.InputsLength = len(strings.Join(params.Inputs, " "))
 
 	b.Implicits, err = parseNinjaStrings(scope, params.Implicits)
 	if err != nil {
@@ -314,6 +749,17 @@ func parseBuildParams(scope scope, params *BuildParams) (*buildDef,
 		return nil, fmt.Errorf("error parsing OrderOnly param: %s", err)
 	}
 
+	for i, validation := range params.Validations {
+		if validation == "" {
+			return nil, fmt.Errorf("error parsing Validations param: element %d "+
+				"is empty", i)
+		}
+	}
+	b.Validations, err = parseNinjaStrings(scope, params.Validations)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing Validations param: %s", err)
+	}
+
 	b.Optional = params.Optional
 
 	if params.Depfile != "" {
@@ -342,7 +788,12 @@ func parseBuildParams(scope scope, params *BuildParams) (*buildDef,
 		b.Args = make(map[Variable]*ninjaString)
 		for name, value := range params.Args {
 			if !rule.isArg(name) {
-				return nil, fmt.Errorf("unknown argument %q", name)
+				if argNames := RuleArgNames(rule); len(argNames) > 0 {
+					return nil, fmt.Errorf("unknown argument %q for rule %s, its "+
+						"arguments are %q", name, rule, argNames)
+				}
+				return nil, fmt.Errorf("unknown argument %q for rule %s, which has "+
+					"no arguments", name, rule)
 			}
 
 			argVar, err := argNameScope.LookupVariable(name)
@@ -361,56 +812,183 @@ func parseBuildParams(scope scope, params *BuildParams) (*buildDef,
 		}
 	}
 
+	err = checkRuleArgs(rule, params.Args)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(params.LocalVariables) > 0 {
+		b.LocalVariables = make(map[Variable]*ninjaString)
+		for name, value := range params.LocalVariables {
+			if rule.isArg(name) {
+				return nil, fmt.Errorf("local variable %q is an argument of "+
+					"rule %s, set it in Args instead", name, rule)
+			}
+
+			v, err := scope.LookupVariable(name)
+			if err != nil {
+				return nil, fmt.Errorf("error looking up local variable %q: %s",
+					name, err)
+			}
+			if argVar, err := argNameScope.LookupVariable(v.name()); err == nil &&
+				argVar == v && rule.isArg(v.name()) {
+
+				return nil, fmt.Errorf("local variable %q is shadowed by an "+
+					"argument of rule %s, set it in Args instead", name, rule)
+			}
+
+			ninjaValue, err := parseNinjaString(scope, value)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing local variable %q: %s",
+					name, err)
+			}
+
+			b.LocalVariables[v] = ninjaValue
+		}
+	}
+
 	return b, nil
 }
 
-func (b *buildDef) WriteTo(nw *ninjaWriter, pkgNames map[*packageContext]string) error {
-	var (
-		comment       = b.Comment
-		rule          = b.Rule.fullName(pkgNames)
-		outputs       = valueList(b.Outputs, pkgNames, outputEscaper)
-		implicitOuts  = valueList(b.ImplicitOutputs, pkgNames, outputEscaper)
-		explicitDeps  = valueList(b.Inputs, pkgNames, inputEscaper)
-		implicitDeps  = valueList(b.Implicits, pkgNames, inputEscaper)
-		orderOnlyDeps = valueList(b.OrderOnly, pkgNames, inputEscaper)
-	)
+// A buildStatement is a build statement as it is written to the Ninja file,
+// with its paths escaped and the names of its rule, pool and arguments
+// qualified.  It is also the format of the entries in the JSON manifest written
+// by Context.WriteBuildManifest.
+type buildStatement struct {
+	Rule            string            `json:"rule"`
+	Outputs         []string          `json:"outputs"`
+	ImplicitOutputs []string          `json:"implicit_outputs,omitempty"`
+	Inputs          []string          `json:"inputs,omitempty"`
+	Implicits       []string          `json:"implicits,omitempty"`
+	OrderOnly       []string          `json:"order_only,omitempty"`
+	Validations     []string          `json:"validations,omitempty"`
+	Pool            string            `json:"pool,omitempty"`
+	Variables       map[string]string `json:"variables,omitempty"`
+	Args            map[string]string `json:"args,omitempty"`
+	Default         bool              `json:"default"`
+}
+
+func (b *buildDef) statement(pkgNames map[*packageContext]string) *buildStatement {
+	s := &buildStatement{
+		Rule:            b.Rule.fullName(pkgNames),
+		Outputs:         valueList(b.Outputs, pkgNames, outputEscaper),
+		ImplicitOutputs: valueList(b.ImplicitOutputs, pkgNames, outputEscaper),
+		Inputs:          valueList(b.Inputs, pkgNames, inputEscaper),
+		Implicits:       valueList(b.Implicits, pkgNames, inputEscaper),
+		OrderOnly:       valueList(b.OrderOnly, pkgNames, inputEscaper),
+		Validations:     valueList(b.Validations, pkgNames, inputEscaper),
+		Default:         !b.Optional,
+	}
 
 	if b.RuleDef != nil {
-		implicitDeps = append(valueList(b.RuleDef.CommandDeps, pkgNames, inputEscaper), implicitDeps...)
-		orderOnlyDeps = append(valueList(b.RuleDef.CommandOrderOnly, pkgNames, inputEscaper), orderOnlyDeps...)
+		s.Implicits = append(valueList(b.RuleDef.CommandDeps, pkgNames, inputEscaper), s.Implicits...)
+		s.OrderOnly = append(valueList(b.RuleDef.CommandOrderOnly, pkgNames, inputEscaper), s.OrderOnly...)
+		if b.RuleDef.AlwaysRun {
+			s.Implicits = append(s.Implicits, alwaysRunTarget)
+		}
 	}
 
-	err := nw.Build(comment, rule, outputs, implicitOuts, explicitDeps, implicitDeps, orderOnlyDeps)
-	if err != nil {
-		return err
+	if b.Pool != nil {
+		s.Pool = b.Pool.fullName(pkgNames)
 	}
 
-	args := make(map[string]string)
+	if len(b.Variables) > 0 {
+		s.Variables = make(map[string]string, len(b.Variables))
+		for name, value := range b.Variables {
+			s.Variables[name] = value.Value(pkgNames)
+		}
+	}
 
-	for argVar, value := range b.Args {
-		args[argVar.fullName(pkgNames)] = value.Value(pkgNames)
+	if len(b.Args)+len(b.LocalVariables) > 0 {
+		s.Args = make(map[string]string, len(b.Args)+len(b.LocalVariables))
+		for argVar, value := range b.Args {
+			s.Args[argVar.fullName(pkgNames)] = value.Value(pkgNames)
+		}
+		for v, value := range b.LocalVariables {
+			s.Args[v.fullName(pkgNames)] = value.Value(pkgNames)
+		}
 	}
 
-	err = writeVariables(nw, b.Variables, pkgNames)
-	if err != nil {
-		return err
+	return s
+}
+
+// manifestStatement returns the statement of b as it is described by
+// WriteBuildManifest, with the paths expanded using the values of variables and
+// unescaped.
+func (b *buildDef) manifestStatement(pkgNames map[*packageContext]string,
+	variables map[Variable]*ninjaString) (*buildStatement, error) {
+
+	s := b.statement(pkgNames)
+
+	var commandDeps, commandOrderOnly []*ninjaString
+	if b.RuleDef != nil {
+		commandDeps = b.RuleDef.CommandDeps
+		commandOrderOnly = b.RuleDef.CommandOrderOnly
 	}
 
-	var keys []string
-	for k := range args {
-		keys = append(keys, k)
+	for _, paths := range []struct {
+		list  *[]string
+		lists [][]*ninjaString
+	}{
+		{&s.Outputs, [][]*ninjaString{b.Outputs}},
+		{&s.ImplicitOutputs, [][]*ninjaString{b.ImplicitOutputs}},
+		{&s.Inputs, [][]*ninjaString{b.Inputs}},
+		{&s.Implicits, [][]*ninjaString{commandDeps, b.Implicits}},
+		{&s.OrderOnly, [][]*ninjaString{commandOrderOnly, b.OrderOnly}},
+		{&s.Validations, [][]*ninjaString{b.Validations}},
+	} {
+		var list []string
+		for _, ninjaStrs := range paths.lists {
+			for _, ninjaStr := range ninjaStrs {
+				value, err := ninjaStr.Eval(variables)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, unescaper.Replace(value))
+			}
+		}
+		*paths.list = list
+	}
+	if b.RuleDef != nil && b.RuleDef.AlwaysRun {
+		s.Implicits = append(s.Implicits, alwaysRunTarget)
 	}
-	sort.Strings(keys)
 
-	for _, name := range keys {
-		err = nw.ScopedAssign(name, args[name])
+	return s, nil
+}
+
+func (b *buildDef) WriteTo(nw *ninjaWriter, pkgNames map[*packageContext]string) error {
+	s := b.statement(pkgNames)
+
+	err := nw.Build(b.Comment, s.Rule, s.Outputs, s.ImplicitOutputs, s.Inputs, s.Implicits,
+		s.OrderOnly, s.Validations)
+	if err != nil {
+		return err
+	}
+
+	if s.Pool != "" {
+		err = nw.ScopedAssign("pool", s.Pool)
 		if err != nil {
 			return err
 		}
 	}
 
-	if !b.Optional {
-		err = nw.Default(outputs...)
+	for _, vars := range []map[string]string{s.Variables, s.Args} {
+		var keys []string
+		for k := range vars {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, name := range keys {
+			err = nw.ScopedAssign(name, vars[name])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if s.Default {
+		err = nw.Default(s.Outputs...)
 		if err != nil {
 			return err
 		}
@@ -18,22 +18,49 @@ import (
 	"bytes"
 	"fmt"
 	"strings"
+	"time"
 )
 
 const eof = -1
 
+// The escapers are applied to the literal parts of parsed Ninja strings, which
+// are already escaped.  The "$$" and "$ " escape sequences, the latter added by
+// the parser for a leading space, are matched first and kept as they are, so
+// that the spaces they contain are not escaped again.
+//
+// Ninja ends a path in a build statement at a space or a colon, so
+// inputEscaper and outputEscaper escape both in each path.
+//
+// Ninja values cannot contain newlines, so defaultEscaper writes each newline
+// as a line continuation followed by an indented line, which Ninja reads as a
+// single space.  This keeps the words on either side of the newline separate,
+// and a newline at the end of a value does not join the next line of the Ninja
+// file to it.
 var (
 	defaultEscaper = strings.NewReplacer(
-		"\n", "$\n")
+		"$$", "$$",
+		"\n", " $\n"+indentString[:indentWidth])
 	inputEscaper = strings.NewReplacer(
+		"$$", "$$",
+		"$ ", "$ ",
 		"\n", "$\n",
-		" ", "$ ")
+		" ", "$ ",
+		":", "$:")
 	outputEscaper = strings.NewReplacer(
+		"$$", "$$",
+		"$ ", "$ ",
 		"\n", "$\n",
 		" ", "$ ",
 		":", "$:")
 )
 
+// unescaper undoes the escape sequences that the literal parts of parsed Ninja
+// strings and the outputs of the escapers may contain.
+var unescaper = strings.NewReplacer(
+	"$$", "$",
+	"$ ", " ",
+	"$:", ":")
+
 type ninjaString struct {
 	strings   []string
 	variables []Variable
@@ -82,9 +109,15 @@ func (ps *parseState) pushString(s string) {
 type stateFunc func(*parseState, int, rune) (stateFunc, error)
 
 // parseNinjaString parses an unescaped ninja string (i.e. all $<something>
-// occurrences are expected to be variables or $$) and returns a list of the
-// variable names that the string references.
+// occurrences are expected to be variables, $$, or line continuations) and
+// returns a list of the variable names that the string references.  Like in a
+// Ninja file, a '$' at the end of a line and the spaces at the beginning of the
+// next line are dropped.
 func parseNinjaString(scope scope, str string) (*ninjaString, error) {
+	if profiling() {
+		defer ninjaStringParsesProfile.record(time.Now())
+	}
+
 	// naively pre-allocate slices by counting $ signs
 	n := strings.Count(str, "$")
 	result := &ninjaString{
@@ -116,6 +149,86 @@ func parseNinjaString(scope scope, str string) (*ninjaString, error) {
 	return result, nil
 }
 
+// syntaxCheckScope is a scope in which every variable name is defined.  Parsing
+// a string against it only checks the syntax of the string.
+type syntaxCheckScope struct{}
+
+func (syntaxCheckScope) LookupVariable(name string) (Variable, error) {
+	return &argVariable{name}, nil
+}
+
+func (syntaxCheckScope) IsRuleVisible(rule Rule) bool {
+	return true
+}
+
+func (syntaxCheckScope) IsPoolVisible(pool Pool) bool {
+	return true
+}
+
+// validateNinjaStringSyntax returns an error if str cannot be parsed as a ninja
+// string, without checking that the variables it references exist.
+func validateNinjaStringSyntax(str string) error {
+	_, err := parseNinjaString(syntaxCheckScope{}, str)
+	return err
+}
+
+// A NinjaString is a string parsed by ParseNinjaString.
+type NinjaString struct {
+	str *ninjaString
+}
+
+// ParseNinjaString parses str the same way Blueprint parses the values of the
+// variables of the package with the given package context, so that it may
+// reference the variables of that package and, like "${pkg.Var}", the exported
+// variables of the packages it imports.  An error is returned if str is not a
+// valid Ninja string or references an unknown variable.
+func ParseNinjaString(pctx PackageContext, str string) (*NinjaString, error) {
+	ninjaStr, err := parseNinjaString(pctx.getScope(), str)
+	if err != nil {
+		return nil, err
+	}
+	return &NinjaString{ninjaStr}, nil
+}
+
+// Variables returns the variables referenced by the string in the order of
+// their first reference.  Each one is named by the path of the Go package that
+// defines it followed by a '.' and its name, like "path/to/pkg.Var".
+func (n *NinjaString) Variables() []string {
+	var names []string
+	seen := make(map[Variable]bool)
+	for _, v := range n.str.variables {
+		if !seen[v] {
+			seen[v] = true
+			names = append(names, v.String())
+		}
+	}
+	return names
+}
+
+// referencedRuleArg returns the name of the first built-in rule argument, like
+// "in" or "out", referenced by str, or an empty string if it references none.
+// The built-in arguments are only defined for rules and build statements, so
+// package-scoped variables cannot reference them, unless scope has a variable
+// with the same name.  An error is returned if str is not a valid Ninja string.
+func referencedRuleArg(scope scope, str string) (string, error) {
+	ninjaStr, err := parseNinjaString(syntaxCheckScope{}, str)
+	if err != nil {
+		return "", err
+	}
+
+	for _, v := range ninjaStr.variables {
+		for _, arg := range builtinRuleArgs {
+			if v.name() != arg {
+				continue
+			}
+			if _, err := scope.LookupVariable(arg); err != nil {
+				return arg, nil
+			}
+		}
+	}
+	return "", nil
+}
+
 func parseFirstRuneState(state *parseState, i int, r rune) (stateFunc, error) {
 	if r == ' ' {
 		state.pendingStr += "$"
@@ -152,6 +265,12 @@ func parseDollarStartState(state *parseState, i int, r rune) (stateFunc, error)
 		// state.stringStart.
 		return parseStringState, nil
 
+	case r == '\n':
+		// A line continuation.  Like Ninja, drop it and the spaces at the
+		// beginning of the next line.
+		state.pendingStr += state.str[state.stringStart : i-1]
+		return parseContinuationState, nil
+
 	case r == '{':
 		// This is a bracketted variable name (e.g. "${blah.blah}").  Output
 		// the string and keep going.
@@ -170,6 +289,15 @@ func parseDollarStartState(state *parseState, i int, r rune) (stateFunc, error)
 	}
 }
 
+func parseContinuationState(state *parseState, i int, r rune) (stateFunc, error) {
+	if r == ' ' {
+		return parseContinuationState, nil
+	}
+
+	state.stringStart = i
+	return parseStringState(state, i, r)
+}
+
 func parseDollarState(state *parseState, i int, r rune) (stateFunc, error) {
 	switch {
 	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z',
@@ -270,6 +398,40 @@ func parseNinjaStrings(scope scope, strs []string) ([]*ninjaString,
 	return result, nil
 }
 
+// referencesVariable returns true if n references v.
+func (n *ninjaString) referencesVariable(v Variable) bool {
+	for _, nv := range n.variables {
+		if nv == v {
+			return true
+		}
+	}
+	return false
+}
+
+// replaceVariable returns a copy of n in which each reference to v is replaced
+// by the contents of repl.
+func (n *ninjaString) replaceVariable(v Variable, repl *ninjaString) *ninjaString {
+	result := &ninjaString{
+		strings: []string{n.strings[0]},
+	}
+
+	for i, nv := range n.variables {
+		if nv != v {
+			result.variables = append(result.variables, nv)
+			result.strings = append(result.strings, n.strings[i+1])
+			continue
+		}
+
+		last := len(result.strings) - 1
+		result.strings[last] += repl.strings[0]
+		result.variables = append(result.variables, repl.variables...)
+		result.strings = append(result.strings, repl.strings[1:]...)
+		result.strings[len(result.strings)-1] += n.strings[i+1]
+	}
+
+	return result
+}
+
 func (n *ninjaString) Value(pkgNames map[*packageContext]string) string {
 	return n.ValueWithEscaper(pkgNames, defaultEscaper)
 }
@@ -318,9 +480,8 @@ func validateNinjaName(name string) error {
 			(r == '-') ||
 			(r == '.')
 		if !valid {
-
-			return fmt.Errorf("%q contains an invalid Ninja name character "+
-				"%q at byte offset %d", name, r, i)
+			return &InvalidNameError{name, fmt.Errorf("%q contains an invalid "+
+				"Ninja name character %q at byte offset %d", name, r, i)}
 		}
 	}
 	return nil
@@ -375,6 +536,42 @@ func validateArgName(argName string) error {
 	return nil
 }
 
+// parseArgNames splits the argNames of a rule, each either a name or a
+// "name=default" pair, into the argument names and their default values.  It
+// returns an error if a name is invalid or a default value is not a valid Ninja
+// string.
+func parseArgNames(argNames []string) ([]string, map[string]string, error) {
+	names := make([]string, len(argNames))
+	var defaults map[string]string
+
+	for i, argName := range argNames {
+		if j := strings.IndexByte(argName, '='); j >= 0 {
+			name, value := argName[:j], argName[j+1:]
+			if name == "" {
+				return nil, nil, fmt.Errorf("missing argument name in %q", argName)
+			}
+			err := validateNinjaStringSyntax(value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid default value for %q: %s",
+					name, err)
+			}
+			if defaults == nil {
+				defaults = make(map[string]string)
+			}
+			defaults[name] = value
+			argName = name
+		}
+		names[i] = argName
+	}
+
+	err := validateArgNames(names)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return names, defaults, nil
+}
+
 func validateArgNames(argNames []string) error {
 	for _, argName := range argNames {
 		err := validateArgName(argName)
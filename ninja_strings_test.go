@@ -67,6 +67,31 @@ var ninjaParseTestCases = []struct {
 		vars:  []string{"foo"},
 		strs:  []string{"", "$$"},
 	},
+	{
+		input: "a$$b",
+		vars:  nil,
+		strs:  []string{"a$$b"},
+	},
+	{
+		input: "$$${foo}",
+		vars:  []string{"foo"},
+		strs:  []string{"$$", ""},
+	},
+	{
+		input: "foo$$",
+		vars:  nil,
+		strs:  []string{"foo$$"},
+	},
+	{
+		input: "${foo}$$",
+		vars:  []string{"foo"},
+		strs:  []string{"", "$$"},
+	},
+	{
+		input: "${foo}$$$bar",
+		vars:  []string{"foo", "bar"},
+		strs:  []string{"", "$$", ""},
+	},
 	{
 		input: "foo bar",
 		vars:  nil,
@@ -77,6 +102,21 @@ var ninjaParseTestCases = []struct {
 		vars:  nil,
 		strs:  []string{"$ foo "},
 	},
+	{
+		input: "foo $\n    bar",
+		vars:  nil,
+		strs:  []string{"foo bar"},
+	},
+	{
+		input: "$\n  foo$\n",
+		vars:  nil,
+		strs:  []string{"foo"},
+	},
+	{
+		input: "$foo $\n  ${bar}$\n$$",
+		vars:  []string{"foo", "bar"},
+		strs:  []string{"", " ", "$$"},
+	},
 	{
 		input: "foo $ bar",
 		err:   "invalid character after '$' at byte offset 5",
@@ -142,6 +182,47 @@ func TestParseNinjaString(t *testing.T) {
 	}
 }
 
+func TestNinjaStringEscapers(t *testing.T) {
+	for _, tc := range []struct {
+		input  string
+		value  string
+		inputs string
+		output string
+	}{
+		{"a$$b", "a$$b", "a$$b", "a$$b"},
+		{"$$${foo}", "$$${foo}", "$$${foo}", "$$${foo}"},
+		{"foo$$", "foo$$", "foo$$", "foo$$"},
+		{"${foo}$$", "${foo}$$", "${foo}$$", "${foo}$$"},
+		{"a$$ b:c", "a$$ b:c", "a$$$ b$:c", "a$$$ b$:c"},
+		{" foo", "$ foo", "$ foo", "$ foo"},
+		{" $$ ${foo}", "$ $$ ${foo}", "$ $$$ ${foo}", "$ $$$ ${foo}"},
+		{"a\nb", "a $\n    b", "a$\nb", "a$\nb"},
+		{"\nfoo", " $\n    foo", "$\nfoo", "$\nfoo"},
+		{"foo\n", "foo $\n    ", "foo$\n", "foo$\n"},
+		{"a$$\n\n${foo}", "a$$ $\n     $\n    ${foo}", "a$$$\n$\n${foo}", "a$$$\n$\n${foo}"},
+	} {
+		scope := newLocalScope(nil, "")
+		_, err := scope.AddLocalVariable("foo", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		output, err := parseNinjaString(scope, tc.input)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %s", tc.input, err)
+		}
+		if g := output.Value(nil); g != tc.value {
+			t.Errorf("%q: incorrect value, want %q, got %q", tc.input, tc.value, g)
+		}
+		if g := output.ValueWithEscaper(nil, inputEscaper); g != tc.inputs {
+			t.Errorf("%q: incorrect input, want %q, got %q", tc.input, tc.inputs, g)
+		}
+		if g := output.ValueWithEscaper(nil, outputEscaper); g != tc.output {
+			t.Errorf("%q: incorrect output, want %q, got %q", tc.input, tc.output, g)
+		}
+	}
+}
+
 func TestParseNinjaStringWithImportedVar(t *testing.T) {
 	ImpVar := &staticVariable{name_: "ImpVar"}
 	impScope := newScope(nil)
@@ -164,6 +245,107 @@ func TestParseNinjaStringWithImportedVar(t *testing.T) {
 	}
 }
 
+func TestValidateNinjaStringSyntax(t *testing.T) {
+	for _, input := range []string{"abc ${undefined.Var} $other", "$$", ""} {
+		if err := validateNinjaStringSyntax(input); err != nil {
+			t.Errorf("unexpected error for %q: %s", input, err)
+		}
+	}
+
+	for _, input := range []string{"${unterminated", "abc $", "${}", "$!"} {
+		if err := validateNinjaStringSyntax(input); err == nil {
+			t.Errorf("expected an error for %q", input)
+		}
+	}
+}
+
+func TestValidateNinjaName(t *testing.T) {
+	for _, name := range []string{"foo", "Foo_bar-1.2", ""} {
+		if err := validateNinjaName(name); err != nil {
+			t.Errorf("unexpected error for %q: %s", name, err)
+		}
+	}
+
+	for name, want := range map[string]string{
+		"foo bar":   `"foo bar" contains an invalid Ninja name character ' ' at byte offset 3`,
+		"foo/bar":   `"foo/bar" contains an invalid Ninja name character '/' at byte offset 3`,
+		"$foo":      `"$foo" contains an invalid Ninja name character '$' at byte offset 0`,
+		"fooé.bar":  `"fooé.bar" contains an invalid Ninja name character 'é' at byte offset 3`,
+		"a.b.c:d.e": `"a.b.c:d.e" contains an invalid Ninja name character ':' at byte offset 5`,
+	} {
+		err := validateNinjaName(name)
+		if err == nil {
+			t.Errorf("expected an error for %q", name)
+		} else if err.Error() != want {
+			t.Errorf("incorrect error for %q:\nwant: %s\n got: %s", name, want, err)
+		}
+	}
+}
+
+func TestReferencedRuleArg(t *testing.T) {
+	pkg := NewTestPackage("example.com/ruleargs")
+	pkg.AddStaticVariable("in", "src")
+	pkgScope := pkg.pctx.scope
+
+	for _, tc := range []struct {
+		scope scope
+		input string
+		want  string
+	}{
+		{newScope(nil), "-o $out", "out"},
+		{newScope(nil), "${in} ${out}", "in"},
+		{newScope(nil), "$inputs ${pkg.out}", ""},
+		{newScope(nil), "$$in", ""},
+		// The package defines its own in variable.
+		{pkgScope, "${in} ${out}", "out"},
+		{pkgScope, "-I${in}", ""},
+	} {
+		got, err := referencedRuleArg(tc.scope, tc.input)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", tc.input, err)
+		} else if got != tc.want {
+			t.Errorf("expected %q for %q, got %q", tc.want, tc.input, got)
+		}
+	}
+
+	if _, err := referencedRuleArg(pkgScope, "-o $"); err == nil {
+		t.Errorf("expected an error for an invalid string")
+	}
+
+	// The value of a package-scoped variable may reference the package's in
+	// variable, but not the built-in out argument.
+	pkg.AddStaticVariable("inRef", "-I${in}")
+	func() {
+		defer func() {
+			want := `variable example.com/ruleargs.outRef references the rule argument "out": ` +
+				"package-scoped variables cannot reference rule arguments"
+			if err, ok := recover().(error); !ok || err.Error() != want {
+				t.Errorf("expected panic %q, got %v", want, err)
+			}
+		}()
+		pkg.AddStaticVariable("outRef", "${in} -o ${out}")
+	}()
+}
+
+func TestExportedParseNinjaString(t *testing.T) {
+	ninjaStr, err := ParseNinjaString(pctxTest, "${listVar} -I${dynBase} ${listVar} $$x")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expect := []string{
+		"github.com/google/blueprint/pctx_test.listVar",
+		"github.com/google/blueprint/pctx_test.dynBase",
+	}
+	if got := ninjaStr.Variables(); !reflect.DeepEqual(got, expect) {
+		t.Errorf("expected variables %q, got %q", expect, got)
+	}
+
+	if _, err := ParseNinjaString(pctxTest, "${dynBsae}"); err == nil {
+		t.Errorf("expected an error for an unknown variable")
+	}
+}
+
 func BenchmarkNinjaString_Value(b *testing.B) {
 	b.Run("constant", func(b *testing.B) {
 		for _, l := range []int{1, 10, 100, 1000} {
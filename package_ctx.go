@@ -17,11 +17,17 @@ package blueprint
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
 	"reflect"
 	"regexp"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
+
+	"github.com/google/blueprint/proptools"
 )
 
 // A PackageContext provides a way to create package-scoped Ninja pools,
@@ -54,19 +60,83 @@ import (
 //             Outputs: []string{"$myPrivateVar"},
 //         })
 //     }
+//
+// The order of the definitions within a package's initialization doesn't
+// matter.  Only the syntax of the Ninja strings is checked when a definition is
+// created, the variables, rules, and pools they reference are looked up once
+// they are used during the generate phase, after all the init() functions and
+// therefore all the calls to Import have completed.  The references of the
+// static variables that are never used are checked by ResolveDependencies in
+// strict variable resolution mode, see Context.SetStrictVariableResolution.
 type PackageContext interface {
 	Import(pkgPath string)
+	TryImport(pkgPath string) error
+	ImportOptional(pkgPath string) bool
+	ImportPrefix(prefix string)
 	ImportAs(as, pkgPath string)
+	TryImportAs(as, pkgPath string) error
+	ReExport(pkgPath string)
+	DefineToolchain(name string, members ...interface{})
+	ImportToolchain(pkgPath, name string)
+	SetNamespace(ns string)
+	SetPackageDefaultPool(pool Pool)
 
 	StaticVariable(name, value string) Variable
+	TryStaticVariable(name, value string) (Variable, error)
+	DeprecatedStaticVariable(name, value, replacement string) Variable
+	TryDeprecatedStaticVariable(name, value, replacement string) (Variable, error)
+	StaticListVariable(name string, values []string, sep string) Variable
+	TryStaticListVariable(name string, values []string, sep string) (Variable, error)
+	StaticVariableJoin(name, sep string, fragments ...string) Variable
+	TryStaticVariableJoin(name, sep string, fragments ...string) (Variable, error)
 	VariableFunc(name string, f func(config interface{}) (string, error)) Variable
+	TryVariableFunc(name string, f func(config interface{}) (string, error)) (Variable, error)
+	ListVariableFunc(name string, f func(config interface{}) ([]string, error), sep string) Variable
+	TryListVariableFunc(name string, f func(config interface{}) ([]string, error), sep string) (Variable, error)
+	OnceVariable(name string, f func() (string, error)) Variable
+	TryOnceVariable(name string, f func() (string, error)) (Variable, error)
 	VariableConfigMethod(name string, method interface{}) Variable
+	TryVariableConfigMethod(name string, method interface{}) (Variable, error)
+	VariableConfigMethodArgs(name string, method interface{}, args ...interface{}) Variable
+	TryVariableConfigMethodArgs(name string, method interface{}, args ...interface{}) (Variable, error)
+	MapVariable(name string, keyMethod interface{}, mapping map[string]string, defaultValue string) Variable
+	TryMapVariable(name string, keyMethod interface{}, mapping map[string]string, defaultValue string) (Variable, error)
+	FlavoredVariable(name string, byFlavor map[string]string, defaultValue string) Variable
+	TryFlavoredVariable(name string, byFlavor map[string]string, defaultValue string) (Variable, error)
+	EnvVariable(name, envKey, defaultValue string) Variable
+	TryEnvVariable(name, envKey, defaultValue string) (Variable, error)
+	FileVariable(name, path string) Variable
+	TryFileVariable(name, path string) (Variable, error)
+	ConcatVariable(name string, parts ...Variable) Variable
+	TryConcatVariable(name string, parts ...Variable) (Variable, error)
+	DynamicVariable(name string, deps []Variable,
+		f func(config interface{}, resolved map[Variable]string) (string, error)) Variable
+	TryDynamicVariable(name string, deps []Variable,
+		f func(config interface{}, resolved map[Variable]string) (string, error)) (Variable, error)
+	ResolvingVariableFunc(name string,
+		f func(config interface{}, resolve func(Variable) (string, error)) (string, error)) Variable
+	TryResolvingVariableFunc(name string,
+		f func(config interface{}, resolve func(Variable) (string, error)) (string, error)) (Variable, error)
 
 	StaticPool(name string, params PoolParams) Pool
+	TryStaticPool(name string, params PoolParams) (Pool, error)
 	PoolFunc(name string, f func(interface{}) (PoolParams, error)) Pool
+	TryPoolFunc(name string, f func(interface{}) (PoolParams, error)) (Pool, error)
+	CPUScaledPool(name string, fraction float64) Pool
+	TryCPUScaledPool(name string, fraction float64) (Pool, error)
+	CompositePool(name string, children ...Pool) Pool
+	TryCompositePool(name string, children ...Pool) (Pool, error)
 
 	StaticRule(name string, params RuleParams, argNames ...string) Rule
+	TryStaticRule(name string, params RuleParams, argNames ...string) (Rule, error)
 	RuleFunc(name string, f func(interface{}) (RuleParams, error), argNames ...string) Rule
+	TryRuleFunc(name string, f func(interface{}) (RuleParams, error), argNames ...string) (Rule, error)
+	DerivedRule(name string, base Rule, override RuleParams, argNames ...string) Rule
+	TryDerivedRule(name string, base Rule, override RuleParams, argNames ...string) (Rule, error)
+	SegmentedRule(name string, params RuleParams, segments []RuleSegment, argNames ...string) Rule
+	TrySegmentedRule(name string, params RuleParams, segments []RuleSegment, argNames ...string) (Rule, error)
+	SelectRule(name string, selector func(config interface{}) (Rule, error), argNames ...string) RuleSet
+	TrySelectRule(name string, selector func(config interface{}) (Rule, error), argNames ...string) (RuleSet, error)
 
 	AddNinjaFileDeps(deps ...string)
 
@@ -78,9 +148,22 @@ type packageContext struct {
 	shortName     string
 	pkgPath       string
 	scope         *basicScope
+	imports       map[string]*packageContext   // imported packages by local name
+	overrides     map[Variable]*staticVariable // set by OverrideVariable
+	namespace     string                       // set by SetNamespace
+	toolchains    map[string]*toolchain        // set by DefineToolchain
+	defaultPool   Pool                         // set by SetPackageDefaultPool
 	ninjaFileDeps []string
 }
 
+// A toolchain is a named group of the definitions of a package that other
+// packages can import together with ImportToolchain.
+type toolchain struct {
+	vars  []Variable
+	rules []Rule
+	pools []Pool
+}
+
 var _ PackageContext = &packageContext{}
 
 func (p *packageContext) getScope() *basicScope {
@@ -89,6 +172,45 @@ func (p *packageContext) getScope() *basicScope {
 
 var packageContexts = map[string]*packageContext{}
 
+// packageNames maps the Ninja-friendly name of each package with a context back
+// to the package path, so that collisions between package names can be
+// detected.
+var packageNames = map[string]string{}
+
+// Reset removes all the package contexts, along with the environment variables
+// recorded for EnvDeps, so that a long-running process can load a new set of
+// packages, for example from Go plugins, without colliding with the package
+// contexts of the previous ones.  It also removes the argument checks
+// registered by SetArgValidator, RequireArgs, and ExclusiveArgs, and restores
+// the defaults of the package-level settings made by SetNameTransformer,
+// SetCaseInsensitiveNames, SetPackageNameMangler, SetGenerationFlavor,
+// SetRegistrationObserver, and SetProfilingEnabled, whose statistics are
+// cleared.
+// The package contexts created by init() functions cannot be recreated, so the
+// PackageContexts and the Variables, Rules, and Pools defined by them must not
+// be used after Reset.
+//
+// Reset must not be called concurrently with the creation of package contexts
+// or with the generation of build actions.
+func Reset() {
+	packageContexts = map[string]*packageContext{}
+	packageNames = map[string]string{}
+
+	envDepsLock.Lock()
+	envDeps = make(map[string]string)
+	envDepsLock.Unlock()
+
+	ruleArgChecks = map[Rule]*argChecks{}
+
+	SetNameTransformer(nil)
+	SetCaseInsensitiveNames(false)
+	packageNameMangler = pkgPathToName
+	SetGenerationFlavor("")
+	SetRegistrationObserver(nil)
+	SetProfilingEnabled(false)
+	resetProfilingStats()
+}
+
 // NewPackageContext creates a PackageContext object for a given package.  The
 // pkgPath argument should always be set to the full path used to import the
 // package.  This function may only be called from a Go package's init()
@@ -100,10 +222,15 @@ func NewPackageContext(pkgPath string) PackageContext {
 		panic(fmt.Errorf("package %q already has a package context", pkgPath))
 	}
 
-	pkgName := pkgPathToName(pkgPath)
+	pkgName := packageNameMangler(pkgPath)
 	err := validateNinjaName(pkgName)
 	if err != nil {
-		panic(err)
+		panic(fmt.Errorf("invalid Ninja name for package %q: %s", pkgPath, err))
+	}
+
+	if otherPkgPath, present := packageNames[pkgName]; present {
+		panic(fmt.Errorf("packages %q and %q both have the Ninja name %q, "+
+			"one of them must be renamed", otherPkgPath, pkgPath, pkgName))
 	}
 
 	i := strings.LastIndex(pkgPath, "/")
@@ -114,72 +241,273 @@ func NewPackageContext(pkgPath string) PackageContext {
 		shortName: shortName,
 		pkgPath:   pkgPath,
 		scope:     newScope(nil),
+		imports:   make(map[string]*packageContext),
+		overrides: make(map[Variable]*staticVariable),
 	}
 
+	p.scope.desc = fmt.Sprintf("package %q", pkgPath)
+
 	packageContexts[pkgPath] = p
+	packageNames[pkgName] = pkgPath
 
 	return p
 }
 
-var Phony Rule = NewBuiltinRule("phony")
+// ErrInvalidName and ErrNameCollision match, with errors.Is, every
+// *InvalidNameError and every *DuplicateNameError respectively, so that callers
+// can tell the two kinds of errors apart without depending on the details that
+// the error types carry.
+var (
+	ErrInvalidName   = errors.New("invalid name")
+	ErrNameCollision = errors.New("name collision")
+)
+
+// An InvalidNameError describes a name passed to a PackageContext that is not a
+// valid Ninja name or that is reserved.
+type InvalidNameError struct {
+	Name string // the invalid name
+	Err  error  // the reason the name is invalid
+}
+
+func (e *InvalidNameError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *InvalidNameError) Unwrap() error {
+	return e.Err
+}
+
+func (e *InvalidNameError) Is(target error) bool {
+	return target == ErrInvalidName
+}
+
+// A DuplicateNameError describes a variable, pool, rule, or import whose name
+// is already defined in the scope it is added to, or that differs only in case
+// from a name in the scope if SetCaseInsensitiveNames is enabled.
+type DuplicateNameError struct {
+	Kind     string // "variable", "pool", "rule", or "import"
+	Name     string // the name that is already defined
+	Existing string // the defined name that differs from Name only in case, if any
+}
+
+func (e *DuplicateNameError) Error() string {
+	if e.Existing != "" {
+		return fmt.Sprintf("%s %q differs only in case from %s %q, which is "+
+			"already defined in this scope", e.Kind, e.Name, e.Kind, e.Existing)
+	}
+	return fmt.Sprintf("%s %q is already defined in this scope", e.Kind, e.Name)
+}
+
+func (e *DuplicateNameError) Is(target error) bool {
+	return target == ErrNameCollision
+}
+
+// An ImportError describes a package that cannot be imported, because it has no
+// package context, it is already imported under the same local name, or
+// importing it would create an import cycle.
+type ImportError struct {
+	PkgPath string // the path of the imported package
+	Err     error  // the reason the package cannot be imported
+}
+
+func (e *ImportError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ImportError) Unwrap() error {
+	return e.Err
+}
 
-var Console Pool = NewBuiltinPool("console")
+// reservedRuleNames contains the names of the rules that are built into Ninja
+// or predefined by Blueprint.  These rules are written to the Ninja file
+// without a package prefix, so NewBuiltinRule may not be used with these names.
+// Packages may define rules with the same names, they are written under the
+// packages' prefixes.
+var reservedRuleNames = map[string]bool{}
+
+// Phony is the Ninja built-in phony rule.
+var Phony Rule = newReservedBuiltinRule("phony", nil)
+
+// Touch is a rule that creates its outputs or updates their timestamps.  It is
+// predefined by Blueprint, and its definition is written to the Ninja file only
+// if a build statement uses it.
+var Touch Rule = newReservedBuiltinRule("touch", &RuleParams{
+	Command:     "touch $out",
+	Description: "touch $out",
+})
+
+// reservedPoolNames contains the names of the pools that are built into Ninja.
+// Packages may not define pools with these names.
+var reservedPoolNames = map[string]bool{}
+
+// Console is the Ninja built-in console pool.  It has a depth of 1, and the
+// commands of the build statements in it have direct access to Ninja's
+// standard input, output and error streams, which makes it suitable for
+// interactive commands.  It is never defined in the Ninja file, build
+// statements and rules that use it are written with "pool = console".
+var Console Pool = newReservedBuiltinPool("console")
 
 var errRuleIsBuiltin = errors.New("the rule is a built-in")
 var errPoolIsBuiltin = errors.New("the pool is a built-in")
 var errVariableIsArg = errors.New("argument variables have no value")
 
 // checkCalledFromInit panics if a Go package's init function is not on the
-// call stack.
+// call stack.  The whole stack is searched, rather than a fixed number of
+// frames, because the compiler may inline the functions between the init
+// function and the caller of checkCalledFromInit.
 func checkCalledFromInit() {
-	for skip := 3; ; skip++ {
-		_, funcName, ok := callerName(skip)
-		if !ok {
-			panic("not called from an init func")
+	// Skip runtime.Callers, checkCalledFromInit and the function that called
+	// it.
+	const skip = 3
+
+	pcs := make([]uintptr, 32)
+	for {
+		n := runtime.Callers(skip, pcs)
+		if n < len(pcs) {
+			pcs = pcs[:n]
+			break
 		}
+		pcs = make([]uintptr, 2*len(pcs))
+	}
 
-		if funcName == "init" || strings.HasPrefix(funcName, "init·") ||
-			funcName == "init.ializers" || strings.HasPrefix(funcName, "init.") {
+	// CallersFrames expands the frames of inlined functions.
+	frames := runtime.CallersFrames(pcs)
+	for {
+		frame, more := frames.Next()
+		if _, funcName, ok := splitFuncName(frame.Function); ok && isInitFuncName(funcName) {
 			return
 		}
+		if !more {
+			break
+		}
 	}
+
+	panic("not called from an init func")
+}
+
+// isInitFuncName returns true if funcName, a function name without the package
+// path, is the name that one of the Go versions gives the init functions of a
+// package or the functions called to initialize its package-scoped variables.
+func isInitFuncName(funcName string) bool {
+	return funcName == "init" || strings.HasPrefix(funcName, "init·") ||
+		funcName == "init.ializers" || strings.HasPrefix(funcName, "init.")
 }
 
 // A regex to find a package path within a function name. It finds the shortest string that is
 // followed by '.' and doesn't have any '/'s left.
 var pkgPathRe = regexp.MustCompile(`^(.*?)\.([^/]+)$`)
 
-// callerName returns the package path and function name of the calling
-// function.  The skip argument has the same meaning as the skip argument of
-// runtime.Callers.
-func callerName(skip int) (pkgPath, funcName string, ok bool) {
-	var pc [1]uintptr
-	n := runtime.Callers(skip+1, pc[:])
-	if n != 1 {
-		return "", "", false
-	}
-	frames := runtime.CallersFrames(pc[:])
-	frame, _ := frames.Next()
-	f := frame.Function
+// splitFuncName splits the fully qualified name of a function, as returned by
+// runtime.Frame.Function, into the package path and the function name.
+func splitFuncName(f string) (pkgPath, funcName string, ok bool) {
 	s := pkgPathRe.FindStringSubmatch(f)
 	if len(s) < 3 {
-		panic(fmt.Errorf("failed to extract package path and function name from %q", f))
+		return "", "", false
 	}
 
 	return s[1], s[2], true
 }
 
 // pkgPathToName makes a Ninja-friendly name out of a Go package name by
-// replaceing all the '/' characters with '.'.  We assume the results are
-// unique, though this is not 100% guaranteed for Go package names that
-// already contain '.' characters. Disallowing package names with '.' isn't
-// reasonable since many package names contain the name of the hosting site
-// (e.g. "code.google.com").  In practice this probably isn't really a
-// problem.
+// replaceing all the '/' characters with '.'.  The results are not guaranteed
+// to be unique for Go package names that already contain '.' characters, so
+// NewPackageContext panics if two packages end up with the same name.
+// Disallowing package names with '.' isn't reasonable since many package names
+// contain the name of the hosting site (e.g. "code.google.com").
 func pkgPathToName(pkgPath string) string {
 	return strings.Replace(pkgPath, "/", ".", -1)
 }
 
+// packageNameMangler is set by SetPackageNameMangler.
+var packageNameMangler = pkgPathToName
+
+// SetPackageNameMangler replaces the function that makes the Ninja names of the
+// packages out of their Go package paths, which by default replaces all the '/'
+// characters with '.', for example to strip a common vendor prefix.  Passing
+// nil restores the default.  The names it returns must be valid Ninja names and
+// must be unique, NewPackageContext panics otherwise.
+//
+// It only affects the package contexts created after it is called, so it should
+// be called from the init() function of a package that is initialized before
+// the packages that create package contexts, or after Reset, which restores
+// the default, before they are loaded again.
+func SetPackageNameMangler(mangler func(pkgPath string) string) {
+	if mangler == nil {
+		mangler = pkgPathToName
+	}
+	packageNameMangler = mangler
+}
+
+// registrationObserver is set by SetRegistrationObserver.  Module types may be
+// registered with several Contexts concurrently, so it is guarded by
+// registrationObserverLock.
+var (
+	registrationObserverLock sync.RWMutex
+	registrationObserver     func(kind, pkgPath, name string)
+)
+
+// SetRegistrationObserver sets a function that is called each time a variable,
+// rule, or pool is defined by a package context or a module type is registered
+// with a Context, for example to build an index of the definitions.  The kind
+// is "variable", "rule", "pool", "module type", or "module type alias", and the
+// pkgPath of a module type or an alias is the package of its factory function.
+// The module types created by CloneModuleType are reported as module types,
+// and the names added by RegisterModuleTypeAlias as aliases.  The observer is
+// called synchronously by the function making the definition, so it sees the
+// definitions in the order in which the Go packages are initialized.  The
+// definitions made visible by ReExport are not reported again.  Passing nil
+// disables it.
+//
+// It only sees the definitions made after it is called, so it should be called
+// from the init() function of a package that is initialized before the packages
+// that create package contexts.
+func SetRegistrationObserver(observer func(kind, pkgPath, name string)) {
+	registrationObserverLock.Lock()
+	defer registrationObserverLock.Unlock()
+	registrationObserver = observer
+}
+
+// observeRegistration reports a definition to the registration observer, if
+// there is one.
+func observeRegistration(kind, pkgPath, name string) {
+	registrationObserverLock.RLock()
+	observer := registrationObserver
+	registrationObserverLock.RUnlock()
+	if observer != nil {
+		observer(kind, pkgPath, name)
+	}
+}
+
+// addVariable adds v to the package's scope and reports it to the registration
+// observer.
+func (p *packageContext) addVariable(v Variable) error {
+	err := p.scope.AddVariable(v)
+	if err == nil {
+		observeRegistration("variable", p.pkgPath, v.name())
+	}
+	return err
+}
+
+// addRule adds r to the package's scope and reports it to the registration
+// observer.
+func (p *packageContext) addRule(r Rule) error {
+	err := p.scope.AddRule(r)
+	if err == nil {
+		observeRegistration("rule", p.pkgPath, r.name())
+	}
+	return err
+}
+
+// addPool adds pool to the package's scope and reports it to the registration
+// observer.
+func (p *packageContext) addPool(pool Pool) error {
+	err := p.scope.AddPool(pool)
+	if err == nil {
+		observeRegistration("pool", p.pkgPath, pool.name())
+	}
+	return err
+}
+
 // Import enables access to the exported Ninja pools, rules, and variables
 // that are defined at the package scope of another Go package.  Go's
 // visibility rules apply to these references - capitalized names indicate
@@ -187,8 +515,10 @@ func pkgPathToName(pkgPath string) string {
 // init() function.  The Go package path passed to Import must have already
 // been imported into the Go package using a Go import statement.  The
 // imported variables may then be accessed from Ninja strings as
-// "${pkg.Variable}", while the imported rules can simply be accessed as
-// exported Go variables from the package.  For example:
+// "${pkg.Variable}", while the imported rules and pools can simply be accessed
+// as exported Go variables from the package, for example as the Pool of a
+// RuleParams or a BuildParams.  They are written to the Ninja file under the
+// name of the package that defined them.  For example:
 //
 //     import (
 //         "blueprint"
@@ -214,570 +544,3345 @@ func pkgPathToName(pkgPath string) string {
 // is derived from pkgPath by extracting the last path component.  This differs
 // from Go's import declaration, which derives the local name from the package
 // clause in the imported package.  By convention these names are made to match,
-// but this is not required.
+// but this is not required.  The characters of the last path component that
+// cannot be part of the name, such as the '.' in "gopkg.in/yaml.v2", are
+// replaced with '_', unless that makes the name collide with the name of a
+// package that is already imported, in which case ImportAs must be used.
+//
+// Imports may not form a cycle; Import panics with the cycle's package paths if
+// importing pkgPath would create one.
 func (p *packageContext) Import(pkgPath string) {
+	err := p.TryImport(pkgPath)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// TryImport provides the same functionality as Import, but it returns an
+// *ImportError instead of panicking if pkgPath cannot be imported, so that the
+// errors of several imports can be reported together.  It may only be called
+// from a Go package's init() function.
+func (p *packageContext) TryImport(pkgPath string) error {
+	checkCalledFromInit()
+	importPkg, ok := packageContexts[pkgPath]
+	if !ok {
+		return &ImportError{pkgPath, fmt.Errorf("package %q has no context", pkgPath)}
+	}
+
+	as, err := p.importName(importPkg)
+	if err != nil {
+		return err
+	}
+
+	return p.addImport(as, importPkg)
+}
+
+// ImportOptional provides the same functionality as Import for a package that
+// may not be linked into the program, for example a toolchain package that is
+// only included by some builds.  It returns false instead of panicking if
+// pkgPath has no context, and the caller must then not reference the package's
+// definitions.  It may only be called from a Go package's init() function.
+//
+// A package's context is only created when the package is initialized, so the
+// optional package must be initialized before the calling package whenever it
+// is linked in, for example by importing it in a Go file that is included by a
+// build tag.
+func (p *packageContext) ImportOptional(pkgPath string) bool {
 	checkCalledFromInit()
 	importPkg, ok := packageContexts[pkgPath]
 	if !ok {
-		panic(fmt.Errorf("package %q has no context", pkgPath))
+		return false
 	}
 
-	err := p.scope.AddImport(importPkg.shortName, importPkg.scope)
+	as, err := p.importName(importPkg)
+	if err == nil {
+		err = p.addImport(as, importPkg)
+	}
 	if err != nil {
 		panic(err)
 	}
+	return true
+}
+
+// ImportPrefix provides the same functionality as Import for every package whose
+// path is prefix or starts with prefix followed by a '/', for example the
+// "tc/arm", "tc/x86", and "tc/common" packages of a toolchain split into
+// several packages for the prefix "tc".  Each package is imported under its own
+// name, as by Import, and the calling package itself is skipped.  Only the
+// packages whose contexts already exist are imported, so they must be
+// initialized before the calling package, for example by importing them in Go.
+// It panics if no package matches, or with an *ImportError if two of the
+// packages would be imported under the same name or if one of them would be
+// imported under the name of a package that is already imported.  In both cases
+// none of the packages are imported.  It may only be called from a Go package's
+// init() function.
+func (p *packageContext) ImportPrefix(prefix string) {
+	checkCalledFromInit()
+	prefix = strings.TrimSuffix(prefix, "/")
+
+	var pkgPaths []string
+	for pkgPath := range packageContexts {
+		if (pkgPath == prefix || strings.HasPrefix(pkgPath, prefix+"/")) &&
+			pkgPath != p.pkgPath {
+			pkgPaths = append(pkgPaths, pkgPath)
+		}
+	}
+	if len(pkgPaths) == 0 {
+		panic(fmt.Errorf("no package with a context has the path prefix %q", prefix))
+	}
+	sort.Strings(pkgPaths)
+
+	// Check all the names before importing any of the packages.
+	names := make([]string, len(pkgPaths))
+	pkgPathsByName := make(map[string]string, len(pkgPaths))
+	for i, pkgPath := range pkgPaths {
+		as, err := p.importName(packageContexts[pkgPath])
+		if err != nil {
+			panic(err)
+		}
+		if otherPkgPath, present := pkgPathsByName[as]; present {
+			panic(&ImportError{pkgPath, fmt.Errorf("cannot import packages %q and %q "+
+				"with the path prefix %q: both are named %q (use ImportAs for one "+
+				"of them)", otherPkgPath, pkgPath, prefix, as)})
+		}
+		if otherPkg, present := p.imports[as]; present &&
+			otherPkg != packageContexts[pkgPath] {
+			panic(&ImportError{pkgPath, fmt.Errorf("cannot import package %q as %q: "+
+				"package %q is already imported as %q (use ImportAs to choose a "+
+				"different name)", pkgPath, as, otherPkg.pkgPath, as)})
+		}
+		pkgPathsByName[as] = pkgPath
+		names[i] = as
+	}
+
+	for i, pkgPath := range pkgPaths {
+		importPkg := packageContexts[pkgPath]
+		if p.imports[names[i]] == importPkg {
+			continue
+		}
+		err := p.addImport(names[i], importPkg)
+		if err != nil {
+			panic(err)
+		}
+	}
 }
 
 // ImportAs provides the same functionality as Import, but it allows the local
 // name that will be used to refer to the package to be specified explicitly.
 // It may only be called from a Go package's init() function.
 func (p *packageContext) ImportAs(as, pkgPath string) {
+	err := p.TryImportAs(as, pkgPath)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// TryImportAs provides the same functionality as ImportAs, but it returns an
+// error instead of panicking, either an *ImportError or an *InvalidNameError if
+// as is not a valid name.  It may only be called from a Go package's init()
+// function.
+func (p *packageContext) TryImportAs(as, pkgPath string) error {
 	checkCalledFromInit()
 	importPkg, ok := packageContexts[pkgPath]
 	if !ok {
-		panic(fmt.Errorf("package %q has no context", pkgPath))
+		return &ImportError{pkgPath, fmt.Errorf("package %q has no context", pkgPath)}
 	}
 
 	err := validateNinjaName(as)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	err = p.scope.AddImport(as, importPkg.scope)
+	return p.addImport(as, importPkg)
+}
+
+// ReExport makes the exported Ninja pools, rules, and variables of another Go
+// package part of the exported definitions of the calling package, so that
+// packages importing the calling package can reference them without also
+// importing pkgPath.  It may only be called from a Go package's init()
+// function.  The definitions are still written to the Ninja file under the
+// namespace of the package that defined them.  A re-exported name that
+// collides with a name already defined in the calling package results in a
+// panic.
+func (p *packageContext) ReExport(pkgPath string) {
+	checkCalledFromInit()
+	vars, rules, pools, err := ExportedNames(pkgPath)
 	if err != nil {
 		panic(err)
 	}
-}
+	exportScope := packageContexts[pkgPath].scope
 
-type staticVariable struct {
-	pctx   *packageContext
-	name_  string
-	value_ string
+	reExportErr := func(err error) error {
+		return fmt.Errorf("cannot re-export package %q into %q: %s", pkgPath,
+			p.pkgPath, err)
+	}
+
+	for _, name := range vars {
+		err := p.scope.AddVariable(exportScope.variables[name])
+		if err != nil {
+			panic(reExportErr(err))
+		}
+	}
+	for _, name := range rules {
+		err := p.scope.AddRule(exportScope.rules[name])
+		if err != nil {
+			panic(reExportErr(err))
+		}
+	}
+	for _, name := range pools {
+		err := p.scope.AddPool(exportScope.pools[name])
+		if err != nil {
+			panic(reExportErr(err))
+		}
+	}
 }
 
-// StaticVariable returns a Variable whose value does not depend on any
-// configuration information.  It may only be called during a Go package's
-// initialization - either from the init() function or as part of a package-
-// scoped variable's initialization.
-//
-// This function is usually used to initialize a package-scoped Go variable that
-// represents a Ninja variable that will be output.  The name argument should
-// exactly match the Go variable name, and the value string may reference other
-// Ninja variables that are visible within the calling Go package.
-func (p *packageContext) StaticVariable(name, value string) Variable {
+// DefineToolchain defines a named group of the variables, rules, and pools
+// defined by the package, which other packages can import together with
+// ImportToolchain instead of importing the whole package.  Each member must be a
+// Variable, Rule, or Pool created by the package, and a package may not define
+// two toolchains with the same name.  It may only be called from a Go package's
+// init() function.
+func (p *packageContext) DefineToolchain(name string, members ...interface{}) {
 	checkCalledFromInit()
-	err := validateNinjaName(name)
-	if err != nil {
-		panic(err)
+
+	if name == "" {
+		panic(fmt.Errorf("empty toolchain name in package %q", p.pkgPath))
+	}
+	if _, present := p.toolchains[name]; present {
+		panic(fmt.Errorf("toolchain %q is already defined in package %q", name,
+			p.pkgPath))
 	}
 
-	v := &staticVariable{p, name, value}
-	err = p.scope.AddVariable(v)
-	if err != nil {
-		panic(err)
+	memberErr := func(i int, format string, args ...interface{}) error {
+		return fmt.Errorf("member %d of toolchain %q of package %q %s", i, name,
+			p.pkgPath, fmt.Sprintf(format, args...))
 	}
 
-	return v
-}
+	tc := &toolchain{}
+	seen := make(map[interface{}]bool, len(members))
+	for i, member := range members {
+		switch member := member.(type) {
+		case Variable:
+			if member.packageContext() != p || p.scope.variables[member.name()] != member {
+				panic(memberErr(i, "is not a variable of the package: %s", member))
+			}
+			tc.vars = append(tc.vars, member)
+		case Rule:
+			if member.packageContext() != p || p.scope.rules[member.name()] != member {
+				panic(memberErr(i, "is not a rule of the package: %s", member))
+			}
+			tc.rules = append(tc.rules, member)
+		case Pool:
+			if member.packageContext() != p || p.scope.pools[member.name()] != member {
+				panic(memberErr(i, "is not a pool of the package: %s", member))
+			}
+			tc.pools = append(tc.pools, member)
+		default:
+			panic(memberErr(i, "is a %T, not a Variable, Rule, or Pool", member))
+		}
 
-func (v *staticVariable) packageContext() *packageContext {
-	return v.pctx
-}
+		if seen[member] {
+			panic(memberErr(i, "is listed more than once"))
+		}
+		seen[member] = true
+	}
 
-func (v *staticVariable) name() string {
-	return v.name_
+	if p.toolchains == nil {
+		p.toolchains = make(map[string]*toolchain)
+	}
+	p.toolchains[name] = tc
 }
 
-func (v *staticVariable) fullName(pkgNames map[*packageContext]string) string {
-	return packageNamespacePrefix(pkgNames[v.pctx]) + v.name_
-}
+// ImportToolchain makes the members of the toolchain with the given name,
+// defined by the package with path pkgPath using DefineToolchain, part of the
+// scope of the calling package, so that they can be referenced like the
+// definitions of the calling package, as in "${Var}", without importing
+// pkgPath.  Like with ReExport, the definitions are still written to the Ninja
+// file under the namespace of the package that defined them, and the members
+// with exported names are exported by the calling package too.  A member whose
+// name collides with a name already defined in the calling package results in
+// a panic.  It may only be called from a Go package's init() function.
+func (p *packageContext) ImportToolchain(pkgPath, name string) {
+	checkCalledFromInit()
 
-func (v *staticVariable) value(interface{}) (*ninjaString, error) {
-	ninjaStr, err := parseNinjaString(v.pctx.scope, v.value_)
-	if err != nil {
-		err = fmt.Errorf("error parsing variable %s value: %s", v, err)
-		panic(err)
+	pctx, ok := packageContexts[pkgPath]
+	if !ok {
+		panic(&ImportError{pkgPath, fmt.Errorf("package %q has no context", pkgPath)})
+	}
+	tc, ok := pctx.toolchains[name]
+	if !ok {
+		panic(fmt.Errorf("package %q has no toolchain %q", pkgPath, name))
 	}
-	return ninjaStr, nil
-}
 
-func (v *staticVariable) String() string {
-	return v.pctx.pkgPath + "." + v.name_
-}
+	importErr := func(err error) error {
+		return fmt.Errorf("cannot import toolchain %q of package %q into %q: %s",
+			name, pkgPath, p.pkgPath, err)
+	}
 
-type variableFunc struct {
-	pctx   *packageContext
-	name_  string
-	value_ func(interface{}) (string, error)
+	for _, v := range tc.vars {
+		err := p.scope.AddVariable(v)
+		if err != nil {
+			panic(importErr(err))
+		}
+	}
+	for _, r := range tc.rules {
+		err := p.scope.AddRule(r)
+		if err != nil {
+			panic(importErr(err))
+		}
+	}
+	for _, pool := range tc.pools {
+		err := p.scope.AddPool(pool)
+		if err != nil {
+			panic(importErr(err))
+		}
+	}
 }
 
-// VariableFunc returns a Variable whose value is determined by a function that
-// takes a config object as input and returns either the variable value or an
-// error.  It may only be called during a Go package's initialization - either
-// from the init() function or as part of a package-scoped variable's
-// initialization.
+// SetNamespace sets the Ninja namespace of the package, which replaces the name
+// derived from its package path in the Ninja names of its variables, rules, and
+// pools.  Several Go packages may share a namespace, for example the toolchain
+// packages "tc/arm" and "tc/x86" can both write their variables as "g.tc.Var",
+// but then no two of them may define a variable, rule, or pool with the same
+// name.  Such collisions are reported by Context.ResolveDependencies.  The
+// namespace must be a valid Ninja name without '.' characters.  It may only be
+// called from a Go package's init() function.
 //
-// This function is usually used to initialize a package-scoped Go variable that
-// represents a Ninja variable that will be output.  The name argument should
-// exactly match the Go variable name, and the value string returned by f may
-// reference other Ninja variables that are visible within the calling Go
-// package.
-func (p *packageContext) VariableFunc(name string,
-	f func(config interface{}) (string, error)) Variable {
-
+// The namespace only affects the generated Ninja file.  Other Go packages still
+// refer to the package's variables using the name it was imported with.
+func (p *packageContext) SetNamespace(ns string) {
 	checkCalledFromInit()
 
-	err := validateNinjaName(name)
-	if err != nil {
-		panic(err)
+	if ns == "" {
+		panic(fmt.Errorf("empty namespace for package %q", p.pkgPath))
 	}
-
-	v := &variableFunc{p, name, f}
-	err = p.scope.AddVariable(v)
+	err := validateNinjaName(ns)
 	if err != nil {
 		panic(err)
 	}
+	if strings.ContainsRune(ns, '.') {
+		panic(fmt.Errorf("namespace %q for package %q contains a '.' character",
+			ns, p.pkgPath))
+	}
 
-	return v
+	p.namespace = ns
 }
 
-// VariableConfigMethod returns a Variable whose value is determined by calling
-// a method on the config object.  The method must take no arguments and return
-// a single string that will be the variable's value.  It may only be called
-// during a Go package's initialization - either from the init() function or as
-// part of a package-scoped variable's initialization.
-//
-// This function is usually used to initialize a package-scoped Go variable that
-// represents a Ninja variable that will be output.  The name argument should
-// exactly match the Go variable name, and the value string returned by method
-// may reference other Ninja variables that are visible within the calling Go
-// package.
-func (p *packageContext) VariableConfigMethod(name string,
-	method interface{}) Variable {
-
+// SetPackageDefaultPool sets the pool of the package's static rules and rule
+// functions whose RuleParams do not specify a Pool, to bound the number of their
+// build statements that run concurrently.  The Pool of the RuleParams or of the
+// BuildParams still takes precedence.  Generator rules are left without a pool,
+// so that regenerating the manifest is never queued behind other work.  The
+// pool must be defined by the package or by a package it has already imported.
+// It may only be called from a Go package's init() function.
+func (p *packageContext) SetPackageDefaultPool(pool Pool) {
 	checkCalledFromInit()
 
-	err := validateNinjaName(name)
-	if err != nil {
-		panic(err)
+	if pool == nil {
+		panic(fmt.Errorf("nil default pool for package %q", p.pkgPath))
+	}
+	if !p.scope.IsPoolVisible(pool) {
+		panic(fmt.Errorf("default pool %s for package %q is not defined by "+
+			"the package or by a package it imports", pool, p.pkgPath))
 	}
 
-	methodValue := reflect.ValueOf(method)
-	validateVariableMethod(name, methodValue)
+	p.defaultPool = pool
+}
 
-	fun := func(config interface{}) (string, error) {
-		result := methodValue.Call([]reflect.Value{reflect.ValueOf(config)})
-		resultStr := result[0].Interface().(string)
-		return resultStr, nil
+// addImport makes importPkg visible in the package's scope under the local
+// name as.  It returns an *ImportError if another package was already imported
+// under that name or if the import would create a cycle.
+func (p *packageContext) addImport(as string, importPkg *packageContext) error {
+	importErr := func(err error) error {
+		return &ImportError{importPkg.pkgPath, err}
+	}
+
+	if otherPkg, present := p.imports[as]; present {
+		if otherPkg == importPkg {
+			return importErr(fmt.Errorf("package %q is already imported as %q",
+				importPkg.pkgPath, as))
+		}
+		return importErr(fmt.Errorf("cannot import package %q as %q: package %q is "+
+			"already imported as %q (use ImportAs to choose a different name)",
+			importPkg.pkgPath, as, otherPkg.pkgPath, as))
+	}
+
+	if cycle := importPkg.importChain(p); cycle != nil {
+		pkgPaths := []string{p.pkgPath}
+		for _, pctx := range cycle {
+			pkgPaths = append(pkgPaths, pctx.pkgPath)
+		}
+		return importErr(fmt.Errorf("import cycle detected: %s",
+			strings.Join(pkgPaths, " -> ")))
 	}
 
-	v := &variableFunc{p, name, fun}
-	err = p.scope.AddVariable(v)
+	err := p.scope.AddImport(as, importPkg.scope)
 	if err != nil {
-		panic(err)
+		return importErr(err)
 	}
 
-	return v
+	p.imports[as] = importPkg
+	return nil
 }
 
-func (v *variableFunc) packageContext() *packageContext {
-	return v.pctx
-}
+// importName returns the local name used by Import for importPkg, which is its
+// short name with the characters that cannot be part of a package name in a
+// Ninja variable reference replaced with '_'.
+func (p *packageContext) importName(importPkg *packageContext) (string, error) {
+	name := importPkg.shortName
+	if validateNinjaName(name) == nil && !strings.ContainsRune(name, '.') {
+		return name, nil
+	}
 
-func (v *variableFunc) name() string {
-	return v.name_
-}
+	sanitized := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') ||
+			(r >= '0' && r <= '9') || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, name)
+
+	if otherPkg, present := p.imports[sanitized]; present && otherPkg != importPkg {
+		return "", &ImportError{importPkg.pkgPath, fmt.Errorf("cannot import package "+
+			"%q: its name %q is not a valid Ninja name and package %q is already "+
+			"imported as %q (use ImportAs to choose a different name)",
+			importPkg.pkgPath, name, otherPkg.pkgPath, sanitized)}
+	}
 
-func (v *variableFunc) fullName(pkgNames map[*packageContext]string) string {
-	return packageNamespacePrefix(pkgNames[v.pctx]) + v.name_
+	return sanitized, nil
 }
 
-func (v *variableFunc) value(config interface{}) (*ninjaString, error) {
-	value, err := v.value_(config)
-	if err != nil {
-		return nil, err
-	}
+// importChain returns the chain of packages from p to target following the
+// packages' imports, starting with p and ending with target, or nil if target
+// is not reachable from p.
+func (p *packageContext) importChain(target *packageContext) []*packageContext {
+	visited := make(map[*packageContext]bool)
 
-	ninjaStr, err := parseNinjaString(v.pctx.scope, value)
-	if err != nil {
-		err = fmt.Errorf("error parsing variable %s value: %s", v, err)
-		panic(err)
+	var walk func(pctx *packageContext) []*packageContext
+	walk = func(pctx *packageContext) []*packageContext {
+		if pctx == target {
+			return []*packageContext{pctx}
+		}
+		if visited[pctx] {
+			return nil
+		}
+		visited[pctx] = true
+
+		names := make([]string, 0, len(pctx.imports))
+		for name := range pctx.imports {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if chain := walk(pctx.imports[name]); chain != nil {
+				return append([]*packageContext{pctx}, chain...)
+			}
+		}
+		return nil
 	}
 
-	return ninjaStr, nil
+	return walk(p)
 }
 
-func (v *variableFunc) String() string {
-	return v.pctx.pkgPath + "." + v.name_
-}
+// ExportedNames returns the sorted names of the variables, rules, and pools
+// exported by the package with the given path.  These are the names that can be
+// referenced by other packages after calling Import or ImportAs, for example a
+// returned variable name "Foo" can be referenced as "${pkg.Foo}".  An error is
+// returned if the package has no package context.
+func ExportedNames(pkgPath string) (vars, rules, pools []string, err error) {
+	pctx, ok := packageContexts[pkgPath]
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("package %q has no context", pkgPath)
+	}
 
-func validateVariableMethod(name string, methodValue reflect.Value) {
-	methodType := methodValue.Type()
-	if methodType.Kind() != reflect.Func {
-		panic(fmt.Errorf("method given for variable %s is not a function",
-			name))
+	scope := pctx.scope
+	for name := range scope.variables {
+		if isExportedName(name) {
+			vars = append(vars, name)
+		}
 	}
-	if n := methodType.NumIn(); n != 1 {
-		panic(fmt.Errorf("method for variable %s has %d inputs (should be 1)",
-			name, n))
+	for name := range scope.rules {
+		if isExportedName(name) {
+			rules = append(rules, name)
+		}
 	}
-	if n := methodType.NumOut(); n != 1 {
-		panic(fmt.Errorf("method for variable %s has %d outputs (should be 1)",
-			name, n))
+	for name := range scope.pools {
+		if isExportedName(name) {
+			pools = append(pools, name)
+		}
 	}
-	if kind := methodType.Out(0).Kind(); kind != reflect.String {
-		panic(fmt.Errorf("method for variable %s does not return a string",
-			name))
+
+	sort.Strings(vars)
+	sort.Strings(rules)
+	sort.Strings(pools)
+
+	return vars, rules, pools, nil
+}
+
+// AssertExports returns an error if the names of the variables, rules, and
+// pools exported by the package with the given path, as returned by
+// ExportedNames, are not exactly vars, rules, and pools, for example to check
+// that a package's exports are stable.  The error lists the expected names that
+// are missing and the extra exported names, sorted by kind and name, one per
+// line.  An error is also returned if the package has no package context.
+func AssertExports(pkgPath string, vars, rules, pools []string) error {
+	gotVars, gotRules, gotPools, err := ExportedNames(pkgPath)
+	if err != nil {
+		return err
+	}
+
+	var diffs []string
+	diff := func(kind string, want, got []string) {
+		wantSet := make(map[string]bool, len(want))
+		for _, name := range want {
+			wantSet[name] = true
+		}
+		gotSet := make(map[string]bool, len(got))
+		for _, name := range got {
+			gotSet[name] = true
+		}
+
+		var missing, extra []string
+		for name := range wantSet {
+			if !gotSet[name] {
+				missing = append(missing, name)
+			}
+		}
+		for name := range gotSet {
+			if !wantSet[name] {
+				extra = append(extra, name)
+			}
+		}
+		sort.Strings(missing)
+		sort.Strings(extra)
+
+		for _, name := range missing {
+			diffs = append(diffs, fmt.Sprintf("  missing %s %q", kind, name))
+		}
+		for _, name := range extra {
+			diffs = append(diffs, fmt.Sprintf("  extra %s %q", kind, name))
+		}
+	}
+	diff("variable", vars, gotVars)
+	diff("rule", rules, gotRules)
+	diff("pool", pools, gotPools)
+
+	if len(diffs) == 0 {
+		return nil
 	}
+	return fmt.Errorf("package %q does not export the expected names:\n%s",
+		pkgPath, strings.Join(diffs, "\n"))
 }
 
-// An argVariable is a Variable that exists only when it is set by a build
-// statement to pass a value to the rule being invoked.  It has no value, so it
-// can never be used to create a Ninja assignment statement.  It is inserted
-// into the rule's scope, which is used for name lookups within the rule and
-// when assigning argument values as part of a build statement.
-type argVariable struct {
-	name_ string
+// ImportGraph returns the paths of the packages imported by each package with a
+// package context, mapped from the path of the importing package.  The imported
+// paths are sorted and each one is listed once, even if the package was
+// imported under several names with ImportAs.  The packages that import nothing
+// are included with a nil list.  Packages whose names are only made visible by
+// ReExport are not considered imported.
+func ImportGraph() map[string][]string {
+	graph := make(map[string][]string, len(packageContexts))
+	for pkgPath, pctx := range packageContexts {
+		seen := make(map[string]bool, len(pctx.imports))
+		var imports []string
+		for _, imported := range pctx.imports {
+			if !seen[imported.pkgPath] {
+				seen[imported.pkgPath] = true
+				imports = append(imports, imported.pkgPath)
+			}
+		}
+		sort.Strings(imports)
+		graph[pkgPath] = imports
+	}
+	return graph
 }
 
-func (v *argVariable) packageContext() *packageContext {
-	panic("this should not be called")
+// VariablePackage returns the path of the package that defined v.  It returns
+// false for variables that do not belong to a package, such as rule arguments
+// and local variables.
+func VariablePackage(v Variable) (pkgPath string, ok bool) {
+	if _, isArg := v.(*argVariable); isArg {
+		return "", false
+	}
+	return packagePath(v.packageContext())
 }
 
-func (v *argVariable) name() string {
-	return v.name_
+// RulePackage returns the path of the package that defined r.  It returns false
+// for rules that do not belong to a package, such as the built-in rules.
+func RulePackage(r Rule) (pkgPath string, ok bool) {
+	return packagePath(r.packageContext())
 }
 
-func (v *argVariable) fullName(pkgNames map[*packageContext]string) string {
-	return v.name_
+// PoolPackage returns the path of the package that defined p.  It returns false
+// for pools that do not belong to a package, such as the built-in pools.
+func PoolPackage(p Pool) (pkgPath string, ok bool) {
+	return packagePath(p.packageContext())
 }
 
-func (v *argVariable) value(config interface{}) (*ninjaString, error) {
-	return nil, errVariableIsArg
+// RuleArgNames returns the sorted names of the arguments that r accepts in
+// BuildParams.Args.  It returns nil for rules that do not accept any arguments,
+// such as the built-in rules.
+func RuleArgNames(r Rule) []string {
+	var argNames map[string]bool
+	switch r := r.(type) {
+	case *staticRule:
+		argNames = r.argNames
+	case *ruleFunc:
+		argNames = r.argNames
+	case *selectedRule:
+		argNames = r.argNames
+	case *localRule:
+		argNames = r.argNames
+	case *rspfileRule:
+		return RuleArgNames(r.rule)
+	}
+
+	if len(argNames) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(argNames))
+	for argName := range argNames {
+		names = append(names, argName)
+	}
+	sort.Strings(names)
+
+	return names
 }
 
-func (v *argVariable) String() string {
-	return "<arg>:" + v.name_
+// checkRuleArgUsage returns an error if def, the definition of a rule created
+// by StaticRule or RuleFunc, does not use one of the arguments of the rule, see
+// Context.SetCheckUnusedRuleArgs.
+func checkRuleArgUsage(r Rule, def *ruleDef) error {
+	var argNames map[string]bool
+	switch r := r.(type) {
+	case *staticRule:
+		argNames = r.argNames
+	case *ruleFunc:
+		argNames = r.argNames
+	default:
+		return nil
+	}
+
+	err := validateRuleArgUsage(def, r.scope(), argNames)
+	if err != nil {
+		return fmt.Errorf("invalid arguments for rule %s: %s", r, err)
+	}
+	return nil
 }
 
-type staticPool struct {
+func packagePath(pctx *packageContext) (string, bool) {
+	if pctx == nil {
+		return "", false
+	}
+	return pctx.pkgPath, true
+}
+
+type staticVariable struct {
 	pctx   *packageContext
 	name_  string
-	params PoolParams
+	value_ string
+
+	deprecated  bool   // set by DeprecatedStaticVariable
+	replacement string // suggested replacement for a deprecated variable
+
+	values []string // set by StaticListVariable, never nil for list variables
+
+	parsed     *ninjaString
+	sync.Mutex // protects parsed during lazy parsing
 }
 
-// StaticPool returns a Pool whose value does not depend on any configuration
-// information.  It may only be called during a Go package's initialization -
-// either from the init() function or as part of a package-scoped Go variable's
-// initialization.
+// StaticVariable returns a Variable whose value does not depend on any
+// configuration information.  It may only be called during a Go package's
+// initialization - either from the init() function or as part of a package-
+// scoped variable's initialization.
 //
 // This function is usually used to initialize a package-scoped Go variable that
-// represents a Ninja pool that will be output.  The name argument should
-// exactly match the Go variable name, and the params fields may reference other
+// represents a Ninja variable that will be output.  The name argument should
+// exactly match the Go variable name, and the value string may reference other
 // Ninja variables that are visible within the calling Go package.
-func (p *packageContext) StaticPool(name string, params PoolParams) Pool {
+//
+// The syntax of the value string is checked immediately, but the variables it
+// references are only looked up once the value is used, so it may reference
+// variables that are declared or imported later during initialization.
+//
+// Ninja values are single lines, so each newline in the value is written as a
+// line continuation, which Ninja reads as a space.  A multi-line shell script
+// must therefore end its commands with ';' or "&&".
+func (p *packageContext) StaticVariable(name, value string) Variable {
+	v, err := p.TryStaticVariable(name, value)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// TryStaticVariable provides the same functionality as StaticVariable, but it
+// returns an error instead of panicking if the variable is invalid, so that the
+// errors of several definitions can be reported together.  An invalid name
+// results in an *InvalidNameError, and a name that is already defined in the
+// package results in a *DuplicateNameError.  It may only be called during a Go
+// package's initialization.
+func (p *packageContext) TryStaticVariable(name, value string) (Variable, error) {
 	checkCalledFromInit()
+	return p.addStaticVariable(&staticVariable{
+		pctx:   p,
+		name_:  name,
+		value_: value,
+	})
+}
 
-	err := validateNinjaName(name)
+// addStaticVariable validates v and adds it to the package's scope.
+func (p *packageContext) addStaticVariable(v *staticVariable) (Variable, error) {
+	err := validateNinjaName(v.name_)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	pool := &staticPool{p, name, params}
-	err = p.scope.AddPool(pool)
+	arg, err := referencedRuleArg(p.scope, v.value_)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("error parsing variable %s value: %s", v, err)
+	}
+	if arg != "" {
+		return nil, fmt.Errorf("variable %s references the rule argument %q: "+
+			"package-scoped variables cannot reference rule arguments", v, arg)
 	}
 
-	return pool
-}
+	err = p.addVariable(v)
+	if err != nil {
+		return nil, err
+	}
 
-func (p *staticPool) packageContext() *packageContext {
-	return p.pctx
+	return v, nil
 }
 
-func (p *staticPool) name() string {
-	return p.name_
+// DeprecatedStaticVariable returns a Variable that behaves exactly like one
+// returned by StaticVariable, but that is marked as deprecated.  Each build
+// statement, rule, or variable that references it during the generate phase
+// results in a warning that suggests using replacement instead.  The collected
+// warnings are available from Context.Warnings.  It may only be called during a
+// Go package's initialization - either from the init() function or as part of a
+// package-scoped variable's initialization.
+func (p *packageContext) DeprecatedStaticVariable(name, value,
+	replacement string) Variable {
+
+	v, err := p.TryDeprecatedStaticVariable(name, value, replacement)
+	if err != nil {
+		panic(err)
+	}
+	return v
 }
 
-func (p *staticPool) fullName(pkgNames map[*packageContext]string) string {
-	return packageNamespacePrefix(pkgNames[p.pctx]) + p.name_
+// TryDeprecatedStaticVariable provides the same functionality as
+// DeprecatedStaticVariable, but it returns an error instead of panicking if the
+// variable is invalid.  It may only be called during a Go package's
+// initialization.
+func (p *packageContext) TryDeprecatedStaticVariable(name, value,
+	replacement string) (Variable, error) {
+
+	checkCalledFromInit()
+	return p.addStaticVariable(&staticVariable{
+		pctx:        p,
+		name_:       name,
+		value_:      value,
+		deprecated:  true,
+		replacement: replacement,
+	})
 }
 
-func (p *staticPool) def(config interface{}) (*poolDef, error) {
-	def, err := parsePoolParams(p.pctx.scope, &p.params)
+// StaticListVariable returns a Variable whose value is the list of strings in
+// values joined with sep.  Each element is treated as a literal string, so any
+// '$' characters it contains are escaped and do not reference other Ninja
+// variables.  It may only be called during a Go package's initialization -
+// either from the init() function or as part of a package-scoped variable's
+// initialization.
+//
+// The unescaped elements can be retrieved with StaticListVariableValues.
+func (p *packageContext) StaticListVariable(name string, values []string,
+	sep string) Variable {
+
+	v, err := p.TryStaticListVariable(name, values, sep)
 	if err != nil {
-		panic(fmt.Errorf("error parsing PoolParams for %s: %s", p, err))
+		panic(err)
 	}
-	return def, nil
+	return v
 }
 
-func (p *staticPool) String() string {
-	return p.pctx.pkgPath + "." + p.name_
-}
+// TryStaticListVariable provides the same functionality as StaticListVariable,
+// but it returns an error instead of panicking if the variable is invalid.  It
+// may only be called during a Go package's initialization.
+func (p *packageContext) TryStaticListVariable(name string, values []string,
+	sep string) (Variable, error) {
 
-type poolFunc struct {
-	pctx       *packageContext
-	name_      string
-	paramsFunc func(interface{}) (PoolParams, error)
+	checkCalledFromInit()
+	return p.addStaticVariable(&staticVariable{
+		pctx:   p,
+		name_:  name,
+		value_: strings.Join(proptools.NinjaEscapeList(values), sep),
+		values: append([]string{}, values...),
+	})
 }
 
-// PoolFunc returns a Pool whose value is determined by a function that takes a
-// config object as input and returns either the pool parameters or an error. It
-// may only be called during a Go package's initialization - either from the
-// init() function or as part of a package-scoped variable's initialization.
+// StaticVariableJoin returns a Variable whose value is the non-empty fragments
+// joined with sep.  It may only be called during a Go package's initialization
+// - either from the init() function or as part of a package-scoped variable's
+// initialization.
 //
-// This function is usually used to initialize a package-scoped Go variable that
-// represents a Ninja pool that will be output.  The name argument should
-// exactly match the Go variable name, and the string fields of the PoolParams
-// returned by f may reference other Ninja variables that are visible within the
-// calling Go package.
-func (p *packageContext) PoolFunc(name string, f func(interface{}) (PoolParams,
-	error)) Pool {
-
-	checkCalledFromInit()
-
-	err := validateNinjaName(name)
+// Unlike the elements of StaticListVariable, each fragment is a Ninja string
+// like the value of StaticVariable, which may reference other Ninja variables
+// and must escape its literal '$' characters as "$$".  The separator is treated
+// as a literal string and is escaped.  The empty fragments are dropped so that
+// they don't result in doubled separators.
+func (p *packageContext) StaticVariableJoin(name, sep string,
+	fragments ...string) Variable {
+
+	v, err := p.TryStaticVariableJoin(name, sep, fragments...)
 	if err != nil {
 		panic(err)
 	}
+	return v
+}
 
-	pool := &poolFunc{p, name, f}
-	err = p.scope.AddPool(pool)
-	if err != nil {
-		panic(err)
+// TryStaticVariableJoin provides the same functionality as StaticVariableJoin,
+// but it returns an error instead of panicking if a fragment or the variable is
+// invalid.  It may only be called during a Go package's initialization.
+func (p *packageContext) TryStaticVariableJoin(name, sep string,
+	fragments ...string) (Variable, error) {
+
+	checkCalledFromInit()
+
+	var nonEmpty []string
+	for _, fragment := range fragments {
+		if fragment == "" {
+			continue
+		}
+		// Check each fragment on its own, a trailing '$' could otherwise be
+		// completed by the separator.
+		err := validateNinjaStringSyntax(fragment)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing fragment %q of variable %q: %s",
+				fragment, name, err)
+		}
+		nonEmpty = append(nonEmpty, fragment)
 	}
 
-	return pool
+	return p.addStaticVariable(&staticVariable{
+		pctx:   p,
+		name_:  name,
+		value_: strings.Join(nonEmpty, proptools.NinjaEscape(sep)),
+	})
 }
 
-func (p *poolFunc) packageContext() *packageContext {
-	return p.pctx
-}
+// OverrideVariable replaces the value of a Variable defined by a package's
+// StaticVariable, VariableFunc, or similar call with newValue.  It allows a
+// package that is initialized later, for example one for a specific product,
+// to change the value of a variable without modifying the package that defined
+// it.  It may only be called from a Go package's init() function.
+//
+// The newValue string is parsed in the scope of the package that defined v, so
+// it may only reference variables that are visible within that package.  A
+// Variable may only be overridden once, and argument variables and variables
+// local to a module or singleton cannot be overridden.
+func OverrideVariable(v Variable, newValue string) {
+	checkCalledFromInit()
 
-func (p *poolFunc) name() string {
-	return p.name_
-}
+	switch v.(type) {
+	case *staticVariable, *variableFunc, *dynamicVariable, *envVariable,
+		*fileVariable, *concatVariable, *flavoredVariable:
+	default:
+		panic(fmt.Errorf("cannot override variable %s", v))
+	}
 
-func (p *poolFunc) fullName(pkgNames map[*packageContext]string) string {
-	return packageNamespacePrefix(pkgNames[p.pctx]) + p.name_
-}
+	pctx := v.packageContext()
+	if _, present := pctx.overrides[v]; present {
+		panic(fmt.Errorf("variable %s is already overridden", v))
+	}
 
-func (p *poolFunc) def(config interface{}) (*poolDef, error) {
-	params, err := p.paramsFunc(config)
+	arg, err := referencedRuleArg(pctx.scope, newValue)
 	if err != nil {
-		return nil, err
+		panic(fmt.Errorf("error parsing override for variable %s: %s", v, err))
 	}
-	def, err := parsePoolParams(p.pctx.scope, &params)
-	if err != nil {
-		panic(fmt.Errorf("error parsing PoolParams for %s: %s", p, err))
+	if arg != "" {
+		panic(fmt.Errorf("override for variable %s references the rule argument "+
+			"%q: package-scoped variables cannot reference rule arguments", v, arg))
+	}
+
+	pctx.overrides[v] = &staticVariable{
+		pctx:   pctx,
+		name_:  v.name(),
+		value_: newValue,
 	}
-	return def, nil
 }
 
-func (p *poolFunc) String() string {
-	return p.pctx.pkgPath + "." + p.name_
+// overrideValue returns the value registered for v by OverrideVariable.  The
+// returned bool is false if v has not been overridden.
+func (p *packageContext) overrideValue(v Variable) (*ninjaString, bool) {
+	override, ok := p.overrides[v]
+	if !ok {
+		return nil, false
+	}
+	ninjaStr, _ := override.value(nil)
+	return ninjaStr, true
 }
 
-type builtinPool struct {
-	name_ string
+// StaticListVariableValues returns a copy of the unescaped elements passed to
+// StaticListVariable for v.  The returned bool is false if v was not created by
+// StaticListVariable.
+func StaticListVariableValues(v Variable) ([]string, bool) {
+	sv, ok := v.(*staticVariable)
+	if !ok || sv.values == nil {
+		return nil, false
+	}
+	return append([]string{}, sv.values...), true
 }
 
-func (p *builtinPool) packageContext() *packageContext {
-	return nil
+// StaticVariableValue returns the value string of v as it was passed to
+// StaticVariable, with the variables it references left unexpanded.  If v has
+// been overridden by OverrideVariable the value string of the override is
+// returned instead.  The returned bool is false if v is not a static variable.
+func StaticVariableValue(v Variable) (string, bool) {
+	sv, ok := v.(*staticVariable)
+	if !ok {
+		return "", false
+	}
+	if override, ok := sv.pctx.overrides[v]; ok {
+		return override.value_, true
+	}
+	return sv.value_, true
 }
 
-func (p *builtinPool) name() string {
-	return p.name_
+func (v *staticVariable) packageContext() *packageContext {
+	return v.pctx
 }
 
-func (p *builtinPool) fullName(pkgNames map[*packageContext]string) string {
-	return p.name_
+func (v *staticVariable) name() string {
+	return v.name_
 }
 
-func (p *builtinPool) def(config interface{}) (*poolDef, error) {
-	return nil, errPoolIsBuiltin
+func (v *staticVariable) fullName(pkgNames map[*packageContext]string) string {
+	return transformNinjaName(packageNamespacePrefix(pkgNames[v.pctx]) + v.name_)
 }
 
-// NewBuiltinPool returns a Pool object that refers to a pool name created outside of Blueprint
-func NewBuiltinPool(name string) Pool {
-	return &builtinPool{
-		name_: name,
+func (v *staticVariable) value(interface{}) (*ninjaString, error) {
+	if ninjaStr, ok := v.pctx.overrideValue(v); ok {
+		return ninjaStr, nil
+	}
+
+	// We lazily parse the value so that it may reference variables that are
+	// declared, or packages that are imported, after the variable itself.
+	v.Lock()
+	defer v.Unlock()
+
+	if v.parsed == nil {
+		ninjaStr, err := parseNinjaString(v.pctx.scope, v.value_)
+		if err != nil {
+			err = fmt.Errorf("error parsing variable %s value: %s", v, err)
+			panic(err)
+		}
+		v.parsed = ninjaStr
 	}
+	return v.parsed, nil
 }
 
-func (p *builtinPool) String() string {
-	return "<builtin>:" + p.name_
+func (v *staticVariable) String() string {
+	return v.pctx.pkgPath + "." + v.name_
 }
 
-type staticRule struct {
-	pctx       *packageContext
-	name_      string
-	params     RuleParams
-	argNames   map[string]bool
-	scope_     *basicScope
-	sync.Mutex // protects scope_ during lazy creation
+// deprecationWarning returns the warning to report when the variable is
+// referenced, or an empty string if the variable is not deprecated.
+func (v *staticVariable) deprecationWarning() string {
+	if !v.deprecated {
+		return ""
+	}
+	msg := fmt.Sprintf("variable ${%s.%s} is deprecated", v.pctx.shortName,
+		v.name_)
+	if v.replacement != "" {
+		msg += ", use " + v.replacement
+	}
+	return msg
 }
 
-// StaticRule returns a Rule whose value does not depend on any configuration
-// information.  It may only be called during a Go package's initialization -
-// either from the init() function or as part of a package-scoped Go variable's
+type variableFunc struct {
+	pctx   *packageContext
+	name_  string
+	value_ func(interface{}) (string, error)
+	cache  sync.Map // parsed values by config object, see configCacheKey
+}
+
+// VariableFunc returns a Variable whose value is determined by a function that
+// takes a config object as input and returns either the variable value or an
+// error.  It may only be called during a Go package's initialization - either
+// from the init() function or as part of a package-scoped variable's
 // initialization.
 //
 // This function is usually used to initialize a package-scoped Go variable that
-// represents a Ninja rule that will be output.  The name argument should
-// exactly match the Go variable name, and the params fields may reference other
-// Ninja variables that are visible within the calling Go package.
-//
-// The argNames arguments list Ninja variables that may be overridden by Ninja
-// build statements that invoke the rule.  These arguments may be referenced in
-// any of the string fields of params.  Arguments can shadow package-scoped
-// variables defined within the caller's Go package, but they may not shadow
-// those defined in another package.  Shadowing a package-scoped variable
-// results in the package-scoped variable's value being used for build
-// statements that do not override the argument.  For argument names that do not
-// shadow package-scoped variables the default value is an empty string.
-func (p *packageContext) StaticRule(name string, params RuleParams,
-	argNames ...string) Rule {
+// represents a Ninja variable that will be output.  The name argument should
+// exactly match the Go variable name, and the value string returned by f may
+// reference other Ninja variables that are visible within the calling Go
+// package.
+func (p *packageContext) VariableFunc(name string,
+	f func(config interface{}) (string, error)) Variable {
+
+	v, err := p.TryVariableFunc(name, f)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// TryVariableFunc provides the same functionality as VariableFunc, but it
+// returns an error instead of panicking if the name is invalid or already
+// defined in the package.  It may only be called during a Go package's
+// initialization.
+func (p *packageContext) TryVariableFunc(name string,
+	f func(config interface{}) (string, error)) (Variable, error) {
 
 	checkCalledFromInit()
 
 	err := validateNinjaName(name)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	v := &variableFunc{pctx: p, name_: name, value_: f}
+	err = p.addVariable(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// ListVariableFunc returns a Variable whose value is the list of strings
+// returned by a function that takes a config object as input, joined with sep.
+// Like the elements passed to StaticListVariable, each element is treated as a
+// literal string and escaped individually.  A nil or empty list results in an
+// empty value.  It may only be called during a Go package's initialization -
+// either from the init() function or as part of a package-scoped variable's
+// initialization.
+func (p *packageContext) ListVariableFunc(name string,
+	f func(config interface{}) ([]string, error), sep string) Variable {
+
+	v, err := p.TryListVariableFunc(name, f, sep)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// TryListVariableFunc provides the same functionality as ListVariableFunc, but
+// it returns an error instead of panicking if the name is invalid or already
+// defined in the package.  It may only be called during a Go package's
+// initialization.
+func (p *packageContext) TryListVariableFunc(name string,
+	f func(config interface{}) ([]string, error), sep string) (Variable, error) {
+
+	checkCalledFromInit()
+	return p.TryVariableFunc(name, func(config interface{}) (string, error) {
+		values, err := f(config)
+		if err != nil {
+			return "", err
+		}
+		return strings.Join(proptools.NinjaEscapeList(values), sep), nil
+	})
+}
+
+// OnceVariable returns a Variable whose value is determined by a function that
+// does not depend on the config object, for example one that reads a large
+// configuration file.  The function is called at most once in the process, the
+// first time the variable is evaluated for any config object, and its value or
+// error is the result of every evaluation of the variable.  It may only be
+// called during a Go package's initialization - either from the init()
+// function or as part of a package-scoped variable's initialization.
+func (p *packageContext) OnceVariable(name string, f func() (string, error)) Variable {
+	v, err := p.TryOnceVariable(name, f)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// TryOnceVariable provides the same functionality as OnceVariable, but it
+// returns an error instead of panicking if the name is invalid or already
+// defined in the package.  It may only be called during a Go package's
+// initialization.
+func (p *packageContext) TryOnceVariable(name string,
+	f func() (string, error)) (Variable, error) {
+
+	checkCalledFromInit()
+
+	var (
+		once  sync.Once
+		value string
+		err   error
+	)
+	return p.TryVariableFunc(name, func(interface{}) (string, error) {
+		once.Do(func() {
+			value, err = f()
+		})
+		return value, err
+	})
+}
+
+// VariableConfigMethod returns a Variable whose value is determined by calling
+// a method on the config object.  The method must take no arguments and return
+// a string that will be the variable's value, optionally followed by an error
+// that is returned when the variable is evaluated.  It may only be called
+// during a Go package's initialization - either from the init() function or as
+// part of a package-scoped variable's initialization.
+//
+// This function is usually used to initialize a package-scoped Go variable that
+// represents a Ninja variable that will be output.  The name argument should
+// exactly match the Go variable name, and the value string returned by method
+// may reference other Ninja variables that are visible within the calling Go
+// package.
+//
+// The method may have a value or a pointer receiver, for example Config.Foo or
+// (*Config).Foo.  A method with a value receiver may be used with a pointer
+// config object, which is then dereferenced, but a method with a pointer
+// receiver can only be used with a pointer config object, otherwise evaluating
+// the variable results in an error.
+func (p *packageContext) VariableConfigMethod(name string,
+	method interface{}) Variable {
+
+	v, err := p.TryVariableConfigMethod(name, method)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// TryVariableConfigMethod provides the same functionality as
+// VariableConfigMethod, but it returns an error instead of panicking if the
+// name or the method is invalid.  It may only be called during a Go package's
+// initialization.
+func (p *packageContext) TryVariableConfigMethod(name string,
+	method interface{}) (Variable, error) {
+
+	checkCalledFromInit()
+	return p.TryVariableConfigMethodArgs(name, method)
+}
+
+// VariableConfigMethodArgs returns a Variable whose value is determined by
+// calling a method on the config object with the given arguments.  The method
+// must take len(args) arguments, each of which args must be assignable to, and
+// return a string that will be the variable's value, optionally followed by an
+// error as for VariableConfigMethod.  It may only be called during a Go
+// package's initialization - either from the init() function or as part of a
+// package-scoped variable's initialization.
+//
+// This allows a single method to be used for multiple variables, for example:
+//
+//     var (
+//         ArmArch   = pctx.VariableConfigMethodArgs("ArmArch", Config.Arch, "arm")
+//         Arm64Arch = pctx.VariableConfigMethodArgs("Arm64Arch", Config.Arch, "arm64")
+//     )
+func (p *packageContext) VariableConfigMethodArgs(name string,
+	method interface{}, args ...interface{}) Variable {
+
+	v, err := p.TryVariableConfigMethodArgs(name, method, args...)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// TryVariableConfigMethodArgs provides the same functionality as
+// VariableConfigMethodArgs, but it returns an error instead of panicking if the
+// name, the method, or its arguments are invalid.  It may only be called during
+// a Go package's initialization.
+func (p *packageContext) TryVariableConfigMethodArgs(name string,
+	method interface{}, args ...interface{}) (Variable, error) {
+
+	checkCalledFromInit()
+
+	err := validateNinjaName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	methodValue := reflect.ValueOf(method)
+	argValues, err := validateVariableMethod(name, methodValue, args)
+	if err != nil {
+		return nil, err
+	}
+
+	fun := func(config interface{}) (string, error) {
+		return callVariableMethod(p.pkgPath+"."+name, methodValue, config,
+			argValues)
+	}
+
+	v := &variableFunc{pctx: p, name_: name, value_: fun}
+	err = p.addVariable(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// MapVariable returns a Variable whose value is selected from mapping by the
+// key returned by calling keyMethod on the config object, for example to map an
+// architecture to its ABI.  The key method must have the signature of a method
+// for VariableConfigMethod.  A key that is not in mapping selects defaultValue,
+// or results in an error when the variable is evaluated if defaultValue is
+// empty.  It may only be called during a Go package's initialization - either
+// from the init() function or as part of a package-scoped variable's
+// initialization.
+//
+// The values in mapping and defaultValue may reference other Ninja variables
+// that are visible within the calling Go package, their syntax is checked
+// immediately.
+func (p *packageContext) MapVariable(name string, keyMethod interface{},
+	mapping map[string]string, defaultValue string) Variable {
+
+	v, err := p.TryMapVariable(name, keyMethod, mapping, defaultValue)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// TryMapVariable provides the same functionality as MapVariable, but it returns
+// an error instead of panicking if the name, the key method, or one of the
+// values is invalid.  It may only be called during a Go package's
+// initialization.
+func (p *packageContext) TryMapVariable(name string, keyMethod interface{},
+	mapping map[string]string, defaultValue string) (Variable, error) {
+
+	checkCalledFromInit()
+
+	err := validateNinjaName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	methodValue := reflect.ValueOf(keyMethod)
+	_, err = validateVariableMethod(name, methodValue, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(mapping))
+	for key, value := range mapping {
+		err := validateNinjaStringSyntax(value)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing value for key %q of variable %s: %s",
+				key, p.pkgPath+"."+name, err)
+		}
+		values[key] = value
+	}
+	err = validateNinjaStringSyntax(defaultValue)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing default value of variable %s: %s",
+			p.pkgPath+"."+name, err)
+	}
+
+	fun := func(config interface{}) (string, error) {
+		key, err := callVariableMethod(p.pkgPath+"."+name, methodValue, config,
+			nil)
+		if err != nil {
+			return "", err
+		}
+
+		if value, ok := values[key]; ok {
+			return value, nil
+		}
+		if defaultValue != "" {
+			return defaultValue, nil
+		}
+
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return "", fmt.Errorf("variable %s has no value for key %q and no "+
+			"default value, the keys are %q", p.pkgPath+"."+name, key, keys)
+	}
+
+	v := &variableFunc{pctx: p, name_: name, value_: fun}
+	err = p.addVariable(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func (v *variableFunc) packageContext() *packageContext {
+	return v.pctx
+}
+
+func (v *variableFunc) name() string {
+	return v.name_
+}
+
+func (v *variableFunc) fullName(pkgNames map[*packageContext]string) string {
+	return transformNinjaName(packageNamespacePrefix(pkgNames[v.pctx]) + v.name_)
+}
+
+func (v *variableFunc) value(config interface{}) (*ninjaString, error) {
+	if ninjaStr, ok := v.pctx.overrideValue(v); ok {
+		return ninjaStr, nil
+	}
+
+	key, cacheable := configCacheKey(config)
+	if cacheable {
+		if ninjaStr, ok := v.cache.Load(key); ok {
+			return ninjaStr.(*ninjaString), nil
+		}
+	}
+
+	value, err := v.value_(config)
+	if err != nil {
+		return nil, err
+	}
+
+	ninjaStr, err := parseNinjaString(v.pctx.scope, value)
+	if err != nil {
+		err = fmt.Errorf("error parsing variable %s value: %s", v, err)
+		panic(err)
+	}
+
+	if cacheable {
+		v.cache.Store(key, ninjaStr)
+	}
+
+	return ninjaStr, nil
+}
+
+func (v *variableFunc) String() string {
+	return v.pctx.pkgPath + "." + v.name_
+}
+
+type envVariable struct {
+	pctx         *packageContext
+	name_        string
+	envKey       string
+	defaultValue string
+}
+
+var (
+	envDepsLock sync.Mutex
+	envDeps     = make(map[string]string)
+)
+
+// EnvVariable returns a Variable whose value is the value of the environment
+// variable envKey when the Ninja file is generated, or defaultValue if envKey
+// is not set.  It may only be called during a Go package's initialization -
+// either from the init() function or as part of a package-scoped variable's
+// initialization.
+//
+// The value is treated as a literal string, so any '$' characters it contains
+// are escaped and do not reference other Ninja variables.  The environment
+// variables read by EnvVariables are recorded, see EnvDeps.
+func (p *packageContext) EnvVariable(name, envKey, defaultValue string) Variable {
+	v, err := p.TryEnvVariable(name, envKey, defaultValue)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// TryEnvVariable provides the same functionality as EnvVariable, but it returns
+// an error instead of panicking if the name or the environment variable name is
+// invalid.  It may only be called during a Go package's initialization.
+func (p *packageContext) TryEnvVariable(name, envKey,
+	defaultValue string) (Variable, error) {
+
+	checkCalledFromInit()
+
+	err := validateNinjaName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if envKey == "" {
+		return nil, fmt.Errorf("empty environment variable name for variable %q", name)
+	}
+
+	v := &envVariable{
+		pctx:         p,
+		name_:        name,
+		envKey:       envKey,
+		defaultValue: defaultValue,
+	}
+	err = p.addVariable(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// EnvDeps returns the environment variables that have been read by the values
+// of EnvVariables, mapped to the values they had when they were read, or to
+// the empty string if they were not set.  They include the variables listed by
+// the PassthroughEnv params of the rules that have been written.  A Ninja file
+// that uses EnvVariables must be regenerated when one of these values changes.
+func EnvDeps() map[string]string {
+	envDepsLock.Lock()
+	defer envDepsLock.Unlock()
+
+	deps := make(map[string]string, len(envDeps))
+	for key, value := range envDeps {
+		deps[key] = value
+	}
+	return deps
+}
+
+// lookupEnvDep returns the value of the environment variable key and whether it
+// is set, and records it in envDeps.
+func lookupEnvDep(key string) (string, bool) {
+	value, set := os.LookupEnv(key)
+
+	envDepsLock.Lock()
+	envDeps[key] = value
+	envDepsLock.Unlock()
+
+	return value, set
+}
+
+func (v *envVariable) packageContext() *packageContext {
+	return v.pctx
+}
+
+func (v *envVariable) name() string {
+	return v.name_
+}
+
+func (v *envVariable) fullName(pkgNames map[*packageContext]string) string {
+	return transformNinjaName(packageNamespacePrefix(pkgNames[v.pctx]) + v.name_)
+}
+
+func (v *envVariable) value(config interface{}) (*ninjaString, error) {
+	if ninjaStr, ok := v.pctx.overrideValue(v); ok {
+		return ninjaStr, nil
+	}
+
+	value, set := lookupEnvDep(v.envKey)
+	if !set {
+		value = v.defaultValue
+	}
+
+	ninjaStr, err := parseNinjaString(v.pctx.scope, proptools.NinjaEscape(value))
+	if err != nil {
+		// This shouldn't happen, the escaped value references no variables.
+		return nil, fmt.Errorf("error parsing variable %s value: %s", v, err)
+	}
+
+	return ninjaStr, nil
+}
+
+func (v *envVariable) String() string {
+	return v.pctx.pkgPath + "." + v.name_
+}
+
+type fileVariable struct {
+	pctx  *packageContext
+	name_ string
+	path  string
+}
+
+// FileVariable returns a Variable whose value is the contents of the file at
+// path when the Ninja file is generated, without its trailing newline.  It may
+// only be called during a Go package's initialization - either from the init()
+// function or as part of a package-scoped variable's initialization.
+//
+// Like the value string of a StaticVariable, the contents may reference other
+// Ninja variables that are visible within the calling Go package.  An error
+// reading the file is returned when the variable is evaluated.  The path is
+// added to the package's Ninja file dependencies, see AddNinjaFileDeps, so
+// that the Ninja file is regenerated when the file changes.
+func (p *packageContext) FileVariable(name, path string) Variable {
+	v, err := p.TryFileVariable(name, path)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// TryFileVariable provides the same functionality as FileVariable, but it
+// returns an error instead of panicking if the name or the path is invalid.  It
+// may only be called during a Go package's initialization.
+func (p *packageContext) TryFileVariable(name, path string) (Variable, error) {
+	checkCalledFromInit()
+
+	err := validateNinjaName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if path == "" {
+		return nil, fmt.Errorf("empty path for variable %q", name)
+	}
+
+	v := &fileVariable{pctx: p, name_: name, path: path}
+	err = p.addVariable(v)
+	if err != nil {
+		return nil, err
+	}
+
+	p.AddNinjaFileDeps(path)
+
+	return v, nil
+}
+
+func (v *fileVariable) packageContext() *packageContext {
+	return v.pctx
+}
+
+func (v *fileVariable) name() string {
+	return v.name_
+}
+
+func (v *fileVariable) fullName(pkgNames map[*packageContext]string) string {
+	return transformNinjaName(packageNamespacePrefix(pkgNames[v.pctx]) + v.name_)
+}
+
+func (v *fileVariable) value(config interface{}) (*ninjaString, error) {
+	if ninjaStr, ok := v.pctx.overrideValue(v); ok {
+		return ninjaStr, nil
+	}
+
+	contents, err := ioutil.ReadFile(v.path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading variable %s: %s", v, err)
+	}
+
+	value := strings.TrimSuffix(string(contents), "\n")
+	value = strings.TrimSuffix(value, "\r")
+
+	ninjaStr, err := parseNinjaString(v.pctx.scope, value)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing variable %s value from %s: %s",
+			v, v.path, err)
+	}
+
+	return ninjaStr, nil
+}
+
+func (v *fileVariable) String() string {
+	return v.pctx.pkgPath + "." + v.name_
+}
+
+type flavoredVariable struct {
+	pctx         *packageContext
+	name_        string
+	byFlavor     map[string]string
+	defaultValue string
+}
+
+var (
+	generationFlavorLock sync.RWMutex
+	generationFlavor     string
+)
+
+// SetGenerationFlavor sets the flavor of the Ninja file that is being generated,
+// for example "debug" or "release", which selects the values of the
+// FlavoredVariables.  It allows generating several Ninja files from the same
+// definitions without adding the flavor to every config method.  The flavor is
+// empty by default, which selects the default values.  It may be called
+// concurrently with the generation of build actions, but the flavor should not
+// change while a Ninja file is being generated.
+func SetGenerationFlavor(name string) {
+	generationFlavorLock.Lock()
+	defer generationFlavorLock.Unlock()
+	generationFlavor = name
+}
+
+// currentGenerationFlavor returns the flavor set by SetGenerationFlavor.
+func currentGenerationFlavor() string {
+	generationFlavorLock.RLock()
+	defer generationFlavorLock.RUnlock()
+	return generationFlavor
+}
+
+// FlavoredVariable returns a Variable whose value is selected from byFlavor by
+// the flavor set with SetGenerationFlavor when the value is computed.  A flavor
+// that is not in byFlavor selects defaultValue, or results in an error when the
+// variable is evaluated if defaultValue is empty.  It may only be called during
+// a Go package's initialization - either from the init() function or as part of
+// a package-scoped variable's initialization.
+//
+// The values in byFlavor and defaultValue may reference other Ninja variables
+// that are visible within the calling Go package, their syntax is checked
+// immediately.
+func (p *packageContext) FlavoredVariable(name string, byFlavor map[string]string,
+	defaultValue string) Variable {
+
+	v, err := p.TryFlavoredVariable(name, byFlavor, defaultValue)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// TryFlavoredVariable provides the same functionality as FlavoredVariable, but
+// it returns an error instead of panicking if the name or one of the values is
+// invalid.  It may only be called during a Go package's initialization.
+func (p *packageContext) TryFlavoredVariable(name string, byFlavor map[string]string,
+	defaultValue string) (Variable, error) {
+
+	checkCalledFromInit()
+
+	err := validateNinjaName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(byFlavor))
+	for flavor, value := range byFlavor {
+		err := validateNinjaStringSyntax(value)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing value for flavor %q of variable %s: %s",
+				flavor, p.pkgPath+"."+name, err)
+		}
+		values[flavor] = value
+	}
+	err = validateNinjaStringSyntax(defaultValue)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing default value of variable %s: %s",
+			p.pkgPath+"."+name, err)
+	}
+
+	v := &flavoredVariable{
+		pctx:         p,
+		name_:        name,
+		byFlavor:     values,
+		defaultValue: defaultValue,
+	}
+	err = p.addVariable(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func (v *flavoredVariable) packageContext() *packageContext {
+	return v.pctx
+}
+
+func (v *flavoredVariable) name() string {
+	return v.name_
+}
+
+func (v *flavoredVariable) fullName(pkgNames map[*packageContext]string) string {
+	return transformNinjaName(packageNamespacePrefix(pkgNames[v.pctx]) + v.name_)
+}
+
+func (v *flavoredVariable) value(config interface{}) (*ninjaString, error) {
+	if ninjaStr, ok := v.pctx.overrideValue(v); ok {
+		return ninjaStr, nil
+	}
+
+	// The value is not cached, the flavor may change between the generations.
+	flavor := currentGenerationFlavor()
+	value, ok := v.byFlavor[flavor]
+	if !ok {
+		if v.defaultValue == "" {
+			flavors := make([]string, 0, len(v.byFlavor))
+			for flavor := range v.byFlavor {
+				flavors = append(flavors, flavor)
+			}
+			sort.Strings(flavors)
+			return nil, fmt.Errorf("variable %s has no value for flavor %q and "+
+				"no default value, the flavors are %q", v, flavor, flavors)
+		}
+		value = v.defaultValue
+	}
+
+	ninjaStr, err := parseNinjaString(v.pctx.scope, value)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing variable %s value: %s", v, err)
+	}
+
+	return ninjaStr, nil
+}
+
+func (v *flavoredVariable) String() string {
+	return v.pctx.pkgPath + "." + v.name_
+}
+
+type concatVariable struct {
+	pctx  *packageContext
+	name_ string
+	parts []Variable
+}
+
+// ConcatVariable returns a Variable whose value is the values of the parts
+// Variables joined with spaces.  It may only be called during a Go package's
+// initialization - either from the init() function or as part of a
+// package-scoped variable's initialization.
+//
+// Each part is evaluated for the config object when the value is computed, and
+// the Ninja variables referenced by the values of the parts are left
+// unexpanded.  The parts may be defined in other packages.  The nil parts and
+// the parts whose value is empty are skipped, so they don't add extra spaces.
+// Rule arguments cannot be parts.
+func (p *packageContext) ConcatVariable(name string, parts ...Variable) Variable {
+	v, err := p.TryConcatVariable(name, parts...)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// TryConcatVariable provides the same functionality as ConcatVariable, but it
+// returns an error instead of panicking if the name or one of the parts is
+// invalid.  It may only be called during a Go package's initialization.
+func (p *packageContext) TryConcatVariable(name string,
+	parts ...Variable) (Variable, error) {
+
+	checkCalledFromInit()
+
+	err := validateNinjaName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var nonNil []Variable
+	for _, part := range parts {
+		if part == nil {
+			continue
+		}
+		if _, ok := part.(*argVariable); ok {
+			return nil, fmt.Errorf("rule argument %q cannot be part of variable %q",
+				part.name(), name)
+		}
+		nonNil = append(nonNil, part)
+	}
+
+	v := &concatVariable{
+		pctx:  p,
+		name_: name,
+		parts: nonNil,
+	}
+	err = p.addVariable(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func (v *concatVariable) packageContext() *packageContext {
+	return v.pctx
+}
+
+func (v *concatVariable) name() string {
+	return v.name_
+}
+
+func (v *concatVariable) fullName(pkgNames map[*packageContext]string) string {
+	return transformNinjaName(packageNamespacePrefix(pkgNames[v.pctx]) + v.name_)
+}
+
+func (v *concatVariable) value(config interface{}) (*ninjaString, error) {
+	if ninjaStr, ok := v.pctx.overrideValue(v); ok {
+		return ninjaStr, nil
+	}
+
+	result := simpleNinjaString("")
+	for _, part := range v.parts {
+		value, err := part.value(config)
+		if err != nil {
+			return nil, fmt.Errorf("error evaluating part %s of variable %s: %s",
+				part, v, err)
+		}
+		if len(value.variables) == 0 && value.strings[0] == "" {
+			continue
+		}
+
+		last := len(result.strings) - 1
+		if len(result.variables) > 0 || result.strings[last] != "" {
+			result.strings[last] += " "
+		}
+		result.strings[last] += value.strings[0]
+		result.variables = append(result.variables, value.variables...)
+		result.strings = append(result.strings, value.strings[1:]...)
+	}
+
+	return result, nil
+}
+
+func (v *concatVariable) String() string {
+	return v.pctx.pkgPath + "." + v.name_
+}
+
+type dynamicVariable struct {
+	pctx   *packageContext
+	name_  string
+	deps   []Variable
+	value_ func(interface{}, map[Variable]string) (string, error)
+
+	// set by ResolvingVariableFunc instead of deps and value_
+	resolvingValue func(interface{}, func(Variable) (string, error)) (string, error)
+}
+
+// DynamicVariable returns a Variable whose value is determined by a function
+// that takes a config object and the fully evaluated values of the deps
+// Variables as input, and returns either the variable value or an error.  It
+// may only be called during a Go package's initialization - either from the
+// init() function or as part of a package-scoped variable's initialization.
+//
+// Each Variable in deps is evaluated for the config object, including any
+// Ninja variables it references, before f is called.  The resolved map passed
+// to f contains an entry for every Variable in deps.  A dependency cycle
+// between variables results in an error during evaluation.
+//
+// This function is usually used to initialize a package-scoped Go variable that
+// represents a Ninja variable that will be output.  The name argument should
+// exactly match the Go variable name, and the value string returned by f may
+// reference other Ninja variables that are visible within the calling Go
+// package.
+func (p *packageContext) DynamicVariable(name string, deps []Variable,
+	f func(config interface{}, resolved map[Variable]string) (string, error)) Variable {
+
+	v, err := p.TryDynamicVariable(name, deps, f)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// TryDynamicVariable provides the same functionality as DynamicVariable, but it
+// returns an error instead of panicking if the name is invalid or already
+// defined in the package.  It may only be called during a Go package's
+// initialization.
+func (p *packageContext) TryDynamicVariable(name string, deps []Variable,
+	f func(config interface{}, resolved map[Variable]string) (string,
+		error)) (Variable, error) {
+
+	checkCalledFromInit()
+
+	err := validateNinjaName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &dynamicVariable{
+		pctx:   p,
+		name_:  name,
+		deps:   append([]Variable(nil), deps...),
+		value_: f,
+	}
+	err = p.addVariable(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// ResolvingVariableFunc returns a Variable whose value is determined by a
+// function that takes a config object and a resolve function as input, and
+// returns either the variable value or an error.  It may only be called during
+// a Go package's initialization - either from the init() function or as part
+// of a package-scoped variable's initialization.
+//
+// The resolve function returns the fully evaluated value of any Variable for
+// the config object, including one defined in another package, with the Ninja
+// variables it references expanded.  Unlike the deps of DynamicVariable, the
+// Variables to resolve can be chosen by f.  Resolving a rule argument returns
+// an error, as does a reference cycle between variables.
+//
+// This function is usually used to initialize a package-scoped Go variable that
+// represents a Ninja variable that will be output.  The name argument should
+// exactly match the Go variable name, and the value string returned by f may
+// reference other Ninja variables that are visible within the calling Go
+// package.
+func (p *packageContext) ResolvingVariableFunc(name string,
+	f func(config interface{}, resolve func(Variable) (string, error)) (string, error)) Variable {
+
+	v, err := p.TryResolvingVariableFunc(name, f)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// TryResolvingVariableFunc provides the same functionality as
+// ResolvingVariableFunc, but it returns an error instead of panicking if the
+// name is invalid or already defined in the package.  It may only be called
+// during a Go package's initialization.
+func (p *packageContext) TryResolvingVariableFunc(name string, f func(config interface{},
+	resolve func(Variable) (string, error)) (string, error)) (Variable, error) {
+
+	checkCalledFromInit()
+
+	err := validateNinjaName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &dynamicVariable{pctx: p, name_: name, resolvingValue: f}
+	err = p.addVariable(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func (v *dynamicVariable) packageContext() *packageContext {
+	return v.pctx
+}
+
+func (v *dynamicVariable) name() string {
+	return v.name_
+}
+
+func (v *dynamicVariable) fullName(pkgNames map[*packageContext]string) string {
+	return transformNinjaName(packageNamespacePrefix(pkgNames[v.pctx]) + v.name_)
+}
+
+func (v *dynamicVariable) value(config interface{}) (*ninjaString, error) {
+	return v.evalValue(config, []Variable{v})
+}
+
+// evalValue computes the variable's value for config.  The stack argument
+// lists the variables currently being evaluated, ending with v itself, and is
+// used to detect reference cycles.
+func (v *dynamicVariable) evalValue(config interface{},
+	stack []Variable) (*ninjaString, error) {
+
+	if ninjaStr, ok := v.pctx.overrideValue(v); ok {
+		return ninjaStr, nil
+	}
+
+	var value string
+	var err error
+	if v.resolvingValue != nil {
+		value, err = v.resolvingValue(config, func(dep Variable) (string, error) {
+			return resolveVariable(dep, config, stack)
+		})
+	} else {
+		resolved := make(map[Variable]string, len(v.deps))
+		for _, dep := range v.deps {
+			value, err := resolveVariable(dep, config, stack)
+			if err != nil {
+				return nil, err
+			}
+			resolved[dep] = value
+		}
+
+		value, err = v.value_(config, resolved)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ninjaStr, err := parseNinjaString(v.pctx.scope, value)
+	if err != nil {
+		err = fmt.Errorf("error parsing variable %s value: %s", v, err)
+		panic(err)
+	}
+
+	return ninjaStr, nil
+}
+
+func (v *dynamicVariable) String() string {
+	return v.pctx.pkgPath + "." + v.name_
+}
+
+// ResolveVariable evaluates v for config and expands all the Ninja variables
+// referenced by its value, transitively, for example to show the value of a
+// variable for a config without generating a Ninja file.  The Ninja escape
+// sequences, such as "$$", are unescaped, so the result is the value that
+// Ninja would pass to a command.  An error is returned if a variable cannot be
+// evaluated for config, if the references form a cycle, or if a rule argument
+// such as ${in} is referenced, since arguments only have values in build
+// statements.
+func ResolveVariable(v Variable, config interface{}) (string, error) {
+	value, err := resolveVariable(v, config, nil)
+	if err != nil {
+		return "", err
+	}
+	return unescaper.Replace(value), nil
+}
+
+// resolveVariable evaluates v for config and expands all the Ninja variables
+// referenced by its value, returning the resulting string, which keeps the
+// Ninja escape sequences of the literal parts.  The stack argument lists the
+// variables whose evaluation led to v and is used to detect reference cycles.
+func resolveVariable(v Variable, config interface{}, stack []Variable) (string,
+	error) {
+
+	for i, s := range stack {
+		if s == v {
+			var names []string
+			for _, c := range append(stack[i:], v) {
+				names = append(names, c.String())
+			}
+			return "", fmt.Errorf("detected variable reference cycle: %s",
+				strings.Join(names, " -> "))
+		}
+	}
+	stack = append(stack[:len(stack):len(stack)], v)
+
+	var ninjaStr *ninjaString
+	var err error
+	if dv, ok := v.(*dynamicVariable); ok {
+		ninjaStr, err = dv.evalValue(config, stack)
+	} else {
+		ninjaStr, err = v.value(config)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	str := ninjaStr.strings[0]
+	for i, ref := range ninjaStr.variables {
+		value, err := resolveVariable(ref, config, stack)
+		if err != nil {
+			return "", err
+		}
+		str += value + ninjaStr.strings[i+1]
+	}
+
+	return str, nil
+}
+
+// configCacheKey returns the key under which values computed from config can
+// be cached.  Config objects are opaque, so only pointers are cached, using the
+// identity of the pointer as the key.
+func configCacheKey(config interface{}) (key interface{}, ok bool) {
+	if config == nil || reflect.TypeOf(config).Kind() != reflect.Ptr {
+		return nil, false
+	}
+	return config, true
+}
+
+// clearConfigCaches drops all values cached by configCacheKey so that config
+// objects that are reused or modified between generations are re-evaluated.
+func clearConfigCaches() {
+	for _, pctx := range packageContexts {
+		for _, v := range pctx.scope.variables {
+			if vf, ok := v.(*variableFunc); ok {
+				clearCache(&vf.cache)
+			}
+		}
+		for _, r := range pctx.scope.rules {
+			if rf, ok := r.(*ruleFunc); ok {
+				clearCache(&rf.cache)
+			}
+		}
+	}
+}
+
+func clearCache(cache *sync.Map) {
+	cache.Range(func(key, value interface{}) bool {
+		cache.Delete(key)
+		return true
+	})
+}
+
+// checkCaseInsensitiveNames returns an error for each variable, rule, or pool
+// name of a package that differs only in case from another one, which may have
+// been defined before case-insensitive names were enabled.
+func checkCaseInsensitiveNames() []error {
+	var pkgPaths []string
+	for pkgPath := range packageContexts {
+		pkgPaths = append(pkgPaths, pkgPath)
+	}
+	sort.Strings(pkgPaths)
+
+	var errs []error
+	for _, pkgPath := range pkgPaths {
+		scope := packageContexts[pkgPath].scope
+
+		var collisions []string
+		check := func(kind, name string) {
+			other, ok := scope.foldedNames[foldedNameKey(kind, name)]
+			if ok && other != name {
+				collisions = append(collisions, kind+"\x00"+name+"\x00"+other)
+			}
+		}
+		for name := range scope.variables {
+			check("variable", name)
+		}
+		for name := range scope.rules {
+			check("rule", name)
+		}
+		for name := range scope.pools {
+			check("pool", name)
+		}
+		sort.Strings(collisions)
+
+		for _, collision := range collisions {
+			parts := strings.Split(collision, "\x00")
+			errs = append(errs, fmt.Errorf("package %q: %s", pkgPath,
+				&DuplicateNameError{Kind: parts[0], Name: parts[1], Existing: parts[2]}))
+		}
+	}
+
+	return errs
+}
+
+// checkPackageNamespaces returns an error for each variable, rule, or pool name
+// that is defined by more than one of the packages sharing a namespace, and for
+// each namespace that is the full Ninja name of a package outside of it.
+func checkPackageNamespaces() []error {
+	var pkgPaths []string
+	for pkgPath, pctx := range packageContexts {
+		if pctx.namespace != "" {
+			pkgPaths = append(pkgPaths, pkgPath)
+		}
+	}
+	if len(pkgPaths) == 0 {
+		return nil
+	}
+	sort.Strings(pkgPaths)
+
+	type definition struct {
+		namespace, kind, name string
+	}
+	definers := make(map[definition]string)
+
+	var errs []error
+
+	for _, pkgPath := range pkgPaths {
+		pctx := packageContexts[pkgPath]
+
+		if otherPkgPath, ok := packageNames[pctx.namespace]; ok &&
+			packageContexts[otherPkgPath].namespace != pctx.namespace {
+
+			errs = append(errs, fmt.Errorf("the Ninja namespace %q of package %q "+
+				"is the Ninja name of package %q", pctx.namespace, pkgPath,
+				otherPkgPath))
+		}
+
+		// Skip the entities re-exported from other packages.
+		var defs []definition
+		for name, v := range pctx.scope.variables {
+			if v.packageContext() == pctx {
+				defs = append(defs, definition{pctx.namespace, "variable", name})
+			}
+		}
+		for name, r := range pctx.scope.rules {
+			if r.packageContext() == pctx {
+				defs = append(defs, definition{pctx.namespace, "rule", name})
+			}
+		}
+		for name, p := range pctx.scope.pools {
+			if p.packageContext() == pctx {
+				defs = append(defs, definition{pctx.namespace, "pool", name})
+			}
+		}
+		sort.Slice(defs, func(i, j int) bool {
+			if defs[i].kind != defs[j].kind {
+				return defs[i].kind < defs[j].kind
+			}
+			return defs[i].name < defs[j].name
+		})
+
+		for _, def := range defs {
+			if otherPkgPath, ok := definers[def]; ok {
+				errs = append(errs, fmt.Errorf("packages %q and %q share the "+
+					"Ninja namespace %q and both define the %s %q", otherPkgPath,
+					pkgPath, def.namespace, def.kind, def.name))
+				continue
+			}
+			definers[def] = pkgPath
+		}
+	}
+
+	return errs
+}
+
+// checkStaticVariables returns an error for each static variable whose value,
+// or the value set for it by OverrideVariable, references an unknown variable.
+// It is used in strict variable resolution mode.
+func checkStaticVariables() []error {
+	pkgPaths := make([]string, 0, len(packageContexts))
+	for pkgPath := range packageContexts {
+		pkgPaths = append(pkgPaths, pkgPath)
+	}
+	sort.Strings(pkgPaths)
+
+	var errs []error
+	for _, pkgPath := range pkgPaths {
+		pctx := packageContexts[pkgPath]
+
+		var staticVars []*staticVariable
+		for _, v := range pctx.scope.variables {
+			// Skip the variables re-exported from other packages.
+			if sv, ok := v.(*staticVariable); ok && sv.pctx == pctx {
+				staticVars = append(staticVars, sv)
+			}
+		}
+		sort.Slice(staticVars, func(i, j int) bool {
+			return staticVars[i].name_ < staticVars[j].name_
+		})
+
+		for _, v := range staticVars {
+			_, err := parseNinjaString(pctx.scope, v.value_)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("error parsing variable %s value: %s",
+					v, err))
+			}
+		}
+
+		overridden := make([]Variable, 0, len(pctx.overrides))
+		for v := range pctx.overrides {
+			overridden = append(overridden, v)
+		}
+		sort.Slice(overridden, func(i, j int) bool {
+			return overridden[i].name() < overridden[j].name()
+		})
+
+		for _, v := range overridden {
+			_, err := parseNinjaString(pctx.scope, pctx.overrides[v].value_)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("error parsing override of variable %s: %s",
+					v, err))
+			}
+		}
+	}
+
+	return errs
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// validateVariableMethod returns an error if methodValue is not a method that
+// can be called with a config object followed by args, and that returns a
+// string, optionally followed by an error.  It returns args converted to the
+// values to pass to the method.
+func validateVariableMethod(name string, methodValue reflect.Value,
+	args []interface{}) ([]reflect.Value, error) {
+
+	methodType := methodValue.Type()
+	if methodType.Kind() != reflect.Func {
+		return nil, fmt.Errorf("method given for variable %s is not a function",
+			name)
+	}
+	if n, want := methodType.NumIn(), 1+len(args); n != want {
+		return nil, fmt.Errorf("method for variable %s has %d inputs (should be %d)",
+			name, n, want)
+	}
+	if n := methodType.NumOut(); n != 1 && n != 2 {
+		return nil, fmt.Errorf("method for variable %s has %d outputs "+
+			"(should be 1 or 2)", name, n)
+	}
+	if kind := methodType.Out(0).Kind(); kind != reflect.String {
+		return nil, fmt.Errorf("method for variable %s does not return a string",
+			name)
+	}
+	if methodType.NumOut() == 2 && methodType.Out(1) != errorType {
+		return nil, fmt.Errorf("method for variable %s does not return an error "+
+			"as its second output", name)
+	}
+
+	argValues := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		inType := methodType.In(i + 1)
+		argValue := reflect.ValueOf(arg)
+		if !argValue.IsValid() {
+			switch inType.Kind() {
+			case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map,
+				reflect.Ptr, reflect.Slice:
+				argValue = reflect.Zero(inType)
+			default:
+				return nil, fmt.Errorf("argument %d for variable %s is nil, which "+
+					"is not assignable to %s", i, name, inType)
+			}
+		} else if !argValue.Type().AssignableTo(inType) {
+			return nil, fmt.Errorf("argument %d for variable %s has type %s, which "+
+				"is not assignable to %s", i, name, argValue.Type(), inType)
+		}
+		argValues[i] = argValue
+	}
+
+	return argValues, nil
+}
+
+// callVariableMethod calls a method validated by validateVariableMethod on
+// config with the given arguments and returns its string result.  The errors
+// name the variable v.
+func callVariableMethod(v string, methodValue reflect.Value, config interface{},
+	argValues []reflect.Value) (string, error) {
+
+	recv, err := configReceiver(methodValue.Type().In(0), config)
+	if err != nil {
+		return "", fmt.Errorf("cannot evaluate variable %s: %s", v, err)
+	}
+	in := append([]reflect.Value{recv}, argValues...)
+	result := methodValue.Call(in)
+	if len(result) == 2 && !result[1].IsNil() {
+		return "", fmt.Errorf("error evaluating variable %s: %s", v,
+			result[1].Interface().(error))
+	}
+	return result[0].Interface().(string), nil
+}
+
+// configReceiver returns the value to pass as the receiver of type recvType of
+// a config method for config, which is dereferenced if the method has a value
+// receiver and config is a pointer to its type.
+func configReceiver(recvType reflect.Type, config interface{}) (reflect.Value,
+	error) {
+
+	configValue := reflect.ValueOf(config)
+	if !configValue.IsValid() {
+		switch recvType.Kind() {
+		case reflect.Interface, reflect.Ptr:
+			return reflect.Zero(recvType), nil
+		}
+		return reflect.Value{}, fmt.Errorf("the method takes a %s, but the "+
+			"config object is nil", recvType)
+	}
+
+	configType := configValue.Type()
+	switch {
+	case configType.AssignableTo(recvType):
+		return configValue, nil
+	case configType.Kind() == reflect.Ptr && configType.Elem().AssignableTo(recvType):
+		if configValue.IsNil() {
+			return reflect.Value{}, fmt.Errorf("the method takes a %s, but the "+
+				"config object is a nil %s", recvType, configType)
+		}
+		return configValue.Elem(), nil
+	case recvType.Kind() == reflect.Ptr && configType.AssignableTo(recvType.Elem()):
+		return reflect.Value{}, fmt.Errorf("the method has a pointer receiver "+
+			"and takes a %s, but the config object is a %s value, pass a "+
+			"pointer to the config object instead", recvType, configType)
+	}
+
+	return reflect.Value{}, fmt.Errorf("the method takes a %s, but the config "+
+		"object is a %s", recvType, configType)
+}
+
+// An argVariable is a Variable that exists only when it is set by a build
+// statement to pass a value to the rule being invoked.  It has no value, so it
+// can never be used to create a Ninja assignment statement.  It is inserted
+// into the rule's scope, which is used for name lookups within the rule and
+// when assigning argument values as part of a build statement.
+type argVariable struct {
+	name_ string
+}
+
+func (v *argVariable) packageContext() *packageContext {
+	panic("this should not be called")
+}
+
+func (v *argVariable) name() string {
+	return v.name_
+}
+
+func (v *argVariable) fullName(pkgNames map[*packageContext]string) string {
+	return v.name_
+}
+
+func (v *argVariable) value(config interface{}) (*ninjaString, error) {
+	return nil, errVariableIsArg
+}
+
+func (v *argVariable) String() string {
+	return "<arg>:" + v.name_
+}
+
+type staticPool struct {
+	pctx   *packageContext
+	name_  string
+	params PoolParams
+}
+
+// StaticPool returns a Pool whose value does not depend on any configuration
+// information.  It may only be called during a Go package's initialization -
+// either from the init() function or as part of a package-scoped Go variable's
+// initialization.
+//
+// This function is usually used to initialize a package-scoped Go variable that
+// represents a Ninja pool that will be output.  The name argument should
+// exactly match the Go variable name, and the params fields may reference other
+// Ninja variables that are visible within the calling Go package.  The names of
+// the built-in pools, such as "console", are reserved, and the depth must be at
+// least 1.
+func (p *packageContext) StaticPool(name string, params PoolParams) Pool {
+	pool, err := p.TryStaticPool(name, params)
+	if err != nil {
+		panic(err)
+	}
+	return pool
+}
+
+// TryStaticPool provides the same functionality as StaticPool, but it returns
+// an error instead of panicking if the pool is invalid.  An invalid or reserved
+// name results in an *InvalidNameError, and a name that is already defined in
+// the package results in a *DuplicateNameError.  It may only be called during
+// a Go package's initialization.
+func (p *packageContext) TryStaticPool(name string, params PoolParams) (Pool, error) {
+	checkCalledFromInit()
+	return p.addStaticPool(name, params)
+}
+
+// addStaticPool validates the pool and adds it to the package's scope.
+func (p *packageContext) addStaticPool(name string, params PoolParams) (Pool, error) {
+	err := validatePoolName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validatePoolDepth(params.Depth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pool %s: %s", name, err)
+	}
+
+	pool := &staticPool{p, name, params}
+	err = p.addPool(pool)
+	if err != nil {
+		return nil, err
+	}
+
+	return pool, nil
+}
+
+func (p *staticPool) packageContext() *packageContext {
+	return p.pctx
+}
+
+func (p *staticPool) name() string {
+	return p.name_
+}
+
+func (p *staticPool) fullName(pkgNames map[*packageContext]string) string {
+	return transformNinjaName(packageNamespacePrefix(pkgNames[p.pctx]) + p.name_)
+}
+
+func (p *staticPool) def(config interface{}) (*poolDef, error) {
+	def, err := parsePoolParams(p.pctx.scope, &p.params)
+	if err != nil {
+		panic(fmt.Errorf("error parsing PoolParams for %s: %s", p, err))
+	}
+	return def, nil
+}
+
+func (p *staticPool) String() string {
+	return p.pctx.pkgPath + "." + p.name_
+}
+
+type poolFunc struct {
+	pctx       *packageContext
+	name_      string
+	paramsFunc func(interface{}) (PoolParams, error)
+}
+
+// PoolFunc returns a Pool whose value is determined by a function that takes a
+// config object as input and returns either the pool parameters or an error. It
+// may only be called during a Go package's initialization - either from the
+// init() function or as part of a package-scoped variable's initialization.
+//
+// This function is usually used to initialize a package-scoped Go variable that
+// represents a Ninja pool that will be output.  The name argument should
+// exactly match the Go variable name, and the string fields of the PoolParams
+// returned by f may reference other Ninja variables that are visible within the
+// calling Go package.  The names of the built-in pools are reserved.  The depth
+// returned by f is checked when the pool is used, and a depth less than 1 is
+// reported as an error.
+func (p *packageContext) PoolFunc(name string, f func(interface{}) (PoolParams,
+	error)) Pool {
+
+	pool, err := p.TryPoolFunc(name, f)
+	if err != nil {
+		panic(err)
+	}
+	return pool
+}
+
+// TryPoolFunc provides the same functionality as PoolFunc, but it returns an
+// error instead of panicking if the name is invalid, reserved, or already
+// defined in the package.  It may only be called during a Go package's
+// initialization.
+func (p *packageContext) TryPoolFunc(name string, f func(interface{}) (PoolParams,
+	error)) (Pool, error) {
+
+	checkCalledFromInit()
+
+	err := validatePoolName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := &poolFunc{p, name, f}
+	err = p.addPool(pool)
+	if err != nil {
+		return nil, err
+	}
+
+	return pool, nil
+}
+
+// CPUScaledPool returns a Pool whose depth is the given fraction of the number
+// of CPUs available when the Ninja file is generated, rounded to the nearest
+// integer but at least 1.  The fraction must be greater than 0 and at most 1.
+// It may only be called during a Go package's initialization - either from the
+// init() function or as part of a package-scoped variable's initialization.
+func (p *packageContext) CPUScaledPool(name string, fraction float64) Pool {
+	pool, err := p.TryCPUScaledPool(name, fraction)
+	if err != nil {
+		panic(err)
+	}
+	return pool
+}
+
+// TryCPUScaledPool provides the same functionality as CPUScaledPool, but it
+// returns an error instead of panicking if the name or the fraction is
+// invalid.  It may only be called during a Go package's initialization.
+func (p *packageContext) TryCPUScaledPool(name string,
+	fraction float64) (Pool, error) {
+
+	checkCalledFromInit()
+
+	if !(fraction > 0 && fraction <= 1) {
+		return nil, fmt.Errorf("fraction %v for pool %q is not in the range (0, 1]",
+			fraction, name)
+	}
+
+	return p.TryPoolFunc(name, func(interface{}) (PoolParams, error) {
+		depth := int(math.Round(float64(runtime.NumCPU()) * fraction))
+		if depth < 1 {
+			depth = 1
+		}
+		return PoolParams{Depth: depth}, nil
+	})
+}
+
+func (p *poolFunc) packageContext() *packageContext {
+	return p.pctx
+}
+
+func (p *poolFunc) name() string {
+	return p.name_
+}
+
+func (p *poolFunc) fullName(pkgNames map[*packageContext]string) string {
+	return transformNinjaName(packageNamespacePrefix(pkgNames[p.pctx]) + p.name_)
+}
+
+func (p *poolFunc) def(config interface{}) (*poolDef, error) {
+	params, err := p.paramsFunc(config)
+	if err != nil {
+		return nil, err
+	}
+	def, err := parsePoolParams(p.pctx.scope, &params)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing PoolParams for %s: %s", p, err)
+	}
+	return def, nil
+}
+
+func (p *poolFunc) String() string {
+	return p.pctx.pkgPath + "." + p.name_
+}
+
+type compositePool struct {
+	pctx     *packageContext
+	name_    string
+	children []Pool
+}
+
+// CompositePool returns a Pool whose depth is the sum of the depths of the
+// children pools, evaluated for the config object when the Ninja file is
+// generated, so that the total number of jobs of a group of rules can be
+// budgeted while each rule keeps its own pool.  It may only be called during a
+// Go package's initialization - either from the init() function or as part of
+// a package-scoped variable's initialization.
+//
+// The children must be visible within the calling Go package.  They may be
+// composite pools themselves, but not built-in pools such as Console, which
+// have no depth of their own.  The children's definitions are only written to
+// the Ninja file if they are used.
+func (p *packageContext) CompositePool(name string, children ...Pool) Pool {
+	pool, err := p.TryCompositePool(name, children...)
+	if err != nil {
+		panic(err)
+	}
+	return pool
+}
+
+// TryCompositePool provides the same functionality as CompositePool, but it
+// returns an error instead of panicking if the name or one of the children is
+// invalid.  It may only be called during a Go package's initialization.
+func (p *packageContext) TryCompositePool(name string,
+	children ...Pool) (Pool, error) {
+
+	checkCalledFromInit()
+
+	err := validatePoolName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(children) == 0 {
+		return nil, fmt.Errorf("composite pool %q has no children", name)
+	}
+	for i, child := range children {
+		if child == nil {
+			return nil, fmt.Errorf("child %d of composite pool %q is nil", i, name)
+		}
+		if _, ok := child.(*builtinPool); ok {
+			return nil, fmt.Errorf("child %s of composite pool %q is a built-in pool",
+				child, name)
+		}
+	}
+
+	pool := &compositePool{
+		pctx:     p,
+		name_:    name,
+		children: append([]Pool(nil), children...),
+	}
+	err = p.addPool(pool)
+	if err != nil {
+		return nil, err
+	}
+
+	return pool, nil
+}
+
+func (p *compositePool) packageContext() *packageContext {
+	return p.pctx
+}
+
+func (p *compositePool) name() string {
+	return p.name_
+}
+
+func (p *compositePool) fullName(pkgNames map[*packageContext]string) string {
+	return transformNinjaName(packageNamespacePrefix(pkgNames[p.pctx]) + p.name_)
+}
+
+// def returns the sum of the depths of the children of p.  The children exist
+// before p is created and cannot be changed afterwards, so composite pools
+// cannot form a cycle.
+func (p *compositePool) def(config interface{}) (*poolDef, error) {
+	depth := 0
+	for _, child := range p.children {
+		if !p.pctx.scope.IsPoolVisible(child) {
+			return nil, fmt.Errorf("child of composite pool %s: %s", p,
+				poolNotVisibleError(child))
+		}
+
+		def, err := child.def(config)
+		if err != nil {
+			return nil, err
+		}
+		depth += def.Depth
+	}
+
+	return &poolDef{Depth: depth}, nil
+}
+
+func (p *compositePool) String() string {
+	return p.pctx.pkgPath + "." + p.name_
+}
+
+type builtinPool struct {
+	name_ string
+}
+
+func (p *builtinPool) packageContext() *packageContext {
+	return nil
+}
+
+func (p *builtinPool) name() string {
+	return p.name_
+}
+
+func (p *builtinPool) fullName(pkgNames map[*packageContext]string) string {
+	return p.name_
+}
+
+func (p *builtinPool) def(config interface{}) (*poolDef, error) {
+	return nil, errPoolIsBuiltin
+}
+
+// NewBuiltinPool returns a Pool object that refers to a pool name created outside of Blueprint
+func NewBuiltinPool(name string) Pool {
+	return &builtinPool{
+		name_: name,
+	}
+}
+
+func (p *builtinPool) String() string {
+	return "<builtin>:" + p.name_
+}
+
+// newReservedBuiltinPool returns a built-in pool and reserves its name.
+func newReservedBuiltinPool(name string) Pool {
+	reservedPoolNames[name] = true
+	return NewBuiltinPool(name)
+}
+
+// validatePoolName checks that name is a valid Ninja name that is not reserved
+// for a built-in pool.
+func validatePoolName(name string) error {
+	err := validateNinjaName(name)
+	if err != nil {
+		return err
+	}
+
+	if reservedPoolNames[name] {
+		return &InvalidNameError{name, fmt.Errorf("pool name %q is reserved "+
+			"for a built-in pool", name)}
+	}
+
+	return nil
+}
+
+type staticRule struct {
+	pctx        *packageContext
+	name_       string
+	params      RuleParams
+	argNames    map[string]bool
+	argDefaults map[string]string // set by "name=default" argNames
+	scope_      *basicScope
+	sync.Mutex  // protects scope_ during lazy creation
+
+	segments []RuleSegment // set by SegmentedRule
+}
+
+// StaticRule returns a Rule whose value does not depend on any configuration
+// information.  It may only be called during a Go package's initialization -
+// either from the init() function or as part of a package-scoped Go variable's
+// initialization.
+//
+// This function is usually used to initialize a package-scoped Go variable that
+// represents a Ninja rule that will be output.  The name argument should
+// exactly match the Go variable name, and the params fields may reference other
+// Ninja variables that are visible within the calling Go package.
+//
+// The argNames arguments list Ninja variables that may be overridden by Ninja
+// build statements that invoke the rule.  These arguments may be referenced in
+// any of the string fields of params.  Arguments can shadow package-scoped
+// variables defined within the caller's Go package, but they may not shadow
+// those defined in another package.  Shadowing a package-scoped variable
+// results in the package-scoped variable's value being used for build
+// statements that do not override the argument.  For argument names that do not
+// shadow package-scoped variables the default value is an empty string.
+//
+// An argNames entry of the form "name=value" declares an argument whose default
+// value is set by every build statement that does not set the argument.  The
+// value may reference the package-scoped variables visible within the calling
+// Go package, including the one the argument shadows, but not the arguments.
+//
+// The string fields of params are written to the Ninja file on a single line
+// each: a newline becomes a line continuation, which Ninja reads as a space.
+// The lines of a multi-line Command are thus run as one shell command, and
+// need a ';' or "&&" between them.
+func (p *packageContext) StaticRule(name string, params RuleParams,
+	argNames ...string) Rule {
+
+	r, err := p.TryStaticRule(name, params, argNames...)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// TryStaticRule provides the same functionality as StaticRule, but it returns
+// an error instead of panicking if the rule is invalid.  An invalid or reserved
+// name results in an *InvalidNameError, and a name that is already defined in
+// the package results in a *DuplicateNameError.  It may only be called during
+// a Go package's initialization.
+func (p *packageContext) TryStaticRule(name string, params RuleParams,
+	argNames ...string) (Rule, error) {
+
+	checkCalledFromInit()
+	return p.addStaticRule(name, params, argNames)
+}
+
+// addStaticRule validates the rule and adds it to the package's scope.
+func (p *packageContext) addStaticRule(name string, params RuleParams,
+	argNames []string) (Rule, error) {
+
+	err := validateNinjaName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	argNames, argDefaults, err := parseArgNames(argNames)
+	if err != nil {
+		return nil, fmt.Errorf("invalid argument: %s", err)
+	}
+
+	err = validateRuleDepsParams(&params)
+	if err == nil {
+		err = validatePassthroughEnv(&params)
+	}
+	if err == nil {
+		err = validateOutputExtension(&params)
+	}
+	if err == nil {
+		err = validateAlwaysRun(&params)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid RuleParams for rule %q: %s", name, err)
+	}
+
+	argNamesSet := make(map[string]bool)
+	for _, argName := range argNames {
+		argNamesSet[argName] = true
+	}
+
+	ruleScope := (*basicScope)(nil) // This will get created lazily
+
+	r := &staticRule{
+		pctx:        p,
+		name_:       name,
+		params:      params,
+		argNames:    argNamesSet,
+		argDefaults: argDefaults,
+		scope_:      ruleScope,
+	}
+	err = p.addRule(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *staticRule) packageContext() *packageContext {
+	return r.pctx
+}
+
+func (r *staticRule) name() string {
+	return r.name_
+}
+
+func (r *staticRule) fullName(pkgNames map[*packageContext]string) string {
+	return transformNinjaName(packageNamespacePrefix(pkgNames[r.pctx]) + r.name_)
+}
+
+func (r *staticRule) def(interface{}) (*ruleDef, error) {
+	def, err := parseRuleParams(r.scope(), &r.params)
+	if err != nil {
+		panic(fmt.Errorf("error parsing RuleParams for %s: %s", r, err))
+	}
+	if def.Pool == nil && !r.params.Generator {
+		def.Pool = r.pctx.defaultPool
+	}
+
+	def.ArgDefaults, err = parseArgDefaults(r.pctx.scope, r.scope(), r.argDefaults)
+	if err != nil {
+		return nil, fmt.Errorf("invalid arguments for rule %s: %s", r, err)
+	}
+
+	return def, nil
+}
+
+func (r *staticRule) scope() *basicScope {
+	// We lazily create the scope so that all the package-scoped variables get
+	// declared before the args are created.  Otherwise we could incorrectly
+	// shadow a package-scoped variable with an arg variable.
+	r.Lock()
+	defer r.Unlock()
+
+	if r.scope_ == nil {
+		r.scope_ = makeRuleScope(r.pctx.scope, r.argNames)
+	}
+	return r.scope_
+}
+
+func (r *staticRule) isArg(argName string) bool {
+	return r.argNames[argName]
+}
+
+func (r *staticRule) String() string {
+	return r.pctx.pkgPath + "." + r.name_
+}
+
+type ruleFunc struct {
+	pctx        *packageContext
+	name_       string
+	paramsFunc  func(interface{}) (RuleParams, error)
+	argNames    map[string]bool
+	argDefaults map[string]string // set by "name=default" argNames
+	scope_      *basicScope
+	sync.Mutex  // protects scope_ during lazy creation
+
+	cache sync.Map // parsed defs by config object, see configCacheKey
+}
+
+// RuleFunc returns a Rule whose value is determined by a function that takes a
+// config object as input and returns either the rule parameters or an error. It
+// may only be called during a Go package's initialization - either from the
+// init() function or as part of a package-scoped variable's initialization.
+//
+// This function is usually used to initialize a package-scoped Go variable that
+// represents a Ninja rule that will be output.  The name argument should
+// exactly match the Go variable name, and the string fields of the RuleParams
+// returned by f may reference other Ninja variables that are visible within the
+// calling Go package.  If the config object is a pointer the rule's definition is cached,
+// so f is called at most once per config object until the next call to
+// Context.ResolveDependencies.
+//
+// The argNames arguments list Ninja variables that may be overridden by Ninja
+// build statements that invoke the rule.  These arguments may be referenced in
+// any of the string fields of the RuleParams returned by f.  Arguments can
+// shadow package-scoped variables defined within the caller's Go package, but
+// they may not shadow those defined in another package.  Shadowing a package-
+// scoped variable results in the package-scoped variable's value being used for
+// build statements that do not override the argument.  For argument names that
+// do not shadow package-scoped variables the default value is an empty string.
+// Arguments may be given default values as described for StaticRule.
+func (p *packageContext) RuleFunc(name string, f func(interface{}) (RuleParams,
+	error), argNames ...string) Rule {
+
+	r, err := p.TryRuleFunc(name, f, argNames...)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// TryRuleFunc provides the same functionality as RuleFunc, but it returns an
+// error instead of panicking if the name or one of the argument names is
+// invalid.  It may only be called during a Go package's initialization.
+func (p *packageContext) TryRuleFunc(name string, f func(interface{}) (RuleParams,
+	error), argNames ...string) (Rule, error) {
+
+	checkCalledFromInit()
+
+	err := validateNinjaName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	argNames, argDefaults, err := parseArgNames(argNames)
+	if err != nil {
+		return nil, fmt.Errorf("invalid argument: %s", err)
+	}
+
+	argNamesSet := make(map[string]bool)
+	for _, argName := range argNames {
+		argNamesSet[argName] = true
+	}
+
+	ruleScope := (*basicScope)(nil) // This will get created lazily
+
+	rule := &ruleFunc{
+		pctx:        p,
+		name_:       name,
+		paramsFunc:  f,
+		argNames:    argNamesSet,
+		argDefaults: argDefaults,
+		scope_:      ruleScope,
+	}
+	err = p.addRule(rule)
+	if err != nil {
+		return nil, err
+	}
+
+	return rule, nil
+}
+
+// BaseCommand is replaced by the base rule's Command in the Command of the
+// RuleParams passed to DerivedRule.
+const BaseCommand = "{{base}}"
+
+// DerivedRule returns a Rule whose params are those of base, a rule created by
+// StaticRule or RuleFunc in the same package, with the non-zero fields of
+// override applied.  It may only be called during a Go package's
+// initialization - either from the init() function or as part of a
+// package-scoped variable's initialization.
+//
+// The string, bool, Pool, Deps and RspfileThreshold fields of override replace
+// those of base, with any BaseCommand in override.Command replaced by the Command
+// of base.  The CommandDeps and CommandOrderOnly lists of override are appended
+// to those of base, and so are the PassthroughEnv names that base does not
+// list.  The derived rule accepts the arguments of base, with their
+// default values, in addition to argNames, which may also set new default
+// values for the arguments of base.  If base was created by RuleFunc the derived rule's params are
+// computed from the params returned for each config.
+func (p *packageContext) DerivedRule(name string, base Rule, override RuleParams,
+	argNames ...string) Rule {
+
+	r, err := p.TryDerivedRule(name, base, override, argNames...)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// TryDerivedRule provides the same functionality as DerivedRule, but it returns
+// an error instead of panicking if the base rule cannot be derived from or the
+// derived rule is invalid.  It may only be called during a Go package's
+// initialization.
+func (p *packageContext) TryDerivedRule(name string, base Rule, override RuleParams,
+	argNames ...string) (Rule, error) {
+
+	checkCalledFromInit()
+
+	if base.packageContext() != p {
+		return nil, fmt.Errorf("cannot derive rule %q from %s: the base rule must be "+
+			"defined in the same package", name, base)
+	}
+
+	switch base := base.(type) {
+	case *staticRule:
+		return p.TryStaticRule(name, mergeRuleParams(base.params, override),
+			appendArgNames(base.argNames, base.argDefaults, argNames)...)
+	case *ruleFunc:
+		return p.TryRuleFunc(name, func(config interface{}) (RuleParams, error) {
+			params, err := base.paramsFunc(config)
+			if err != nil {
+				return params, err
+			}
+			return mergeRuleParams(params, override), nil
+		}, appendArgNames(base.argNames, base.argDefaults, argNames)...)
+	default:
+		return nil, fmt.Errorf("cannot derive rule %q from %s: only rules created by "+
+			"StaticRule or RuleFunc have params", name, base)
+	}
+}
+
+// SegmentedRule returns a Rule like StaticRule whose command is the commands
+// of segments joined with spaces, in order, and whose other fields are set by
+// params, which must not set a Command.  It may only be called during a Go
+// package's initialization - either from the init() function or as part of a
+// package-scoped Go variable's initialization.
+//
+// Each segment is checked on its own when the rule is created, and an error
+// names the segment.  The segment names must be valid Ninja names and must be
+// distinct.  The segments with an empty command are skipped.  The rule keeps
+// the segments, see RuleSegments.  The argNames arguments are the same as
+// those of StaticRule.
+func (p *packageContext) SegmentedRule(name string, params RuleParams,
+	segments []RuleSegment, argNames ...string) Rule {
+
+	r, err := p.TrySegmentedRule(name, params, segments, argNames...)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// TrySegmentedRule provides the same functionality as SegmentedRule, but it
+// returns an error instead of panicking if one of the segments or the rule is
+// invalid.  It may only be called during a Go package's initialization.
+func (p *packageContext) TrySegmentedRule(name string, params RuleParams,
+	segments []RuleSegment, argNames ...string) (Rule, error) {
+
+	checkCalledFromInit()
+
+	if params.Command != "" {
+		return nil, fmt.Errorf("rule %q sets both a Command and segments", name)
+	}
+
+	seen := make(map[string]bool, len(segments))
+	var commands []string
+	for _, segment := range segments {
+		err := validateNinjaName(segment.Name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid segment name for rule %q: %s", name, err)
+		}
+		if seen[segment.Name] {
+			return nil, fmt.Errorf("rule %q has more than one segment named %q", name,
+				segment.Name)
+		}
+		seen[segment.Name] = true
+
+		if segment.Command == "" {
+			continue
+		}
+		err = validateNinjaStringSyntax(segment.Command)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing segment %q of rule %q: %s",
+				segment.Name, name, err)
+		}
+		commands = append(commands, segment.Command)
+	}
+	if len(commands) == 0 {
+		return nil, fmt.Errorf("rule %q has no segments with a command", name)
+	}
+
+	params.Command = strings.Join(commands, " ")
+	r, err := p.TryStaticRule(name, params, argNames...)
+	if err != nil {
+		return nil, err
+	}
+	r.(*staticRule).segments = append([]RuleSegment(nil), segments...)
+	return r, nil
+}
+
+// RuleSegments returns the segments of a rule created by SegmentedRule, or nil
+// for the other rules.
+func RuleSegments(r Rule) []RuleSegment {
+	if r, ok := r.(*staticRule); ok && r.segments != nil {
+		return append([]RuleSegment(nil), r.segments...)
+	}
+	return nil
+}
+
+// mergeRuleParams returns base with the non-zero fields of override applied as
+// described by DerivedRule.
+func mergeRuleParams(base, override RuleParams) RuleParams {
+	params := base
+
+	if override.Command != "" {
+		params.Command = strings.Replace(override.Command, BaseCommand, base.Command, -1)
+	}
+	if override.Depfile != "" {
+		params.Depfile = override.Depfile
+	}
+	if override.Deps != DepsNone {
+		params.Deps = override.Deps
+	}
+	if override.Description != "" {
+		params.Description = override.Description
+	}
+	if override.Generator {
+		params.Generator = true
+	}
+	if override.Pool != nil {
+		params.Pool = override.Pool
+	}
+	if override.Restat {
+		params.Restat = true
+	}
+	if override.Rspfile != "" {
+		params.Rspfile = override.Rspfile
+	}
+	if override.RspfileContent != "" {
+		params.RspfileContent = override.RspfileContent
+	}
+	if override.RspfileThreshold != 0 {
+		params.RspfileThreshold = override.RspfileThreshold
+	}
+	if override.Comment != "" {
+		params.Comment = override.Comment
 	}
-
-	err = validateArgNames(argNames)
-	if err != nil {
-		panic(fmt.Errorf("invalid argument name: %s", err))
+	if override.OutputExtension != "" {
+		params.OutputExtension = override.OutputExtension
+	}
+	if override.AlwaysRun {
+		params.AlwaysRun = true
 	}
 
-	argNamesSet := make(map[string]bool)
-	for _, argName := range argNames {
-		argNamesSet[argName] = true
+	params.CommandDeps = append(append([]string(nil), base.CommandDeps...),
+		override.CommandDeps...)
+	params.CommandOrderOnly = append(append([]string(nil), base.CommandOrderOnly...),
+		override.CommandOrderOnly...)
+
+	params.PassthroughEnv = append([]string(nil), base.PassthroughEnv...)
+	for _, name := range override.PassthroughEnv {
+		found := false
+		for _, baseName := range base.PassthroughEnv {
+			if name == baseName {
+				found = true
+				break
+			}
+		}
+		if !found {
+			params.PassthroughEnv = append(params.PassthroughEnv, name)
+		}
 	}
 
-	ruleScope := (*basicScope)(nil) // This will get created lazily
+	return params
+}
 
-	r := &staticRule{
-		pctx:     p,
-		name_:    name,
-		params:   params,
-		argNames: argNamesSet,
-		scope_:   ruleScope,
+// appendArgNames returns the sorted names in argNamesSet, with the default
+// values in argDefaults, followed by the argNames that are not in it.  An
+// argName that sets a default replaces the default of the same base argument.
+func appendArgNames(argNamesSet map[string]bool, argDefaults map[string]string,
+	argNames []string) []string {
+
+	overridden := make(map[string]bool)
+	for _, argName := range argNames {
+		if i := strings.IndexByte(argName, '='); i >= 0 {
+			overridden[argName[:i]] = true
+		}
 	}
-	err = p.scope.AddRule(r)
-	if err != nil {
-		panic(err)
+
+	var ret []string
+	for argName := range argNamesSet {
+		if overridden[argName] {
+			continue
+		}
+		if value, ok := argDefaults[argName]; ok {
+			argName += "=" + value
+		}
+		ret = append(ret, argName)
 	}
+	sort.Strings(ret)
 
-	return r
+	for _, argName := range argNames {
+		name := argName
+		if i := strings.IndexByte(argName, '='); i >= 0 {
+			name = argName[:i]
+		}
+		if !argNamesSet[name] || overridden[name] {
+			ret = append(ret, argName)
+		}
+	}
+	return ret
 }
 
-func (r *staticRule) packageContext() *packageContext {
-	return r.pctx
-}
+// ruleArgChecks contains the checks registered by SetArgValidator, RequireArgs,
+// and ExclusiveArgs for each rule.
+var ruleArgChecks = map[Rule]*argChecks{}
 
-func (r *staticRule) name() string {
-	return r.name_
+type argChecks struct {
+	required   map[string]bool
+	validators map[string][]func(value string) error
+	exclusive  [][]string // Groups of arguments of which at most one may be set.
 }
 
-func (r *staticRule) fullName(pkgNames map[*packageContext]string) string {
-	return packageNamespacePrefix(pkgNames[r.pctx]) + r.name_
-}
+// argChecksFor returns the checks of the argument argName of r, which are
+// created if needed.  It panics if r has no argument argName.
+func argChecksFor(r Rule, argName string) *argChecks {
+	if !r.isArg(argName) {
+		panic(fmt.Errorf("rule %s has no argument %q", r, argName))
+	}
 
-func (r *staticRule) def(interface{}) (*ruleDef, error) {
-	def, err := parseRuleParams(r.scope(), &r.params)
-	if err != nil {
-		panic(fmt.Errorf("error parsing RuleParams for %s: %s", r, err))
+	checks := ruleArgChecks[r]
+	if checks == nil {
+		checks = &argChecks{
+			required:   make(map[string]bool),
+			validators: make(map[string][]func(string) error),
+		}
+		ruleArgChecks[r] = checks
 	}
-	return def, nil
+	return checks
 }
 
-func (r *staticRule) scope() *basicScope {
-	// We lazily create the scope so that all the package-scoped variables get
-	// declared before the args are created.  Otherwise we could incorrectly
-	// shadow a package-scoped variable with an arg variable.
-	r.Lock()
-	defer r.Unlock()
+// SetArgValidator registers a function that checks the value of the argument
+// argName of r in every build statement that sets it, for example to reject an
+// empty value or one that doesn't match a pattern.  The value is checked as it
+// is written in BuildParams.Args, with the Ninja variables it references left
+// unexpanded, and an error returned by validator fails the build statement.
+// Several validators may be registered for the same argument.  It may only be
+// called during a Go package's initialization.
+//
+// The arguments of a rule created by SelectRule are checked against the
+// validators of that rule, not those of the selected rule.
+func SetArgValidator(r Rule, argName string, validator func(value string) error) {
+	checkCalledFromInit()
 
-	if r.scope_ == nil {
-		r.scope_ = makeRuleScope(r.pctx.scope, r.argNames)
+	if validator == nil {
+		panic(fmt.Errorf("nil validator for argument %q of rule %s", argName, r))
 	}
-	return r.scope_
-}
 
-func (r *staticRule) isArg(argName string) bool {
-	return r.argNames[argName]
+	checks := argChecksFor(r, argName)
+	checks.validators[argName] = append(checks.validators[argName], validator)
 }
 
-func (r *staticRule) String() string {
-	return r.pctx.pkgPath + "." + r.name_
-}
+// RequireArgs makes the arguments argNames of r required, so that a build
+// statement that invokes r without setting them fails.  An argument with a
+// default value cannot be required.  It may only be called during a Go
+// package's initialization.
+func RequireArgs(r Rule, argNames ...string) {
+	checkCalledFromInit()
 
-type ruleFunc struct {
-	pctx       *packageContext
-	name_      string
-	paramsFunc func(interface{}) (RuleParams, error)
-	argNames   map[string]bool
-	scope_     *basicScope
-	sync.Mutex // protects scope_ during lazy creation
+	argDefaults := ruleArgDefaults(r)
+	for _, argName := range argNames {
+		if _, ok := argDefaults[argName]; ok {
+			panic(fmt.Errorf("argument %q of rule %s has a default value and "+
+				"cannot be required", argName, r))
+		}
+		argChecksFor(r, argName).required[argName] = true
+	}
 }
 
-// RuleFunc returns a Rule whose value is determined by a function that takes a
-// config object as input and returns either the rule parameters or an error. It
-// may only be called during a Go package's initialization - either from the
-// init() function or as part of a package-scoped variable's initialization.
-//
-// This function is usually used to initialize a package-scoped Go variable that
-// represents a Ninja rule that will be output.  The name argument should
-// exactly match the Go variable name, and the string fields of the RuleParams
-// returned by f may reference other Ninja variables that are visible within the
-// calling Go package.
-//
-// The argNames arguments list Ninja variables that may be overridden by Ninja
-// build statements that invoke the rule.  These arguments may be referenced in
-// any of the string fields of the RuleParams returned by f.  Arguments can
-// shadow package-scoped variables defined within the caller's Go package, but
-// they may not shadow those defined in another package.  Shadowing a package-
-// scoped variable results in the package-scoped variable's value being used for
-// build statements that do not override the argument.  For argument names that
-// do not shadow package-scoped variables the default value is an empty string.
-func (p *packageContext) RuleFunc(name string, f func(interface{}) (RuleParams,
-	error), argNames ...string) Rule {
-
+// ExclusiveArgs makes the arguments argNames of r mutually exclusive, so that a
+// build statement that invokes r and sets more than one of them fails, for
+// example for arguments selecting a static or a shared link.  It may be called
+// several times for the same rule to add several groups of exclusive
+// arguments.  A group must have at least two distinct arguments, none of which
+// has a default value.  It may only be called during a Go package's
+// initialization.
+func ExclusiveArgs(r Rule, argNames ...string) {
 	checkCalledFromInit()
 
-	err := validateNinjaName(name)
-	if err != nil {
-		panic(err)
+	if len(argNames) < 2 {
+		panic(fmt.Errorf("exclusive arguments of rule %s must have at least "+
+			"two arguments, got %q", r, argNames))
 	}
 
-	err = validateArgNames(argNames)
-	if err != nil {
-		panic(fmt.Errorf("invalid argument name: %s", err))
+	argDefaults := ruleArgDefaults(r)
+	seen := make(map[string]bool, len(argNames))
+	var checks *argChecks
+	for _, argName := range argNames {
+		if seen[argName] {
+			panic(fmt.Errorf("exclusive arguments of rule %s list %q more than "+
+				"once", r, argName))
+		}
+		seen[argName] = true
+		if _, ok := argDefaults[argName]; ok {
+			panic(fmt.Errorf("argument %q of rule %s has a default value and "+
+				"cannot be exclusive", argName, r))
+		}
+		checks = argChecksFor(r, argName)
 	}
 
-	argNamesSet := make(map[string]bool)
-	for _, argName := range argNames {
-		argNamesSet[argName] = true
+	checks.exclusive = append(checks.exclusive, append([]string(nil), argNames...))
+}
+
+// ruleArgDefaults returns the default values of the arguments of r.
+func ruleArgDefaults(r Rule) map[string]string {
+	switch r := r.(type) {
+	case *staticRule:
+		return r.argDefaults
+	case *ruleFunc:
+		return r.argDefaults
 	}
+	return nil
+}
 
-	ruleScope := (*basicScope)(nil) // This will get created lazily
+// checkRuleArgs returns an error if args, the arguments set by a build
+// statement that invokes r, don't pass the checks registered for r.
+func checkRuleArgs(r Rule, args map[string]string) error {
+	checks := ruleArgChecks[r]
+	if checks == nil {
+		return nil
+	}
 
-	rule := &ruleFunc{
-		pctx:       p,
-		name_:      name,
-		paramsFunc: f,
-		argNames:   argNamesSet,
-		scope_:     ruleScope,
+	required := make([]string, 0, len(checks.required))
+	for argName := range checks.required {
+		required = append(required, argName)
 	}
-	err = p.scope.AddRule(rule)
-	if err != nil {
-		panic(err)
+	sort.Strings(required)
+	for _, argName := range required {
+		if _, ok := args[argName]; !ok {
+			return fmt.Errorf("missing required argument %q of rule %s",
+				argName, r)
+		}
+	}
+
+	for _, group := range checks.exclusive {
+		var set []string
+		for _, argName := range group {
+			if _, ok := args[argName]; ok {
+				set = append(set, argName)
+			}
+		}
+		if len(set) > 1 {
+			return fmt.Errorf("arguments %q of rule %s are mutually exclusive",
+				set, r)
+		}
+	}
+
+	argNames := make([]string, 0, len(args))
+	for argName := range args {
+		argNames = append(argNames, argName)
+	}
+	sort.Strings(argNames)
+	for _, argName := range argNames {
+		for _, validator := range checks.validators[argName] {
+			if err := validator(args[argName]); err != nil {
+				return fmt.Errorf("invalid value %q for argument %q of rule "+
+					"%s: %s", args[argName], argName, r, err)
+			}
+		}
 	}
 
-	return rule
+	return nil
 }
 
 func (r *ruleFunc) packageContext() *packageContext {
@@ -789,18 +3894,50 @@ func (r *ruleFunc) name() string {
 }
 
 func (r *ruleFunc) fullName(pkgNames map[*packageContext]string) string {
-	return packageNamespacePrefix(pkgNames[r.pctx]) + r.name_
+	return transformNinjaName(packageNamespacePrefix(pkgNames[r.pctx]) + r.name_)
 }
 
 func (r *ruleFunc) def(config interface{}) (*ruleDef, error) {
+	key, cacheable := configCacheKey(config)
+	if cacheable {
+		if def, ok := r.cache.Load(key); ok {
+			return def.(*ruleDef), nil
+		}
+	}
+
 	params, err := r.paramsFunc(config)
 	if err != nil {
 		return nil, err
 	}
+	err = validateRuleDepsParams(&params)
+	if err == nil {
+		err = validatePassthroughEnv(&params)
+	}
+	if err == nil {
+		err = validateOutputExtension(&params)
+	}
+	if err == nil {
+		err = validateAlwaysRun(&params)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid RuleParams for %s: %s", r, err)
+	}
 	def, err := parseRuleParams(r.scope(), &params)
 	if err != nil {
 		panic(fmt.Errorf("error parsing RuleParams for %s: %s", r, err))
 	}
+	if def.Pool == nil && !params.Generator {
+		def.Pool = r.pctx.defaultPool
+	}
+	def.ArgDefaults, err = parseArgDefaults(r.pctx.scope, r.scope(), r.argDefaults)
+	if err != nil {
+		return nil, fmt.Errorf("invalid arguments for rule %s: %s", r, err)
+	}
+
+	if cacheable {
+		r.cache.Store(key, def)
+	}
+
 	return def, nil
 }
 
@@ -827,6 +3964,7 @@ func (r *ruleFunc) String() string {
 
 type builtinRule struct {
 	name_      string
+	params     *RuleParams // nil if the rule is defined outside of Blueprint
 	scope_     *basicScope
 	sync.Mutex // protects scope_ during lazy creation
 }
@@ -844,7 +3982,16 @@ func (r *builtinRule) fullName(pkgNames map[*packageContext]string) string {
 }
 
 func (r *builtinRule) def(config interface{}) (*ruleDef, error) {
-	return nil, errRuleIsBuiltin
+	if r.params == nil {
+		return nil, errRuleIsBuiltin
+	}
+
+	def, err := parseRuleParams(r.scope(), r.params)
+	if err != nil {
+		panic(fmt.Errorf("error parsing RuleParams for %s: %s", r, err))
+	}
+
+	return def, nil
 }
 
 func (r *builtinRule) scope() *basicScope {
@@ -867,11 +4014,248 @@ func (r *builtinRule) String() string {
 
 // NewBuiltinRule returns a Rule object that refers to a rule that was created outside of Blueprint
 func NewBuiltinRule(name string) Rule {
+	if reservedRuleNames[name] {
+		panic(&InvalidNameError{name, fmt.Errorf("rule name %q is reserved "+
+			"for a built-in rule, use the predefined rule instead", name)})
+	}
 	return &builtinRule{
 		name_: name,
 	}
 }
 
+// rspfileRule is the variant of a rule with an RspfileThreshold that is used by
+// the build statements whose inputs are longer than the threshold.
+type rspfileRule struct {
+	rule Rule
+}
+
+func (r *rspfileRule) packageContext() *packageContext {
+	return r.rule.packageContext()
+}
+
+func (r *rspfileRule) name() string {
+	return r.rule.name() + ".rsp"
+}
+
+func (r *rspfileRule) fullName(pkgNames map[*packageContext]string) string {
+	// Rule names may contain '.', so checkNameCollision reports the rules of
+	// the same package that are named like the variant.
+	return r.rule.fullName(pkgNames) + ".rsp"
+}
+
+// checkNameCollision returns an error if the scope that defines the rule also
+// defines a rule with the name of its variant.
+func (r *rspfileRule) checkNameCollision() error {
+	scope := r.rule.scope().parent
+	if scope == nil {
+		return nil
+	}
+	other, ok := scope.rules[r.name()]
+	if !ok || other.packageContext() != r.packageContext() {
+		return nil
+	}
+	return fmt.Errorf("rule %s has the name of the response file variant of "+
+		"rule %s, which has an RspfileThreshold", other, r.rule)
+}
+
+func (r *rspfileRule) def(config interface{}) (*ruleDef, error) {
+	def, err := r.rule.def(config)
+	if err != nil {
+		return nil, err
+	}
+	return def.rspfileVariant(r.rule.scope())
+}
+
+func (r *rspfileRule) scope() *basicScope {
+	return r.rule.scope()
+}
+
+func (r *rspfileRule) isArg(argName string) bool {
+	return r.rule.isArg(argName)
+}
+
+func (r *rspfileRule) String() string {
+	return r.rule.String() + ".rsp"
+}
+
+type selectedRule struct {
+	pctx      *packageContext
+	name_     string
+	selector  func(interface{}) (Rule, error)
+	argNames  map[string]bool
+	scope_    *basicScope
+	scopeLock sync.Mutex // protects scope_ during lazy creation
+}
+
+// SelectRule returns a RuleSet that stands for the rule returned by a function
+// that takes a config object as input and returns either a rule or an error.
+// It may only be called during a Go package's initialization - either from the
+// init() function or as part of a package-scoped variable's initialization.
+//
+// This allows the choice between rules, for example between the rules of two
+// toolchains, to be made in one place.  Build statements that invoke the
+// returned Rule invoke the selected rule instead, and only the definitions of
+// the rules that are selected are written to the Ninja file.  The selected rule
+// must be visible within the calling Go package, so it may be an exported rule
+// of an imported package.
+//
+// The argNames arguments list the arguments that build statements may set,
+// which must be accepted by every rule that can be selected.
+func (p *packageContext) SelectRule(name string,
+	selector func(config interface{}) (Rule, error), argNames ...string) RuleSet {
+
+	r, err := p.TrySelectRule(name, selector, argNames...)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// TrySelectRule provides the same functionality as SelectRule, but it returns
+// an error instead of panicking if the name or one of the argument names is
+// invalid.  It may only be called during a Go package's initialization.
+func (p *packageContext) TrySelectRule(name string,
+	selector func(config interface{}) (Rule, error), argNames ...string) (RuleSet, error) {
+
+	checkCalledFromInit()
+
+	err := validateNinjaName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateArgNames(argNames)
+	if err != nil {
+		return nil, fmt.Errorf("invalid argument name: %s", err)
+	}
+
+	argNamesSet := make(map[string]bool)
+	for _, argName := range argNames {
+		argNamesSet[argName] = true
+	}
+
+	r := &selectedRule{
+		pctx:     p,
+		name_:    name,
+		selector: selector,
+		argNames: argNamesSet,
+	}
+	err = p.addRule(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Select returns the rule that r selects for config.  An error is returned if
+// the selector fails or if the selected rule cannot stand for r.
+func (r *selectedRule) Select(config interface{}) (Rule, error) {
+	rule, err := r.selector(config)
+	if err != nil {
+		return nil, err
+	}
+	if rule == nil {
+		return nil, fmt.Errorf("no rule selected by %s", r)
+	}
+	if _, ok := rule.(*selectedRule); ok {
+		return nil, fmt.Errorf("rule %s selected by %s is also created by "+
+			"SelectRule", rule, r)
+	}
+	if !r.pctx.scope.IsRuleVisible(rule) {
+		return nil, fmt.Errorf("rule %s selected by %s is not visible in "+
+			"package %q", rule, r, r.pctx.pkgPath)
+	}
+
+	for argName := range r.argNames {
+		if !rule.isArg(argName) {
+			return nil, fmt.Errorf("rule %s selected by %s does not accept "+
+				"the argument %q", rule, r, argName)
+		}
+	}
+
+	return rule, nil
+}
+
+// selectRule returns the rule that r selects for config.  The args of def,
+// which refer to the arguments of r, are replaced by the arguments of the
+// selected rule.
+func (r *selectedRule) selectRule(config interface{}, def *buildDef) (Rule, error) {
+	rule, err := r.Select(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(def.Args) > 0 {
+		args := make(map[Variable]*ninjaString, len(def.Args))
+		for argVar, value := range def.Args {
+			selectedArgVar, err := rule.scope().LookupVariable(argVar.name())
+			if err != nil {
+				// This shouldn't happen.
+				return nil, fmt.Errorf("argument lookup error: %s", err)
+			}
+			args[selectedArgVar] = value
+		}
+		def.Args = args
+	}
+
+	return rule, nil
+}
+
+func (r *selectedRule) packageContext() *packageContext {
+	return r.pctx
+}
+
+func (r *selectedRule) name() string {
+	return r.name_
+}
+
+func (r *selectedRule) fullName(pkgNames map[*packageContext]string) string {
+	return transformNinjaName(packageNamespacePrefix(pkgNames[r.pctx]) + r.name_)
+}
+
+func (r *selectedRule) def(config interface{}) (*ruleDef, error) {
+	return nil, fmt.Errorf("rule %s created by SelectRule has no definition", r)
+}
+
+func (r *selectedRule) scope() *basicScope {
+	r.scopeLock.Lock()
+	defer r.scopeLock.Unlock()
+
+	if r.scope_ == nil {
+		r.scope_ = makeRuleScope(r.pctx.scope, r.argNames)
+	}
+	return r.scope_
+}
+
+func (r *selectedRule) isArg(argName string) bool {
+	return r.argNames[argName]
+}
+
+func (r *selectedRule) String() string {
+	return r.pctx.pkgPath + "." + r.name_
+}
+
+// newReservedBuiltinRule returns a built-in Rule and reserves its name so that
+// NewBuiltinRule cannot create another rule with the same name.  If params is nil the rule
+// is assumed to be built into Ninja, otherwise its definition is written to the
+// Ninja file under the unprefixed name.  It must only be used to initialize
+// package-scoped variables of this package.
+func newReservedBuiltinRule(name string, params *RuleParams) Rule {
+	if params != nil {
+		err := validateRuleDepsParams(params)
+		if err != nil {
+			panic(fmt.Errorf("invalid RuleParams for rule %q: %s", name, err))
+		}
+	}
+
+	reservedRuleNames[name] = true
+	return &builtinRule{
+		name_:  name,
+		params: params,
+	}
+}
+
 func (p *packageContext) AddNinjaFileDeps(deps ...string) {
 	p.ninjaFileDeps = append(p.ninjaFileDeps, deps...)
 }
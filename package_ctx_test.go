@@ -0,0 +1,3483 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	pctxTest = NewPackageContext("github.com/google/blueprint/pctx_test")
+
+	dynBase = pctxTest.StaticVariable("dynBase", "-O2")
+	dynArch = pctxTest.VariableFunc("dynArch", func(config interface{}) (string, error) {
+		return "-march=" + config.(string), nil
+	})
+	dynFlags = pctxTest.DynamicVariable("dynFlags", []Variable{dynBase, dynArch},
+		func(config interface{}, resolved map[Variable]string) (string, error) {
+			return resolved[dynBase] + " " + resolved[dynArch], nil
+		})
+
+	dynCycleRef = pctxTest.StaticVariable("dynCycleRef", "${dynCycle}")
+	dynCycle    = pctxTest.DynamicVariable("dynCycle", []Variable{dynCycleRef},
+		func(config interface{}, resolved map[Variable]string) (string, error) {
+			return resolved[dynCycleRef], nil
+		})
+
+	// resolvingVar's config is the Variable to resolve.
+	resolvingVar = pctxTest.ResolvingVariableFunc("resolvingVar",
+		func(config interface{}, resolve func(Variable) (string, error)) (string, error) {
+			value, err := resolve(config.(Variable))
+			if err != nil {
+				return "", err
+			}
+			return value + " -g", nil
+		})
+
+	deprecatedVar = pctxTest.DeprecatedStaticVariable("deprecatedVar", "old",
+		"${pctx_test.newVar}")
+	deprecatedRef = pctxTest.StaticVariable("deprecatedRef", "${deprecatedVar}/ref")
+
+	listVar = pctxTest.StaticListVariable("listVar",
+		[]string{"-DFOO=$$", "a b", "c"}, ":")
+
+	// listFunc's config is the list of values.
+	listFunc = pctxTest.ListVariableFunc("listFunc", func(config interface{}) ([]string, error) {
+		values, _ := config.([]string)
+		return values, nil
+	}, ":")
+
+	// onceVar and onceErrVar count the calls of their functions in onceCalls.
+	onceVar = pctxTest.OnceVariable("onceVar", func() (string, error) {
+		atomic.AddInt32(&onceCalls, 1)
+		return "once $$x", nil
+	})
+	onceErrVar = pctxTest.OnceVariable("onceErrVar", func() (string, error) {
+		atomic.AddInt32(&onceCalls, 1)
+		return "", errors.New("once failed")
+	})
+	onceCalls int32
+
+	// pctxTestTouchRule has the name of the predefined Touch rule, which it
+	// does not collide with because it is written under the package's prefix.
+	pctxTestTouchRule = pctxTest.StaticRule("touch", RuleParams{
+		Command: "touch -c $out",
+	})
+
+	pctxTestRule = pctxTest.StaticRule("pctxTestRule", RuleParams{
+		Command: "cp $in $out",
+	})
+
+	pctxTestDerivedRule = pctxTest.DerivedRule("pctxTestDerivedRule", pctxTestRule,
+		RuleParams{
+			Command: BaseCommand + " && chmod $mode $out",
+			Restat:  true,
+		}, "mode")
+
+	pctxTestPool     = pctxTest.StaticPool("pctxTestPool", PoolParams{Depth: 2})
+	pctxTestPoolRule = pctxTest.StaticRule("pctxTestPoolRule", RuleParams{
+		Command: "cp $in $out",
+		Pool:    pctxTestPool,
+	})
+
+	// pctxTestArgsRule doesn't use its "unused" argument, "generator" is read
+	// by Ninja.
+	pctxTestArgsRule = pctxTest.StaticRule("pctxTestArgsRule", RuleParams{
+		Command: "cp $flags $in $out",
+	}, "flags", "unused", "generator")
+
+	// alwaysRunRule runs on every build.  alwaysRunRestatFunc and
+	// alwaysRunRestatErr, set in init(), combine AlwaysRun with Restat.
+	alwaysRunRule = pctxTest.StaticRule("alwaysRunRule", RuleParams{
+		Command:   "date > $out",
+		AlwaysRun: true,
+	})
+	alwaysRunRestatFunc = pctxTest.RuleFunc("alwaysRunRestatFunc",
+		func(interface{}) (RuleParams, error) {
+			return RuleParams{Command: "date > $out", AlwaysRun: true, Restat: true}, nil
+		})
+	alwaysRunRestatErr error
+
+	// passthroughEnvFunc passes through the environment variables listed in
+	// its config.
+	passthroughEnvFunc = pctxTest.RuleFunc("passthroughEnvFunc",
+		func(config interface{}) (RuleParams, error) {
+			return RuleParams{Command: "true", PassthroughEnv: config.([]string)}, nil
+		})
+
+	outputExtensionFunc = pctxTest.RuleFunc("outputExtensionFunc",
+		func(interface{}) (RuleParams, error) {
+			return RuleParams{Command: "true", OutputExtension: ".$ext"}, nil
+		})
+
+	pctxTestProtoRule = pctxTest.StaticRule("pctxTestProtoRule", RuleParams{
+		Command:         "protoc $in --go_out=$out",
+		OutputExtension: ".pb.go",
+	})
+
+	pctxTestMultiLineRule = pctxTest.StaticRule("pctxTestMultiLineRule", RuleParams{
+		Command: "mkdir -p ${out}.d &&\ncp ${in} ${out}",
+	})
+
+	pctxTestRspRule = pctxTest.StaticRule("pctxTestRspRule", RuleParams{
+		Command:          "ld $in -o $out",
+		RspfileThreshold: 10,
+	})
+
+	// pctxTestRspCollisionRule has the name of the response file variant of
+	// pctxTestRspCollidingRule.
+	pctxTestRspCollidingRule = pctxTest.StaticRule("pctxTestRspCollidingRule", RuleParams{
+		Command:          "ld $in -o $out",
+		RspfileThreshold: 1,
+	})
+	pctxTestRspCollisionRule = pctxTest.StaticRule("pctxTestRspCollidingRule.rsp", RuleParams{
+		Command: "ld @$out.rsp -o $out",
+	})
+
+	// pctxTestDefaultsRule's dynBase argument shadows the dynBase variable.
+	pctxTestDefaultsRule = pctxTest.StaticRule("pctxTestDefaultsRule", RuleParams{
+		Command: "cc $opt $dynBase $extra $in -o $out",
+	}, "opt=-O2", "dynBase=${dynBase} -g", "extra")
+
+	pctxTestDerivedDefaultsRule = pctxTest.DerivedRule("pctxTestDerivedDefaultsRule",
+		pctxTestDefaultsRule, RuleParams{Restat: true}, "opt=-O3")
+
+	ExportedTestVar  = pctxTest.StaticVariable("ExportedTestVar", "")
+	ExportedTestRule = pctxTest.StaticRule("ExportedTestRule", RuleParams{
+		Command: "true",
+	})
+	ExportedTestPool = pctxTest.StaticPool("ExportedTestPool", PoolParams{
+		Depth: 1,
+	})
+)
+
+type pctxTestConfig struct {
+	prefix string
+}
+
+func (c pctxTestConfig) Arch(arch string) string {
+	return c.prefix + arch
+}
+
+func (c pctxTestConfig) Prefix() (string, error) {
+	if c.prefix == "" {
+		return "", errors.New("no prefix")
+	}
+	return c.prefix, nil
+}
+
+func (c *pctxTestConfig) PtrPrefix() string {
+	return "ptr" + c.prefix
+}
+
+var (
+	ptrPrefixVar = pctxTest.VariableConfigMethod("ptrPrefixVar", (*pctxTestConfig).PtrPrefix)
+	armArch      = pctxTest.VariableConfigMethodArgs("armArch", pctxTestConfig.Arch, "arm")
+	arm64Arch    = pctxTest.VariableConfigMethodArgs("arm64Arch", pctxTestConfig.Arch, "arm64")
+	prefixVar    = pctxTest.VariableConfigMethod("prefixVar", pctxTestConfig.Prefix)
+	envVar       = pctxTest.EnvVariable("envVar", "BLUEPRINT_PCTX_TEST_ENV", "default")
+)
+
+// The mapVars select a value with the config's prefix, mapPanic is recovered
+// from a MapVariable with an invalid key method in init().
+var (
+	prefixABIs = map[string]string{
+		"arm-":  "aapcs",
+		"mips-": "o32 ${dynBase}",
+	}
+	mapVar        = pctxTest.MapVariable("mapVar", pctxTestConfig.Prefix, prefixABIs, "")
+	mapDefaultVar = pctxTest.MapVariable("mapDefaultVar", pctxTestConfig.Prefix, prefixABIs, "sysv")
+
+	mapPanic interface{}
+)
+
+// The flavoredVars select a value with the generation flavor.
+var (
+	flavoredVar = pctxTest.FlavoredVariable("flavoredVar", map[string]string{
+		"debug":   "-O0 -g",
+		"release": "-O2 ${dynBase}",
+	}, "")
+	flavoredDefaultVar = pctxTest.FlavoredVariable("flavoredDefaultVar",
+		map[string]string{"debug": "-g"}, "-s")
+)
+
+var (
+	cachedFuncCalls int
+	cachedFunc      = pctxTest.VariableFunc("cachedFunc", func(config interface{}) (string, error) {
+		cachedFuncCalls++
+		return *config.(*string), nil
+	})
+
+	cachedRuleCalls int
+	cachedRule      = pctxTest.RuleFunc("cachedRule", func(config interface{}) (RuleParams, error) {
+		cachedRuleCalls++
+		return RuleParams{Command: "echo " + *config.(*string)}, nil
+	})
+)
+
+var (
+	funcTestPool = pctxTest.PoolFunc("funcTestPool", func(interface{}) (PoolParams, error) {
+		return PoolParams{Depth: 4}, nil
+	})
+	compositeTestPool = pctxTest.CompositePool("compositeTestPool", pctxTestPool, funcTestPool)
+	nestedTestPool    = pctxTest.CompositePool("nestedTestPool", compositeTestPool, ExportedTestPool)
+)
+
+// validatedRule requires mode and checks that flags is not empty in init().
+var (
+	validatedRule = pctxTest.StaticRule("validatedRule", RuleParams{
+		Command: "cc $flags -m$mode -o $out",
+	}, "flags", "mode")
+
+	requireDefaultPanic interface{}
+)
+
+// linkRule's static argument excludes shared and pie, exclusivePanics are
+// recovered from invalid groups of exclusive arguments in init().
+var (
+	linkRule = pctxTest.StaticRule("linkRule", RuleParams{
+		Command: "ld $static $shared $pie $flags -o $out",
+	}, "static", "shared", "pie", "flags")
+
+	exclusivePanics []interface{}
+)
+
+// concatVar skips its nil and empty parts, concatArgPanic is recovered from
+// a ConcatVariable with a rule argument part in init().
+var (
+	concatVar = pctxTest.ConcatVariable("concatVar", dynArch, nil, ExportedTestVar,
+		deprecatedRef, dynBase)
+
+	concatArgPanic interface{}
+)
+
+// joinVar drops its empty fragments, joinFragmentPanic is recovered from a
+// StaticVariableJoin with an invalid fragment in init().
+var (
+	joinVar = pctxTest.StaticVariableJoin("joinVar", ":$", "", "a$$", "${dynBase}", "", "b")
+
+	joinFragmentPanic interface{}
+)
+
+// segmentedRule skips its empty segment, segmentPanics are recovered from
+// invalid SegmentedRules in init().
+var (
+	segmentedRuleSegments = []RuleSegment{
+		{Name: "tool", Command: "cc"},
+		{Name: "flags", Command: "$flags ${dynBase}"},
+		{Name: "extra", Command: ""},
+		{Name: "io", Command: "-c ${in} -o ${out}"},
+	}
+	segmentedRule = pctxTest.SegmentedRule("segmentedRule", RuleParams{
+		Description: "cc ${out}",
+		Restat:      true,
+	}, segmentedRuleSegments, "flags")
+
+	segmentPanics []interface{}
+)
+
+// finalizeTestConfig is the config of TestConfigFinalizer.
+type finalizeTestConfig struct {
+	value string
+}
+
+var finalizedVar = pctxTest.VariableFunc("finalizedVar", func(config interface{}) (string, error) {
+	return config.(*finalizeTestConfig).value, nil
+})
+
+// finalizedToolRule selects the clang rule only for the finalized config.
+var finalizedToolRule = pctxTest.SelectRule("finalizedToolRule", func(config interface{}) (Rule, error) {
+	if config.(*finalizeTestConfig).value == "final" {
+		return clangRule, nil
+	}
+	return gccRule, nil
+}, "flags")
+
+// selectedToolRule selects between the gcc and clang rules by a *string config.
+var (
+	gccRule = pctxTest.StaticRule("gccRule", RuleParams{
+		Command: "gcc $flags -o $out $in",
+	}, "flags")
+	clangRule = pctxTest.StaticRule("clangRule", RuleParams{
+		Command: "clang $flags -o $out $in",
+	}, "flags")
+	selectedToolRule = pctxTest.SelectRule("selectedToolRule", func(config interface{}) (Rule, error) {
+		switch *config.(*string) {
+		case "gcc":
+			return gccRule, nil
+		case "clang":
+			return clangRule, nil
+		case "cached":
+			return cachedRule, nil
+		}
+		return nil, errors.New("unknown toolchain " + strconv.Quote(*config.(*string)))
+	}, "flags")
+)
+
+var pctxReExportTest = NewPackageContext("github.com/google/blueprint/pctx_reexport_test")
+
+var (
+	overriddenVar  = pctxTest.StaticVariable("overriddenVar", "original")
+	overriddenFunc = pctxTest.VariableFunc("overriddenFunc", func(interface{}) (string, error) {
+		return "original", nil
+	})
+)
+
+// pctxCycleA imports pctxCycleB, which imports pctxCycleC.
+var (
+	pctxCycleA = NewPackageContext("github.com/google/blueprint/pctx_cycle_a")
+	pctxCycleB = NewPackageContext("github.com/google/blueprint/pctx_cycle_b")
+	pctxCycleC = NewPackageContext("github.com/google/blueprint/pctx_cycle_c")
+)
+
+// pctxNsArm and pctxNsX86 share the pctx_ns namespace, which is also the short
+// name of pctxNsShort.
+var (
+	pctxNsArm   = NewPackageContext("github.com/google/blueprint/pctx_ns/arm")
+	pctxNsX86   = NewPackageContext("github.com/google/blueprint/pctx_ns/x86")
+	pctxNsShort = NewPackageContext("github.com/google/blueprint/other/pctx_ns")
+
+	nsArmFlags = pctxNsArm.StaticVariable("armFlags", "-marm")
+	nsX86Flags = pctxNsX86.StaticVariable("x86Flags", "-m32")
+	nsRule     = pctxNsArm.StaticRule("nsRule", RuleParams{
+		Command: "cc ${armFlags} $in -o $out",
+	})
+	nsShortVar = pctxNsShort.StaticVariable("nsShortVar", "short")
+)
+
+// typoVar references a misspelled variable, it is only reported in strict
+// variable resolution mode.
+var (
+	pctxStrictTest = NewPackageContext("github.com/google/blueprint/pctx_strict_test")
+
+	typoVar = pctxStrictTest.StaticVariable("typoVar", "${pctx_test.ExportedTestVarr}")
+
+	// importedVar is defined before the import of pctx_test in init().
+	importedVar = pctxStrictTest.StaticVariable("importedVar", "${pctx_test.ExportedTestVar}x")
+)
+
+// pctxFingerprintTest has definitions that depend on a string config.
+var (
+	pctxFingerprintTest = NewPackageContext("github.com/google/blueprint/pctx_fingerprint_test")
+
+	fingerprintVar = pctxFingerprintTest.VariableFunc("fingerprintVar", func(config interface{}) (string, error) {
+		if config == "bad" {
+			return "", errors.New("bad config")
+		}
+		return config.(string), nil
+	})
+	_ = pctxFingerprintTest.StaticRule("fingerprintRule", RuleParams{
+		Command: "echo ${fingerprintVar} ${pctx_test.ExportedTestVar}",
+		Pool:    fingerprintPool,
+	})
+	fingerprintPool = pctxFingerprintTest.StaticPool("fingerprintPool", PoolParams{Depth: 1})
+	_               = pctxFingerprintTest.RuleFunc("fingerprintFuncRule", func(config interface{}) (RuleParams, error) {
+		if config == "undefined" {
+			return RuleParams{Command: "echo ${fingerprintMissing}"}, nil
+		}
+		return RuleParams{Command: "echo ${fingerprintVar}"}, nil
+	})
+)
+
+// pctxTryTest collects the errors of invalid definitions made in init().
+var (
+	pctxTryTest = NewPackageContext("github.com/google/blueprint/pctx_try_test")
+
+	tryErrs            []error
+	tryFuncErrs        []error
+	outputExtensionErr error
+)
+
+// pctxFileTest has a variable read from a file in the temporary directory.
+var (
+	pctxFileTest = NewPackageContext("github.com/google/blueprint/pctx_file_test")
+
+	fileVarPath = filepath.Join(os.TempDir(), "blueprint_pctx_file_test_version")
+	fileVar     = pctxFileTest.FileVariable("fileVar", fileVarPath)
+	fileVarBase = pctxFileTest.StaticVariable("fileVarBase", "1.0")
+)
+
+// pctxCaseTest has names that differ only in case.
+var (
+	pctxCaseTest = NewPackageContext("github.com/google/blueprint/pctx_case_test")
+
+	_ = pctxCaseTest.StaticVariable("caseVar", "a")
+	_ = pctxCaseTest.StaticVariable("CaseVar", "b")
+)
+
+// pctxToolchainTest defines the "cc" toolchain, which pctxToolchainUser imports
+// in init().  toolchainPanics are recovered from invalid toolchain definitions
+// and imports.
+var (
+	pctxToolchainTest = NewPackageContext("github.com/google/blueprint/pctx_toolchain_test")
+	pctxToolchainUser = NewPackageContext("github.com/google/blueprint/pctx_toolchain_user")
+
+	ccCompiler = pctxToolchainTest.StaticVariable("CcCompiler", "clang")
+	ccVersion  = pctxToolchainTest.StaticVariable("ccVersion", "12")
+	ccPool     = pctxToolchainTest.StaticPool("CcPool", PoolParams{Depth: 4})
+	ccRule     = pctxToolchainTest.StaticRule("CcRule", RuleParams{
+		Command: "${CcCompiler} -c $in -o $out",
+		Pool:    ccPool,
+	})
+	ccOther = pctxToolchainTest.StaticVariable("CcOther", "other")
+
+	ccFlags = pctxToolchainUser.StaticVariable("ccFlags", "${CcCompiler}-${ccVersion} -O2")
+
+	toolchainPanics []interface{}
+)
+
+// pctxPoolUser's rules use the pool defined by pctxPoolOwner, which it imports
+// in init().
+var (
+	pctxPoolOwner = NewPackageContext("github.com/google/blueprint/pctx_pool_owner")
+	pctxPoolUser  = NewPackageContext("github.com/google/blueprint/pctx_pool_user")
+
+	SharedPool = pctxPoolOwner.StaticPool("SharedPool", PoolParams{Depth: 3})
+
+	sharedPoolRule = pctxPoolUser.StaticRule("sharedPoolRule", RuleParams{
+		Command: "cp $in $out",
+		Pool:    SharedPool,
+	})
+	sharedPoolFuncRule = pctxPoolUser.RuleFunc("sharedPoolFuncRule",
+		func(interface{}) (RuleParams, error) {
+			return RuleParams{Command: "cp $in $out", Pool: SharedPool}, nil
+		})
+	noPoolRule = pctxPoolUser.StaticRule("noPoolRule", RuleParams{
+		Command: "cp $in $out",
+	})
+)
+
+// pctxDefaultPoolTest sets defaultPool as its default pool in init(), which
+// applies to its rules that do not specify a pool.  defaultPoolPanic is
+// recovered from setting a pool that the package does not import.
+var (
+	pctxDefaultPoolTest = NewPackageContext("github.com/google/blueprint/pctx_default_pool_test")
+
+	defaultPool = pctxDefaultPoolTest.StaticPool("defaultPool", PoolParams{Depth: 2})
+	otherPool   = pctxDefaultPoolTest.StaticPool("otherPool", PoolParams{Depth: 1})
+
+	defaultPoolRule = pctxDefaultPoolTest.StaticRule("defaultPoolRule", RuleParams{
+		Command: "cp $in $out",
+	})
+	defaultPoolFuncRule = pctxDefaultPoolTest.RuleFunc("defaultPoolFuncRule",
+		func(interface{}) (RuleParams, error) {
+			return RuleParams{Command: "cp $in $out"}, nil
+		})
+	otherPoolRule = pctxDefaultPoolTest.StaticRule("otherPoolRule", RuleParams{
+		Command: "cp $in $out",
+		Pool:    otherPool,
+	})
+	generatorRule = pctxDefaultPoolTest.StaticRule("generatorRule", RuleParams{
+		Command:   "cp $in $out",
+		Generator: true,
+	})
+	generatorFuncRule = pctxDefaultPoolTest.RuleFunc("generatorFuncRule",
+		func(interface{}) (RuleParams, error) {
+			return RuleParams{Command: "cp $in $out", Generator: true}, nil
+		})
+
+	defaultPoolPanic interface{}
+)
+
+// pctxTcUser imports the packages under pctx_tc with ImportPrefix in init(),
+// but not pctx_tcx, which only shares the beginning of the path.
+// importPrefixPanics are recovered from prefixes that match no package, two
+// packages with the same name, or a package with the name of an imported one.
+var (
+	pctxTcArm    = NewPackageContext("github.com/google/blueprint/pctx_tc/arm")
+	pctxTcX86    = NewPackageContext("github.com/google/blueprint/pctx_tc/x86")
+	pctxTcCommon = NewPackageContext("github.com/google/blueprint/pctx_tc/common")
+	pctxTcx      = NewPackageContext("github.com/google/blueprint/pctx_tcx")
+	pctxTcUser   = NewPackageContext("github.com/google/blueprint/pctx_tc_user")
+
+	ArmFlags    = pctxTcArm.StaticVariable("ArmFlags", "-marm")
+	X86Flags    = pctxTcX86.StaticVariable("X86Flags", "-m32")
+	CommonFlags = pctxTcCommon.StaticVariable("CommonFlags", "-O2")
+	TcxFlags    = pctxTcx.StaticVariable("TcxFlags", "-x")
+
+	tcFlags = pctxTcUser.StaticVariable("tcFlags", "${arm.ArmFlags} ${x86.X86Flags} ${common.CommonFlags}")
+
+	pctxDupA = NewPackageContext("github.com/google/blueprint/pctx_dup/a/util")
+	pctxDupB = NewPackageContext("github.com/google/blueprint/pctx_dup/b/util")
+
+	pctxClashArm  = NewPackageContext("github.com/google/blueprint/pctx_clash/arm")
+	pctxClashZlib = NewPackageContext("github.com/google/blueprint/pctx_clash/zlib")
+
+	importPrefixPanics []interface{}
+)
+
+// pctxObservedTest is created in init() with a registration observer that
+// records its definitions in registrations.
+var (
+	pctxObservedTest PackageContext
+	registrations    []string
+)
+
+func recordRegistration(kind, pkgPath, name string) {
+	registrations = append(registrations, kind+" "+pkgPath+" "+name)
+}
+
+// pctxMangledTest is created in init() with a package name mangler that strips
+// the vendor directory, manglerPanic is recovered from a package context whose
+// mangled name collides with it.
+var (
+	pctxMangledTest PackageContext
+	manglerPanic    interface{}
+)
+
+// pctxOptionalTest optionally imports pctx_test and a package that isn't linked.
+var (
+	pctxOptionalTest = NewPackageContext("github.com/google/blueprint/pctx_optional_test")
+
+	importedOptional, importedMissing bool
+)
+
+// pctxImportNameTest imports packages whose last path components are not valid
+// package names in Ninja variable references.
+var (
+	pctxImportNameTest = NewPackageContext("github.com/google/blueprint/pctx_import_name_test")
+	pctxYamlV2         = NewPackageContext("github.com/google/blueprint/pctx_import/yaml.v2")
+	pctxOtherYamlV2    = NewPackageContext("github.com/google/blueprint/pctx_import_other/yaml.v2")
+
+	yamlV2Var = pctxYamlV2.StaticVariable("YamlVar", "yaml")
+
+	importNameErr error
+)
+
+func init() {
+	_, err := pctxTryTest.TryStaticVariable("tryVar", "a")
+	tryErrs = append(tryErrs, err)
+	_, err = pctxTryTest.TryStaticVariable("tryVar", "b")
+	tryErrs = append(tryErrs, err)
+	_, err = pctxTryTest.TryStaticRule("try rule", RuleParams{Command: "true"})
+	tryErrs = append(tryErrs, err)
+	_, err = pctxTryTest.TryStaticRule("try.rule$", RuleParams{Command: "true"})
+	tryErrs = append(tryErrs, err)
+	_, err = pctxTryTest.TryStaticPool("tryPool", PoolParams{Depth: 0})
+	tryErrs = append(tryErrs, err)
+	tryErrs = append(tryErrs, pctxTryTest.TryImport("github.com/google/blueprint/pctx_missing"))
+	tryErrs = append(tryErrs, pctxTryTest.TryImportAs("bad name", "github.com/google/blueprint/pctx_test"))
+	_, err = pctxTryTest.TryVariableFunc("tryVarFunc", func(interface{}) (string, error) {
+		return "", nil
+	})
+	tryFuncErrs = append(tryFuncErrs, err)
+	_, err = pctxTryTest.TryVariableFunc("try var func", nil)
+	tryFuncErrs = append(tryFuncErrs, err)
+	_, err = pctxTryTest.TryVariableConfigMethod("tryMethodVar", 42)
+	tryFuncErrs = append(tryFuncErrs, err)
+	_, err = pctxTryTest.TryEnvVariable("tryEnvVar", "", "")
+	tryFuncErrs = append(tryFuncErrs, err)
+	_, err = pctxTryTest.TryConcatVariable("tryConcatVar", &argVariable{"out"})
+	tryFuncErrs = append(tryFuncErrs, err)
+	_, err = pctxTryTest.TryPoolFunc("console", nil)
+	tryFuncErrs = append(tryFuncErrs, err)
+	_, err = pctxTryTest.TryCPUScaledPool("tryCPUPool", 2)
+	tryFuncErrs = append(tryFuncErrs, err)
+	_, err = pctxTryTest.TryCompositePool("tryCompositePool")
+	tryFuncErrs = append(tryFuncErrs, err)
+	_, err = pctxTryTest.TryRuleFunc("tryRuleFunc", nil, "bad arg")
+	tryFuncErrs = append(tryFuncErrs, err)
+	_, err = pctxTryTest.TryDerivedRule("tryDerivedRule", gccRule, RuleParams{})
+	tryFuncErrs = append(tryFuncErrs, err)
+	_, err = pctxTryTest.TrySegmentedRule("trySegmentedRule", RuleParams{}, nil)
+	tryFuncErrs = append(tryFuncErrs, err)
+	_, err = pctxTryTest.TrySelectRule("try select rule", nil)
+	tryFuncErrs = append(tryFuncErrs, err)
+	_, outputExtensionErr = pctxTryTest.TryStaticRule("tryExtRule", RuleParams{
+		Command:         "true",
+		OutputExtension: ".$ext",
+	})
+
+	pctxFingerprintTest.Import("github.com/google/blueprint/pctx_test")
+
+	importedOptional = pctxOptionalTest.ImportOptional("github.com/google/blueprint/pctx_test")
+	importedMissing = pctxOptionalTest.ImportOptional("github.com/google/blueprint/pctx_missing")
+
+	pctxStrictTest.Import("github.com/google/blueprint/pctx_test")
+
+	pctxImportNameTest.Import("github.com/google/blueprint/pctx_import/yaml.v2")
+	importNameErr = pctxImportNameTest.TryImport("github.com/google/blueprint/pctx_import_other/yaml.v2")
+
+	pctxReExportTest.ReExport("github.com/google/blueprint/pctx_test")
+
+	pctxCycleB.Import("github.com/google/blueprint/pctx_cycle_c")
+	pctxCycleA.Import("github.com/google/blueprint/pctx_cycle_b")
+
+	pctxNsArm.SetNamespace("pctx_ns")
+	pctxNsX86.SetNamespace("pctx_ns")
+
+	SetArgValidator(validatedRule, "flags", func(value string) error {
+		if value == "" {
+			return errors.New("must not be empty")
+		}
+		return nil
+	})
+	RequireArgs(validatedRule, "mode")
+	func() {
+		defer func() { requireDefaultPanic = recover() }()
+		RequireArgs(pctxTestDefaultsRule, "opt")
+	}()
+	ExclusiveArgs(linkRule, "static", "shared")
+	ExclusiveArgs(linkRule, "static", "pie")
+	for _, argNames := range [][]string{
+		{"static"},
+		{"static", "static"},
+		{"opt", "extra"},
+	} {
+		func() {
+			defer func() { exclusivePanics = append(exclusivePanics, recover()) }()
+			rule := linkRule
+			if argNames[0] == "opt" {
+				rule = pctxTestDefaultsRule
+			}
+			ExclusiveArgs(rule, argNames...)
+		}()
+	}
+	func() {
+		defer func() { concatArgPanic = recover() }()
+		pctxTest.ConcatVariable("concatArgVar", dynBase, &argVariable{"in"})
+	}()
+	SetPackageNameMangler(func(pkgPath string) string {
+		return strings.Replace(strings.TrimPrefix(pkgPath, "github.com/google/blueprint/vendor/"),
+			"/", ".", -1)
+	})
+	pctxMangledTest = NewPackageContext("github.com/google/blueprint/vendor/pctx_mangled_test")
+	func() {
+		defer func() { manglerPanic = recover() }()
+		NewPackageContext("pctx_mangled_test")
+	}()
+	SetPackageNameMangler(nil)
+
+	pctxPoolOwner.SetNamespace("owner")
+	pctxPoolUser.Import("github.com/google/blueprint/pctx_pool_owner")
+
+	_, alwaysRunRestatErr = pctxTest.TryStaticRule("alwaysRunRestatRule", RuleParams{
+		Command:   "date > $out",
+		AlwaysRun: true,
+		Restat:    true,
+	})
+
+	pctxTcUser.ImportPrefix("github.com/google/blueprint/pctx_tc/")
+	for _, prefix := range []string{
+		"github.com/google/blueprint/pctx_none",
+		"github.com/google/blueprint/pctx_dup",
+		"github.com/google/blueprint/pctx_clash",
+	} {
+		func() {
+			defer func() { importPrefixPanics = append(importPrefixPanics, recover()) }()
+			pctxTcUser.ImportPrefix(prefix)
+		}()
+	}
+
+	pctxDefaultPoolTest.SetPackageDefaultPool(defaultPool)
+	func() {
+		defer func() { defaultPoolPanic = recover() }()
+		pctxDefaultPoolTest.SetPackageDefaultPool(SharedPool)
+	}()
+
+	pctxToolchainTest.DefineToolchain("cc", ccCompiler, ccVersion, ccRule, ccPool)
+	pctxToolchainUser.ImportToolchain("github.com/google/blueprint/pctx_toolchain_test", "cc")
+	for _, f := range []func(){
+		func() { pctxToolchainTest.DefineToolchain("cc", ccOther) },
+		func() { pctxToolchainTest.DefineToolchain("bad", ccOther, "CcOther") },
+		func() { pctxToolchainTest.DefineToolchain("bad", ccOther, ccOther) },
+		func() { pctxToolchainTest.DefineToolchain("bad", ExportedTestVar) },
+		func() { pctxToolchainUser.ImportToolchain("github.com/google/blueprint/pctx_toolchain_test", "ld") },
+		func() { pctxToolchainUser.ImportToolchain("github.com/google/blueprint/pctx_toolchain_test", "cc") },
+	} {
+		func() {
+			defer func() { toolchainPanics = append(toolchainPanics, recover()) }()
+			f()
+		}()
+	}
+
+	SetRegistrationObserver(recordRegistration)
+	pctxObservedTest = NewPackageContext("github.com/google/blueprint/pctx_observed_test")
+	pctxObservedTest.Import("github.com/google/blueprint/pctx_test")
+	pctxObservedTest.StaticVariable("observedVar", "a")
+	pctxObservedTest.StaticPool("observedPool", PoolParams{Depth: 1})
+	pctxObservedTest.StaticRule("observedRule", RuleParams{Command: "true"})
+	pctxObservedTest.VariableFunc("observedFunc", func(interface{}) (string, error) {
+		return "b", nil
+	})
+	pctxObservedTest.ReExport("github.com/google/blueprint/pctx_test")
+	SetRegistrationObserver(nil)
+	pctxObservedTest.StaticVariable("unobservedVar", "c")
+
+	func() {
+		defer func() { mapPanic = recover() }()
+		pctxTest.MapVariable("mapBadVar", pctxTestConfig.Arch, prefixABIs, "")
+	}()
+	func() {
+		defer func() { joinFragmentPanic = recover() }()
+		pctxTest.StaticVariableJoin("joinBadVar", "x", "a$", "b")
+	}()
+	for _, tc := range []struct {
+		params   RuleParams
+		segments []RuleSegment
+	}{
+		{RuleParams{}, []RuleSegment{{Name: "tool", Command: "cc"}, {Name: "tool", Command: "-c"}}},
+		{RuleParams{}, []RuleSegment{{Name: "tool", Command: "cc $"}, {Name: "io", Command: "in"}}},
+		{RuleParams{}, []RuleSegment{{Name: "bad name", Command: "cc"}}},
+		{RuleParams{}, []RuleSegment{{Name: "tool", Command: ""}}},
+		{RuleParams{Command: "cc"}, []RuleSegment{{Name: "io", Command: "-c ${in}"}}},
+	} {
+		func() {
+			defer func() { segmentPanics = append(segmentPanics, recover()) }()
+			pctxTest.SegmentedRule("badSegmentedRule", tc.params, tc.segments)
+		}()
+	}
+
+	OverrideVariable(overriddenVar, "overridden ${dynBase}")
+	OverrideVariable(overriddenFunc, "overridden")
+}
+
+// pctxTestModule is a module whose build actions are supplied by the test.
+type pctxTestModule struct {
+	SimpleName
+	generate func(ctx ModuleContext)
+}
+
+func (m *pctxTestModule) GenerateBuildActions(ctx ModuleContext) {
+	m.generate(ctx)
+}
+
+// runPctxTest runs the generate phase for a single module that calls generate
+// from its GenerateBuildActions method.
+func runPctxTest(t *testing.T, config interface{},
+	generate func(ctx ModuleContext)) (*Context, []error) {
+
+	ctx := parsePctxTest(t, generate)
+
+	_, errs := ctx.ResolveDependencies(config)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+
+	_, errs = ctx.PrepareBuildActions(config)
+	return ctx, errs
+}
+
+// parsePctxTest returns a Context that has parsed the Blueprints file of a
+// single module that calls generate from its GenerateBuildActions.
+func parsePctxTest(t *testing.T, generate func(ctx ModuleContext)) *Context {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Blueprints": []byte(`
+			test_module {
+			    name: "A",
+			}
+		`),
+	})
+	ctx.RegisterModuleType("test_module", func() (Module, []interface{}) {
+		m := &pctxTestModule{generate: generate}
+		return m, []interface{}{&m.SimpleName.Properties}
+	})
+
+	_, errs := ctx.ParseBlueprintsFiles("Blueprints")
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+
+	return ctx
+}
+
+// writePctxTest is like runPctxTest, but also fails the test on errors and
+// returns the generated Ninja file.
+func writePctxTest(t *testing.T, config interface{},
+	generate func(ctx ModuleContext)) (*Context, string) {
+
+	ctx, errs := runPctxTest(t, config, generate)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	return ctx, writeBuildFile(t, ctx)
+}
+
+// writeBuildFile returns the Ninja file written by ctx, for example again after
+// changing the settings of ctx that only affect how it is written.
+func writeBuildFile(t *testing.T, ctx *Context) string {
+	buf := &bytes.Buffer{}
+	err := ctx.WriteBuildFile(buf)
+	if err != nil {
+		t.Fatalf("unexpected error writing build file: %s", err)
+	}
+
+	return buf.String()
+}
+
+func TestDynamicVariable(t *testing.T) {
+	value, err := dynFlags.value("armv8-a")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if g, w := value.Value(nil), "-O2 -march=armv8-a"; g != w {
+		t.Errorf("incorrect value, want %q, got %q", w, g)
+	}
+}
+
+func TestDynamicVariableCycle(t *testing.T) {
+	_, err := dynCycle.value(nil)
+	if err == nil {
+		t.Fatal("expected a reference cycle error")
+	}
+
+	if !strings.Contains(err.Error(), "detected variable reference cycle") {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestDeprecatedStaticVariable(t *testing.T) {
+	// The modules are generated concurrently, but the warnings are sorted.
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Blueprints": []byte(`
+			test_module { name: "E" }
+			test_module { name: "D" }
+			test_module { name: "C" }
+			test_module { name: "B" }
+			test_module { name: "A" }
+		`),
+	})
+	ctx.RegisterModuleType("test_module", func() (Module, []interface{}) {
+		m := &pctxTestModule{generate: func(ctx ModuleContext) {
+			for _, out := range []string{"a", "b"} {
+				ctx.Build(pctxTest, BuildParams{
+					Rule:    pctxTestRule,
+					Outputs: []string{"${deprecatedVar}/" + ctx.ModuleName() + out},
+					Inputs:  []string{"${deprecatedRef}"},
+				})
+			}
+		}}
+		return m, []interface{}{&m.SimpleName.Properties}
+	})
+
+	_, errs := ctx.ParseBlueprintsFiles("Blueprints")
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	_, errs = ctx.PrepareBuildActions(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	var want []string
+	for _, name := range []string{"A", "B", "C", "D", "E"} {
+		want = append(want, `variable ${pctx_test.deprecatedVar} is deprecated, `+
+			`use ${pctx_test.newVar} (referenced by module "`+name+`")`)
+	}
+	want = append(want, `variable ${pctx_test.deprecatedVar} is deprecated, use ${pctx_test.newVar} (referenced by variable github.com/google/blueprint/pctx_test.deprecatedRef)`)
+	if g := ctx.Warnings(); !reflect.DeepEqual(g, want) {
+		t.Errorf("incorrect warnings:\nwant: %q\n got: %q", want, g)
+	}
+}
+
+func TestFailOnDeprecated(t *testing.T) {
+	for _, failOnDeprecated := range []bool{false, true} {
+		ctx := NewContext()
+		ctx.SetFailOnDeprecated(failOnDeprecated)
+		ctx.MockFileSystem(map[string][]byte{
+			"Blueprints": []byte(`
+				old_test_module { name: "C" }
+				old_test_module { name: "B" }
+				old_test_module { name: "A" }
+			`),
+		})
+		ctx.RegisterModuleType("test_module", func() (Module, []interface{}) {
+			m := &pctxTestModule{generate: func(ctx ModuleContext) {
+				ctx.Build(pctxTest, BuildParams{
+					Rule:    pctxTestRule,
+					Outputs: []string{"${deprecatedVar}/" + ctx.ModuleName()},
+				})
+			}}
+			return m, []interface{}{&m.SimpleName.Properties}
+		})
+		ctx.RegisterModuleTypeAlias("old_test_module", "test_module")
+
+		_, errs := ctx.ParseBlueprintsFiles("Blueprints")
+		if len(errs) > 0 {
+			t.Fatalf("unexpected parse errors: %v", errs)
+		}
+		_, errs = ctx.PrepareBuildActions(nil)
+
+		want := []string{
+			`Blueprints:2:5: module type "old_test_module" is deprecated, use "test_module"`,
+			`Blueprints:3:5: module type "old_test_module" is deprecated, use "test_module"`,
+			`Blueprints:4:5: module type "old_test_module" is deprecated, use "test_module"`,
+		}
+		for _, name := range []string{"A", "B", "C"} {
+			want = append(want, `variable ${pctx_test.deprecatedVar} is deprecated, `+
+				`use ${pctx_test.newVar} (referenced by module "`+name+`")`)
+		}
+		var g []string
+		for _, err := range errs {
+			g = append(g, err.Error())
+		}
+		if !failOnDeprecated {
+			if len(errs) > 0 {
+				t.Errorf("unexpected errors: %v", errs)
+			}
+			g = ctx.Warnings()
+		}
+		if !reflect.DeepEqual(g, want) {
+			t.Errorf("failOnDeprecated %t:\nwant: %q\n got: %q", failOnDeprecated, want, g)
+		}
+	}
+}
+
+func TestStaticListVariable(t *testing.T) {
+	value, err := listVar.value(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if g, w := value.Value(nil), "-DFOO=$$$$:a b:c"; g != w {
+		t.Errorf("incorrect value, want %q, got %q", w, g)
+	}
+
+	values, ok := StaticListVariableValues(listVar)
+	if !ok {
+		t.Fatal("expected list variable values")
+	}
+	if w := []string{"-DFOO=$$", "a b", "c"}; !reflect.DeepEqual(values, w) {
+		t.Errorf("incorrect values, want %q, got %q", w, values)
+	}
+
+	if _, ok := StaticListVariableValues(dynBase); ok {
+		t.Error("expected no list values for a non-list variable")
+	}
+}
+
+func TestListVariableFunc(t *testing.T) {
+	for _, testCase := range []struct {
+		config []string
+		want   string
+	}{
+		{[]string{"-DFOO=$$", "a b", "c"}, "-DFOO=$$$$:a b:c"},
+		{[]string{}, ""},
+		{nil, ""},
+	} {
+		value, err := listFunc.value(testCase.config)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if g := value.Value(nil); g != testCase.want {
+			t.Errorf("incorrect value for %q, want %q, got %q", testCase.config,
+				testCase.want, g)
+		}
+	}
+}
+
+func TestOnceVariable(t *testing.T) {
+	atomic.StoreInt32(&onceCalls, 0)
+
+	var wg sync.WaitGroup
+	values := make([]string, 8)
+	errs := make([]error, len(values))
+	for i := range values {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			value, err := onceVar.value(strconv.Itoa(i))
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			values[i] = value.Value(nil)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range values {
+		if errs[i] != nil {
+			t.Fatalf("%d: unexpected error: %s", i, errs[i])
+		}
+		if g, w := values[i], "once $$x"; g != w {
+			t.Errorf("%d: incorrect value, want %q, got %q", i, w, g)
+		}
+	}
+
+	for _, config := range []interface{}{"a", "b"} {
+		_, err := onceErrVar.value(config)
+		if err == nil || err.Error() != "once failed" {
+			t.Errorf("%v: expected error %q, got %v", config, "once failed", err)
+		}
+	}
+
+	if g := atomic.LoadInt32(&onceCalls); g != 2 {
+		t.Errorf("expected the functions to be called 2 times, got %d", g)
+	}
+}
+
+func TestImportGraph(t *testing.T) {
+	graph := ImportGraph()
+	for pkgPath, want := range map[string][]string{
+		"github.com/google/blueprint/pctx_cycle_a":       {"github.com/google/blueprint/pctx_cycle_b"},
+		"github.com/google/blueprint/pctx_cycle_b":       {"github.com/google/blueprint/pctx_cycle_c"},
+		"github.com/google/blueprint/pctx_cycle_c":       nil,
+		"github.com/google/blueprint/pctx_reexport_test": nil,
+	} {
+		imports, ok := graph[pkgPath]
+		if !ok {
+			t.Errorf("missing package %q", pkgPath)
+		} else if !reflect.DeepEqual(imports, want) {
+			t.Errorf("incorrect imports of %q, want %q, got %q", pkgPath, want, imports)
+		}
+	}
+}
+
+func TestExportedNames(t *testing.T) {
+	vars, rules, pools, err := ExportedNames("github.com/google/blueprint/pctx_test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if w := []string{"ExportedTestVar"}; !reflect.DeepEqual(vars, w) {
+		t.Errorf("incorrect vars, want %q, got %q", w, vars)
+	}
+	if w := []string{"ExportedTestRule"}; !reflect.DeepEqual(rules, w) {
+		t.Errorf("incorrect rules, want %q, got %q", w, rules)
+	}
+	if w := []string{"ExportedTestPool"}; !reflect.DeepEqual(pools, w) {
+		t.Errorf("incorrect pools, want %q, got %q", w, pools)
+	}
+
+	_, _, _, err = ExportedNames("github.com/google/blueprint/missing")
+	if err == nil {
+		t.Error("expected an error for a package without a context")
+	}
+}
+
+func TestAssertExports(t *testing.T) {
+	const pkgPath = "github.com/google/blueprint/pctx_test"
+	err := AssertExports(pkgPath, []string{"ExportedTestVar"},
+		[]string{"ExportedTestRule"}, []string{"ExportedTestPool"})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	err = AssertExports(pkgPath, []string{"ExportedTestVar", "RemovedVar", "OldVar"},
+		nil, []string{"ExportedTestPool"})
+	want := `package "github.com/google/blueprint/pctx_test" does not export the expected names:
+  missing variable "OldVar"
+  missing variable "RemovedVar"
+  extra rule "ExportedTestRule"`
+	if err == nil || err.Error() != want {
+		t.Errorf("incorrect error:\nwant: %s\n got: %v", want, err)
+	}
+
+	err = AssertExports("github.com/google/blueprint/missing", nil, nil, nil)
+	if err == nil {
+		t.Error("expected an error for a package without a context")
+	}
+}
+
+func TestReExport(t *testing.T) {
+	scope := newScope(nil)
+	err := scope.AddImport("reexport", pctxReExportTest.getScope())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := scope.LookupVariable("reexport.ExportedTestVar")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if v != ExportedTestVar {
+		t.Errorf("incorrect variable, want %s, got %s", ExportedTestVar, v)
+	}
+
+	if !scope.IsRuleVisible(ExportedTestRule) {
+		t.Error("expected re-exported rule to be visible")
+	}
+	if !scope.IsPoolVisible(ExportedTestPool) {
+		t.Error("expected re-exported pool to be visible")
+	}
+	if scope.IsRuleVisible(pctxTestRule) {
+		t.Error("expected unexported rule not to be visible")
+	}
+}
+
+func TestVariableConfigMethodArgs(t *testing.T) {
+	config := pctxTestConfig{prefix: "-march="}
+	for v, want := range map[Variable]string{
+		armArch:   "-march=arm",
+		arm64Arch: "-march=arm64",
+	} {
+		value, err := v.value(config)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if g := value.Value(nil); g != want {
+			t.Errorf("incorrect value for %s, want %q, got %q", v, want, g)
+		}
+	}
+}
+
+func TestVariableConfigMethodError(t *testing.T) {
+	value, err := prefixVar.value(pctxTestConfig{prefix: "-march="})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if g, w := value.Value(nil), "-march="; g != w {
+		t.Errorf("incorrect value for %s, want %q, got %q", prefixVar, w, g)
+	}
+
+	_, err = prefixVar.value(pctxTestConfig{})
+	if err == nil {
+		t.Fatalf("expected an error for %s", prefixVar)
+	}
+	want := "error evaluating variable github.com/google/blueprint/pctx_test.prefixVar: no prefix"
+	if err.Error() != want {
+		t.Errorf("incorrect error, want %q, got %q", want, err)
+	}
+
+	_, err = validateVariableMethod("badMethod", reflect.ValueOf(func(pctxTestConfig) (string, int) {
+		return "", 0
+	}), nil)
+	if err == nil {
+		t.Errorf("expected an error for a method whose second output is not an error")
+	}
+}
+
+func TestVariableConfigMethodReceiver(t *testing.T) {
+	clearConfigCaches()
+	defer clearConfigCaches()
+
+	for _, tc := range []struct {
+		v      Variable
+		config interface{}
+		want   string
+		err    string
+	}{
+		{arm64Arch, pctxTestConfig{prefix: "-march="}, "-march=arm64", ""},
+		{arm64Arch, &pctxTestConfig{prefix: "-march="}, "-march=arm64", ""},
+		{ptrPrefixVar, &pctxTestConfig{prefix: "-x"}, "ptr-x", ""},
+		{ptrPrefixVar, pctxTestConfig{prefix: "-x"}, "",
+			"the method has a pointer receiver and takes a *blueprint.pctxTestConfig, " +
+				"but the config object is a blueprint.pctxTestConfig value"},
+		{arm64Arch, (*pctxTestConfig)(nil), "",
+			"the method takes a blueprint.pctxTestConfig, but the config object is a nil *blueprint.pctxTestConfig"},
+		{arm64Arch, nil, "",
+			"the method takes a blueprint.pctxTestConfig, but the config object is nil"},
+		{arm64Arch, "config", "",
+			"the method takes a blueprint.pctxTestConfig, but the config object is a string"},
+	} {
+		value, err := tc.v.value(tc.config)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s with %#v: expected error containing %q, got %v", tc.v, tc.config, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s with %#v: unexpected error: %s", tc.v, tc.config, err)
+			continue
+		}
+		if g := value.Value(nil); g != tc.want {
+			t.Errorf("%s with %#v: want %q, got %q", tc.v, tc.config, tc.want, g)
+		}
+	}
+}
+
+func TestVariableFuncCache(t *testing.T) {
+	clearConfigCaches()
+	cachedFuncCalls = 0
+
+	a, b := "a", "b"
+	for _, config := range []*string{&a, &b, &a, &b} {
+		value, err := cachedFunc.value(config)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if g, w := value.Value(nil), *config; g != w {
+			t.Errorf("incorrect value, want %q, got %q", w, g)
+		}
+	}
+	if cachedFuncCalls != 2 {
+		t.Errorf("expected 2 calls, got %d", cachedFuncCalls)
+	}
+
+	clearConfigCaches()
+	cachedFunc.value(&a)
+	if cachedFuncCalls != 3 {
+		t.Errorf("expected 3 calls after clearing the cache, got %d", cachedFuncCalls)
+	}
+}
+
+func TestRuleFuncCache(t *testing.T) {
+	clearConfigCaches()
+	cachedRuleCalls = 0
+
+	a, b := "a", "b"
+	for _, config := range []*string{&a, &b, &a, &b} {
+		def, err := cachedRule.def(config)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if g, w := def.Variables["command"].Value(nil), "echo "+*config; g != w {
+			t.Errorf("incorrect command, want %q, got %q", w, g)
+		}
+	}
+	if cachedRuleCalls != 2 {
+		t.Errorf("expected 2 calls, got %d", cachedRuleCalls)
+	}
+
+	clearConfigCaches()
+	cachedRule.def(&a)
+	if cachedRuleCalls != 3 {
+		t.Errorf("expected 3 calls after clearing the cache, got %d", cachedRuleCalls)
+	}
+}
+
+func TestSelectRule(t *testing.T) {
+	for _, tool := range []string{"gcc", "clang"} {
+		tool := tool
+		_, out := writePctxTest(t, &tool, func(ctx ModuleContext) {
+			ctx.Build(pctxTest, BuildParams{
+				Rule:    selectedToolRule,
+				Outputs: []string{"out"},
+				Inputs:  []string{"in"},
+				Args:    map[string]string{"flags": "-O2"},
+			})
+		})
+
+		for _, want := range []string{
+			"rule g.pctx_test." + tool + "Rule\n",
+			"build out: g.pctx_test." + tool + "Rule in\n    flags = -O2\n",
+		} {
+			if !strings.Contains(out, want) {
+				t.Errorf("%s: expected %q in output:\n%s", tool, want, out)
+			}
+		}
+		if strings.Contains(out, "selectedToolRule") {
+			t.Errorf("%s: unexpected selectedToolRule in output:\n%s", tool, out)
+		}
+	}
+
+	for _, tc := range []struct {
+		tool string
+		err  string
+	}{
+		{"unknown", `unknown toolchain "unknown"`},
+		{"cached", `does not accept the argument "flags"`},
+	} {
+		tool := tc.tool
+		_, errs := runPctxTest(t, &tool, func(ctx ModuleContext) {
+			ctx.Build(pctxTest, BuildParams{
+				Rule:    selectedToolRule,
+				Outputs: []string{"out"},
+			})
+		})
+		if len(errs) == 0 || !strings.Contains(errs[0].Error(), tc.err) {
+			t.Errorf("%s: expected error containing %q, got %v", tc.tool, tc.err, errs)
+		}
+	}
+
+	for _, tc := range []struct {
+		tool string
+		rule Rule
+		err  string
+	}{
+		{"gcc", gccRule, ""},
+		{"clang", clangRule, ""},
+		{"unknown", nil, `unknown toolchain "unknown"`},
+		{"cached", nil, `does not accept the argument "flags"`},
+	} {
+		tool := tc.tool
+		rule, err := selectedToolRule.Select(&tool)
+		if tc.err == "" {
+			if err != nil || rule != tc.rule {
+				t.Errorf("%s: expected %s, got %v, %v", tc.tool, tc.rule, rule, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected error containing %q, got %v", tc.tool, tc.err, err)
+		}
+	}
+}
+
+func TestStaticVariableValue(t *testing.T) {
+	for _, tc := range []struct {
+		v     Variable
+		value string
+		ok    bool
+	}{
+		{dynBase, "-O2", true},
+		{dynFlags, "", false},
+		{overriddenVar, "overridden ${dynBase}", true},
+		{dynArch, "", false},
+		{&argVariable{"out"}, "", false},
+	} {
+		value, ok := StaticVariableValue(tc.v)
+		if value != tc.value || ok != tc.ok {
+			t.Errorf("%s: want %q, %t, got %q, %t", tc.v, tc.value, tc.ok, value, ok)
+		}
+	}
+}
+
+func TestRuleArgNames(t *testing.T) {
+	for _, tc := range []struct {
+		r        Rule
+		argNames []string
+	}{
+		{pctxTestDefaultsRule, []string{"dynBase", "extra", "opt"}},
+		{pctxTestDerivedDefaultsRule, []string{"dynBase", "extra", "opt"}},
+		{ExportedTestRule, nil},
+		{Phony, nil},
+	} {
+		if g := RuleArgNames(tc.r); !reflect.DeepEqual(g, tc.argNames) {
+			t.Errorf("%s: want %q, got %q", tc.r, tc.argNames, g)
+		}
+	}
+}
+
+func TestConcatVariable(t *testing.T) {
+	value, err := concatVar.value("armv8-a")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The variables referenced by the parts are not expanded.
+	pkgNames := map[*packageContext]string{pctxTest.(*packageContext): "pctx_test"}
+	if g, w := value.Value(pkgNames), "-march=armv8-a ${g.pctx_test.deprecatedVar}/ref -O2"; g != w {
+		t.Errorf("incorrect value, want %q, got %q", w, g)
+	}
+
+	resolved, err := resolveVariable(concatVar, "armv8-a", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if g, w := resolved, "-march=armv8-a old/ref -O2"; g != w {
+		t.Errorf("incorrect resolved value, want %q, got %q", w, g)
+	}
+
+	want := `rule argument "in" cannot be part of variable "concatArgVar"`
+	if err, ok := concatArgPanic.(error); !ok || err.Error() != want {
+		t.Errorf("expected panic %q, got %v", want, concatArgPanic)
+	}
+}
+
+func TestStaticVariableJoin(t *testing.T) {
+	value, ok := StaticVariableValue(joinVar)
+	if w := "a$$:$$${dynBase}:$$b"; !ok || value != w {
+		t.Errorf("incorrect value, want %q, got %q", w, value)
+	}
+
+	resolved, err := resolveVariable(joinVar, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if w := "a$$:$$-O2:$$b"; resolved != w {
+		t.Errorf("incorrect resolved value, want %q, got %q", w, resolved)
+	}
+
+	want := `error parsing fragment "a$" of variable "joinBadVar": ` +
+		`unexpected end of string after '$'`
+	if err, ok := joinFragmentPanic.(error); !ok || err.Error() != want {
+		t.Errorf("expected panic %q, got %v", want, joinFragmentPanic)
+	}
+}
+
+func TestSegmentedRule(t *testing.T) {
+	def, err := segmentedRule.def(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	pkgNames := map[*packageContext]string{pctxTest.(*packageContext): "pctx_test"}
+	want := "cc ${flags} ${g.pctx_test.dynBase} -c ${in} -o ${out}"
+	if g := def.Variables["command"].Value(pkgNames); g != want {
+		t.Errorf("incorrect command, want %q, got %q", want, g)
+	}
+	if g, w := def.Variables["description"].Value(pkgNames), "cc ${out}"; g != w {
+		t.Errorf("incorrect description, want %q, got %q", w, g)
+	}
+	if def.Variables["restat"] == nil {
+		t.Errorf("expected restat to be set")
+	}
+	if g, w := RuleArgNames(segmentedRule), []string{"flags"}; !reflect.DeepEqual(g, w) {
+		t.Errorf("incorrect arguments, want %q, got %q", w, g)
+	}
+	if g := RuleSegments(segmentedRule); !reflect.DeepEqual(g, segmentedRuleSegments) {
+		t.Errorf("incorrect segments, want %q, got %q", segmentedRuleSegments, g)
+	}
+	if g := RuleSegments(pctxTestRule); g != nil {
+		t.Errorf("expected no segments for a static rule, got %q", g)
+	}
+
+	for i, want := range []string{
+		`rule "badSegmentedRule" has more than one segment named "tool"`,
+		`error parsing segment "tool" of rule "badSegmentedRule": unexpected end of string after '$'`,
+		`invalid segment name for rule "badSegmentedRule": "bad name" contains an invalid Ninja name character ' ' at byte offset 3`,
+		`rule "badSegmentedRule" has no segments with a command`,
+		`rule "badSegmentedRule" sets both a Command and segments`,
+	} {
+		if err, ok := segmentPanics[i].(error); !ok || err.Error() != want {
+			t.Errorf("expected panic %q, got %v", want, segmentPanics[i])
+		}
+	}
+}
+
+func TestMapVariable(t *testing.T) {
+	pkgNames := map[*packageContext]string{pctxTest.(*packageContext): "pctx_test"}
+	for _, tc := range []struct {
+		v      Variable
+		prefix string
+		value  string
+		err    string
+	}{
+		{mapVar, "arm-", "aapcs", ""},
+		{mapVar, "mips-", "o32 ${g.pctx_test.dynBase}", ""},
+		{mapVar, "x86-", "", `variable github.com/google/blueprint/pctx_test.mapVar ` +
+			`has no value for key "x86-" and no default value, the keys are ["arm-" "mips-"]`},
+		{mapVar, "", "", `error evaluating variable github.com/google/blueprint/pctx_test.mapVar: ` +
+			`no prefix`},
+		{mapDefaultVar, "arm-", "aapcs", ""},
+		{mapDefaultVar, "x86-", "sysv", ""},
+	} {
+		value, err := tc.v.value(pctxTestConfig{prefix: tc.prefix})
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s %q: expected error %q, got %v", tc.v, tc.prefix, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %q: unexpected error: %s", tc.v, tc.prefix, err)
+		} else if g := value.Value(pkgNames); g != tc.value {
+			t.Errorf("%s %q: incorrect value, want %q, got %q", tc.v, tc.prefix, tc.value, g)
+		}
+	}
+
+	want := "method for variable mapBadVar has 2 inputs (should be 1)"
+	if err, ok := mapPanic.(error); !ok || err.Error() != want {
+		t.Errorf("expected panic %q, got %v", want, mapPanic)
+	}
+}
+
+func TestFlavoredVariable(t *testing.T) {
+	defer SetGenerationFlavor("")
+
+	pkgNames := map[*packageContext]string{pctxTest.(*packageContext): "pctx_test"}
+	for _, tc := range []struct {
+		v      Variable
+		flavor string
+		value  string
+		err    string
+	}{
+		{flavoredVar, "debug", "-O0 -g", ""},
+		{flavoredVar, "release", "-O2 ${g.pctx_test.dynBase}", ""},
+		{flavoredVar, "asan", "", `variable github.com/google/blueprint/pctx_test.flavoredVar ` +
+			`has no value for flavor "asan" and no default value, the flavors are ["debug" "release"]`},
+		{flavoredVar, "", "", `variable github.com/google/blueprint/pctx_test.flavoredVar ` +
+			`has no value for flavor "" and no default value, the flavors are ["debug" "release"]`},
+		{flavoredDefaultVar, "debug", "-g", ""},
+		{flavoredDefaultVar, "release", "-s", ""},
+		{flavoredDefaultVar, "", "-s", ""},
+	} {
+		SetGenerationFlavor(tc.flavor)
+		value, err := tc.v.value(nil)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s %q: expected error %q, got %v", tc.v, tc.flavor, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %q: unexpected error: %s", tc.v, tc.flavor, err)
+		} else if g := value.Value(pkgNames); g != tc.value {
+			t.Errorf("%s %q: incorrect value, want %q, got %q", tc.v, tc.flavor, tc.value, g)
+		}
+	}
+}
+
+func TestRegistrationObserver(t *testing.T) {
+	const pkgPath = "github.com/google/blueprint/pctx_observed_test"
+	want := []string{
+		"variable " + pkgPath + " observedVar",
+		"pool " + pkgPath + " observedPool",
+		"rule " + pkgPath + " observedRule",
+		"variable " + pkgPath + " observedFunc",
+	}
+	if !reflect.DeepEqual(registrations, want) {
+		t.Errorf("incorrect registrations, want %q, got %q", want, registrations)
+	}
+
+	var types []string
+	SetRegistrationObserver(func(kind, pkgPath, name string) {
+		types = append(types, kind+" "+pkgPath+" "+name)
+	})
+	defer SetRegistrationObserver(nil)
+
+	ctx := NewContext()
+	ctx.RegisterModuleType("foo_module", newFooModule)
+	ctx.RegisterModuleType("bar_module", newBarModule)
+	ctx.RegisterModuleTypeAlias("old_foo_module", "foo_module")
+	ctx.CloneModuleType("bar_module", "host_bar_module")
+
+	want = []string{
+		"module type github.com/google/blueprint foo_module",
+		"module type github.com/google/blueprint bar_module",
+		"module type alias github.com/google/blueprint old_foo_module",
+		"module type github.com/google/blueprint host_bar_module",
+	}
+	if !reflect.DeepEqual(types, want) {
+		t.Errorf("incorrect module type registrations, want %q, got %q", want, types)
+	}
+}
+
+func TestResolveVariable(t *testing.T) {
+	for _, tc := range []struct {
+		v      Variable
+		config interface{}
+		want   string
+	}{
+		{ccFlags, nil, "clang-12 -O2"},
+		{dynFlags, "armv8-a", "-O2 -march=armv8-a"},
+		{joinVar, nil, "a$:$-O2:$b"},
+		{NewTestPackage("example.com/resolve").AddStaticVariable("spaced", " -DX=$$y"), nil, " -DX=$y"},
+	} {
+		value, err := ResolveVariable(tc.v, tc.config)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.v, err)
+		} else if value != tc.want {
+			t.Errorf("%s: incorrect value, want %q, got %q", tc.v, tc.want, value)
+		}
+	}
+
+	if _, err := ResolveVariable(&argVariable{"in"}, nil); err != errVariableIsArg {
+		t.Errorf("want %v, got %v", errVariableIsArg, err)
+	}
+
+	_, err := ResolveVariable(dynCycleRef, nil)
+	if err == nil || !strings.Contains(err.Error(), "detected variable reference cycle") {
+		t.Errorf("expected a reference cycle error, got %v", err)
+	}
+}
+
+func TestImportPrefix(t *testing.T) {
+	value, err := ResolveVariable(tcFlags, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if w := "-marm -m32 -O2"; value != w {
+		t.Errorf("incorrect value, want %q, got %q", w, value)
+	}
+
+	scope := pctxTcUser.(*packageContext).scope
+	if _, err := scope.LookupVariable("pctx_tcx.TcxFlags"); err == nil {
+		t.Errorf("expected pctx_tcx not to be imported")
+	}
+
+	for i, want := range []string{
+		`no package with a context has the path prefix "github.com/google/blueprint/pctx_none"`,
+		`cannot import packages "github.com/google/blueprint/pctx_dup/a/util" and ` +
+			`"github.com/google/blueprint/pctx_dup/b/util" with the path prefix ` +
+			`"github.com/google/blueprint/pctx_dup": both are named "util" ` +
+			`(use ImportAs for one of them)`,
+		`cannot import package "github.com/google/blueprint/pctx_clash/arm" as "arm": ` +
+			`package "github.com/google/blueprint/pctx_tc/arm" is already imported as ` +
+			`"arm" (use ImportAs to choose a different name)`,
+	} {
+		if err, ok := importPrefixPanics[i].(error); !ok || err.Error() != want {
+			t.Errorf("%d: expected panic %q, got %v", i, want, importPrefixPanics[i])
+		}
+	}
+	for _, name := range []string{"util", "zlib"} {
+		if _, present := pctxTcUser.(*packageContext).imports[name]; present {
+			t.Errorf("expected no %s package to be imported", name)
+		}
+	}
+}
+
+func TestToolchain(t *testing.T) {
+	value, err := resolveVariable(ccFlags, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if w := "clang-12 -O2"; value != w {
+		t.Errorf("incorrect value for %s, want %q, got %q", ccFlags, w, value)
+	}
+
+	scope := pctxToolchainUser.(*packageContext).scope
+	if !scope.IsRuleVisible(ccRule) || !scope.IsPoolVisible(ccPool) {
+		t.Errorf("expected the rule and the pool of the toolchain to be visible")
+	}
+	if _, err := scope.LookupVariable("CcOther"); err == nil {
+		t.Errorf("expected CcOther not to be imported")
+	}
+
+	const pkg = `package "github.com/google/blueprint/pctx_toolchain_test"`
+	for i, want := range []string{
+		`toolchain "cc" is already defined in ` + pkg,
+		`member 1 of toolchain "bad" of ` + pkg + ` is a string, not a Variable, Rule, or Pool`,
+		`member 1 of toolchain "bad" of ` + pkg + ` is listed more than once`,
+		`member 0 of toolchain "bad" of ` + pkg + ` is not a variable of the package: ` +
+			`github.com/google/blueprint/pctx_test.ExportedTestVar`,
+		pkg + ` has no toolchain "ld"`,
+		`cannot import toolchain "cc" of ` + pkg + ` into ` +
+			`"github.com/google/blueprint/pctx_toolchain_user": ` +
+			`variable "CcCompiler" is already defined in this scope`,
+	} {
+		if err, ok := toolchainPanics[i].(error); !ok || err.Error() != want {
+			t.Errorf("%d: expected panic %q, got %v", i, want, toolchainPanics[i])
+		}
+	}
+}
+
+func TestEvaluationErrorModule(t *testing.T) {
+	_, errs := runPctxTest(t, pctxTestConfig{prefix: "x86-"}, func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestRule,
+			Outputs: []string{"${mapVar}/out"},
+		})
+	})
+	want := `while generating build actions for module "A": ` +
+		`variable github.com/google/blueprint/pctx_test.mapVar has no value for key "x86-" ` +
+		`and no default value, the keys are ["arm-" "mips-"]`
+	if len(errs) != 1 || errs[0].Error() != want {
+		t.Errorf("expected error %q, got %v", want, errs)
+	}
+}
+
+func TestImportedPool(t *testing.T) {
+	_, out := writePctxTest(t, nil, func(ctx ModuleContext) {
+		ctx.Build(pctxPoolUser, BuildParams{
+			Rule:    sharedPoolRule,
+			Outputs: []string{"rule_pool"},
+		})
+		ctx.Build(pctxPoolUser, BuildParams{
+			Rule:    sharedPoolFuncRule,
+			Outputs: []string{"func_rule_pool"},
+		})
+		ctx.Build(pctxPoolUser, BuildParams{
+			Rule:    noPoolRule,
+			Pool:    SharedPool,
+			Outputs: []string{"build_pool"},
+		})
+	})
+	for _, want := range []string{
+		"pool g.owner.SharedPool\n    depth = 3\n",
+		"rule g.pctx_pool_user.sharedPoolRule\n    pool = g.owner.SharedPool\n",
+		"rule g.pctx_pool_user.sharedPoolFuncRule\n    pool = g.owner.SharedPool\n",
+		"build build_pool: g.pctx_pool_user.noPoolRule\n    pool = g.owner.SharedPool\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in output:\n%s", want, out)
+		}
+	}
+}
+
+func TestPackageNameMangler(t *testing.T) {
+	if g, w := pctxMangledTest.(*packageContext).fullName, "pctx_mangled_test"; g != w {
+		t.Errorf("incorrect mangled name, want %q, got %q", w, g)
+	}
+
+	want := `packages "github.com/google/blueprint/vendor/pctx_mangled_test" and ` +
+		`"pctx_mangled_test" both have the Ninja name "pctx_mangled_test", one of ` +
+		`them must be renamed`
+	if err, ok := manglerPanic.(error); !ok || err.Error() != want {
+		t.Errorf("expected panic %q, got %v", want, manglerPanic)
+	}
+
+	SetPackageNameMangler(func(pkgPath string) string { return "bad name" })
+	defer SetPackageNameMangler(nil)
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("expected a panic for an invalid mangled name")
+		}
+	}()
+	NewTestPackage("example.com/mangled")
+}
+
+func TestPoolDepth(t *testing.T) {
+	pkg := NewTestPackage("example.com/pooldepth")
+	for _, depth := range []int{0, -1} {
+		func() {
+			defer func() {
+				r := recover()
+				if err, ok := r.(error); !ok || !strings.Contains(err.Error(), "pool badPool") {
+					t.Errorf("depth %d: expected a panic naming the pool, got %v", depth, r)
+				}
+			}()
+			pkg.AddStaticPool("badPool", PoolParams{Depth: depth})
+		}()
+	}
+
+	pool := &poolFunc{pkg.pctx, "badPoolFunc", func(interface{}) (PoolParams, error) {
+		return PoolParams{Depth: 0}, nil
+	}}
+	_, err := pool.def(nil)
+	if err == nil || !strings.Contains(err.Error(), "pool depth must be at least 1, got 0") {
+		t.Errorf("expected a depth error, got %v", err)
+	}
+}
+
+func TestBuildPathEscaping(t *testing.T) {
+	_, out := writePctxTest(t, nil, func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:      pctxTestRule,
+			Outputs:   []string{"a b.o", "a$$b.o", "a:b.o"},
+			Inputs:    []string{"c d", "c$$d", "c:d"},
+			Implicits: []string{"e:f"},
+		})
+	})
+
+	for _, want := range []string{
+		"build a$ b.o a$$b.o a$:b.o: g.pctx_test.pctxTestRule c$ d c$$d c$:d | e$:f\n",
+		"default a$ b.o a$$b.o a$:b.o\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in output:\n%s", want, out)
+		}
+	}
+}
+
+func TestValidations(t *testing.T) {
+	_, out := writePctxTest(t, nil, func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestRule,
+			Outputs: []string{"lint"},
+		})
+		ctx.Build(pctxTest, BuildParams{
+			Rule:        pctxTestRule,
+			Outputs:     []string{"out"},
+			Validations: []string{"lint", "lint report"},
+		})
+	})
+	for _, want := range []string{
+		"build out: g.pctx_test.pctxTestRule |@ lint lint$ report\n",
+		"ninja_required_version = 1.11.0\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in output:\n%s", want, out)
+		}
+	}
+
+	_, out = writePctxTest(t, nil, func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestRule,
+			Outputs: []string{"out"},
+		})
+	})
+	if want := "ninja_required_version = 1.7.0\n"; !strings.Contains(out, want) {
+		t.Errorf("expected %q in output:\n%s", want, out)
+	}
+
+	for _, tc := range []struct {
+		validations []string
+		err         string
+	}{
+		{[]string{"lint", ""}, "error parsing Validations param: element 1 is empty"},
+		{[]string{"lint$"}, "error parsing Validations param: error parsing element 0:"},
+	} {
+		_, errs := runPctxTest(t, nil, func(ctx ModuleContext) {
+			ctx.Build(pctxTest, BuildParams{
+				Rule:        pctxTestRule,
+				Outputs:     []string{"out"},
+				Validations: tc.validations,
+			})
+		})
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), tc.err) {
+			t.Errorf("%q: expected error containing %q, got %v", tc.validations, tc.err, errs)
+		}
+	}
+}
+
+func TestAlwaysRun(t *testing.T) {
+	_, out := writePctxTest(t, nil, func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:      alwaysRunRule,
+			Outputs:   []string{"stamp"},
+			Implicits: []string{"dep"},
+		})
+	})
+
+	for _, want := range []string{
+		"build stamp: g.pctx_test.alwaysRunRule | dep _blueprint_always_run\n",
+		"build _blueprint_always_run: phony\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in output:\n%s", want, out)
+		}
+	}
+
+	_, out = writePctxTest(t, nil, func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestRule,
+			Outputs: []string{"out"},
+		})
+	})
+	if strings.Contains(out, "_blueprint_always_run") {
+		t.Errorf("unexpected always run target in output:\n%s", out)
+	}
+
+	for _, params := range []BuildParams{
+		{Rule: pctxTestRule, Outputs: []string{"_blueprint_always_run"}},
+		{Rule: pctxTestRule, Outputs: []string{"out"}, ImplicitOutputs: []string{"_blueprint_always_run"}},
+	} {
+		params := params
+		_, errs := runPctxTest(t, nil, func(ctx ModuleContext) {
+			ctx.Build(pctxTest, params)
+		})
+		const want = `output "_blueprint_always_run" is reserved`
+		if len(errs) == 0 || !strings.Contains(errs[0].Error(), want) {
+			t.Errorf("expected an error containing %q, got %v", want, errs)
+		}
+	}
+
+	want := "AlwaysRun cannot be used with Restat"
+	if alwaysRunRestatErr == nil || !strings.Contains(alwaysRunRestatErr.Error(), want) {
+		t.Errorf("expected error containing %q, got %v", want, alwaysRunRestatErr)
+	}
+	_, err := alwaysRunRestatFunc.def(nil)
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("expected error containing %q, got %v", want, err)
+	}
+}
+
+func TestOutputExtension(t *testing.T) {
+	_, out := writePctxTest(t, nil, func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestProtoRule,
+			Outputs: []string{"a.pb.go", "${dynBase}/b.pb.go"},
+		})
+	})
+	want := "build a.pb.go ${g.pctx_test.dynBase}/b.pb.go: g.pctx_test.pctxTestProtoRule\n"
+	if !strings.Contains(out, want) {
+		t.Errorf("expected %q in output:\n%s", want, out)
+	}
+
+	_, errs := runPctxTest(t, nil, func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestProtoRule,
+			Outputs: []string{"a.pb.go", "b.go"},
+		})
+	})
+	want = `while generating build actions for module "A": ` +
+		`output "b.go" of rule github.com/google/blueprint/pctx_test.pctxTestProtoRule ` +
+		`does not have the extension ".pb.go"`
+	if len(errs) != 1 || errs[0].Error() != want {
+		t.Errorf("expected error %q, got %v", want, errs)
+	}
+
+	want = `invalid RuleParams for rule "tryExtRule": OutputExtension param ".$ext" ` +
+		`contains a '$' character`
+	if outputExtensionErr == nil || outputExtensionErr.Error() != want {
+		t.Errorf("expected error %q, got %v", want, outputExtensionErr)
+	}
+
+	want = "invalid RuleParams for github.com/google/blueprint/pctx_test.outputExtensionFunc: " +
+		`OutputExtension param ".$ext" contains a '$' character`
+	if _, err := outputExtensionFunc.def(nil); err == nil || err.Error() != want {
+		t.Errorf("expected error %q, got %v", want, err)
+	}
+}
+
+func TestProfiling(t *testing.T) {
+	generate := func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestPoolRule,
+			Outputs: []string{"${dynBase}/out"},
+		})
+	}
+
+	SetProfilingEnabled(true)
+	defer SetProfilingEnabled(false)
+
+	writePctxTest(t, nil, generate)
+	stats := ProfilingStats()
+	for name, stat := range map[string]ProfilingStat{
+		"VariableValues":    stats.VariableValues,
+		"RuleDefs":          stats.RuleDefs,
+		"PoolDefs":          stats.PoolDefs,
+		"NinjaStringParses": stats.NinjaStringParses,
+	} {
+		if stat.Count == 0 {
+			t.Errorf("expected %s to be recorded, got %+v", name, stat)
+		}
+	}
+
+	SetProfilingEnabled(false)
+	writePctxTest(t, nil, generate)
+	if g := ProfilingStats(); g != stats {
+		t.Errorf("expected no statistics recorded while disabled, want %+v, got %+v", stats, g)
+	}
+
+	SetProfilingEnabled(true)
+	if g := ProfilingStats(); g != (GenerationProfile{}) {
+		t.Errorf("expected enabling profiling to reset the statistics, got %+v", g)
+	}
+}
+
+func TestMultiLineValues(t *testing.T) {
+	_, out := writePctxTest(t, nil, func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    validatedRule,
+			Outputs: []string{"out"},
+			Args:    map[string]string{"flags": "-a\n-b $\n    -c\n", "mode": "32"},
+		})
+	})
+	// The trailing newline of flags ends with an indented empty line, so
+	// Ninja reads mode on the next line as a separate variable.
+	want := "    flags = -a $\n    -b -c $\n    \n    mode = 32\n"
+	if !strings.Contains(out, want) {
+		t.Errorf("expected %q in output:\n%s", want, out)
+	}
+
+	_, out = writePctxTest(t, nil, func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestMultiLineRule,
+			Inputs:  []string{"in"},
+			Outputs: []string{"out"},
+		})
+	})
+	want = "rule g.pctx_test.pctxTestMultiLineRule\n" +
+		"    command = mkdir -p ${out}.d && $\n    cp ${in} ${out}\n"
+	if !strings.Contains(out, want) {
+		t.Errorf("expected %q in output:\n%s", want, out)
+	}
+}
+
+func TestEnvVariable(t *testing.T) {
+	const envKey = "BLUEPRINT_PCTX_TEST_ENV"
+	defer os.Unsetenv(envKey)
+
+	for _, tc := range []struct {
+		set   bool
+		env   string
+		value string
+	}{
+		{false, "", "default"},
+		{true, "", ""},
+		{true, "cc $x", "cc $$x"},
+	} {
+		if tc.set {
+			os.Setenv(envKey, tc.env)
+		} else {
+			os.Unsetenv(envKey)
+		}
+
+		value, err := envVar.value(nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if g, w := value.Value(nil), tc.value; g != w {
+			t.Errorf("incorrect value for %q, want %q, got %q", tc.env, w, g)
+		}
+
+		if deps := EnvDeps(); deps[envKey] != tc.env {
+			t.Errorf("expected env dep %s=%q, got %q", envKey, tc.env, deps[envKey])
+		}
+	}
+}
+
+func TestPassthroughEnv(t *testing.T) {
+	const setKey = "BLUEPRINT_PCTX_TEST_PASSTHROUGH"
+	const unsetKey = "BLUEPRINT_PCTX_TEST_PASSTHROUGH_UNSET"
+	os.Setenv(setKey, "it's $HOME")
+	defer os.Unsetenv(setKey)
+	os.Unsetenv(unsetKey)
+
+	pkg := NewTestPackage("example.com/passthrough")
+	rule := pkg.AddStaticRule("rule", RuleParams{
+		Command:        "cc ${in} -o ${out}",
+		PassthroughEnv: []string{setKey, unsetKey},
+	})
+
+	bindings, err := pkg.RuleBindings(rule, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `export ` + setKey + `='it'\''s $$HOME' && cc ${in} -o ${out}`
+	if g := bindings["command"]; g != want {
+		t.Errorf("incorrect command:\nwant: %q\n got: %q", want, g)
+	}
+
+	deps := EnvDeps()
+	if value, ok := deps[setKey]; !ok || value != "it's $HOME" {
+		t.Errorf("expected env dep %s=%q, got %q", setKey, "it's $HOME", value)
+	}
+	if value, ok := deps[unsetKey]; !ok || value != "" {
+		t.Errorf("expected empty env dep %s, got %q", unsetKey, value)
+	}
+
+	for i, tc := range []struct {
+		env []string
+		err string
+	}{
+		{[]string{"1FOO"}, `"1FOO" is not a valid environment variable name`},
+		{[]string{"FOO-BAR"}, `"FOO-BAR" is not a valid environment variable name`},
+		{[]string{""}, "empty environment variable name"},
+		{[]string{"FOO", "FOO"}, `PassthroughEnv param lists "FOO" more than once`},
+	} {
+		func() {
+			defer func() {
+				r := recover()
+				if err, ok := r.(error); !ok || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("%q: expected a panic containing %q, got %v", tc.env, tc.err, r)
+				}
+			}()
+			pkg.AddStaticRule("badRule"+strconv.Itoa(i), RuleParams{
+				Command:        "true",
+				PassthroughEnv: tc.env,
+			})
+		}()
+
+		const prefix = "invalid RuleParams for github.com/google/blueprint/pctx_test.passthroughEnvFunc: "
+		_, err := passthroughEnvFunc.def(tc.env)
+		if err == nil || !strings.HasPrefix(err.Error(), prefix) || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%q: expected error %q containing %q, got %v", tc.env, prefix, tc.err, err)
+		}
+	}
+}
+
+func TestPoolNotVisible(t *testing.T) {
+	const want = `Pool github.com/google/blueprint/pctx_fingerprint_test.fingerprintPool ` +
+		`is not visible in this scope, it is defined by package ` +
+		`"github.com/google/blueprint/pctx_fingerprint_test" which must be imported to use it`
+
+	_, errs := runPctxTest(t, nil, func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestPoolRule,
+			Pool:    fingerprintPool,
+			Outputs: []string{"out"},
+		})
+	})
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), want) {
+		t.Errorf("expected error %q, got %v", want, errs)
+	}
+
+	pkg := NewTestPackage("example.com/poolvisibility")
+	rule := pkg.AddStaticRule("rule", RuleParams{
+		Command: "true",
+		Pool:    fingerprintPool,
+	})
+	defer func() {
+		r := recover()
+		err, ok := r.(error)
+		if !ok || !strings.Contains(err.Error(), "example.com/poolvisibility.rule") ||
+			!strings.Contains(err.Error(), want) {
+			t.Errorf("expected a panic naming the rule with %q, got %v", want, r)
+		}
+	}()
+	pkg.RuleBindings(rule, nil)
+}
+
+func TestCompositePool(t *testing.T) {
+	_, out := writePctxTest(t, nil, func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestPoolRule,
+			Pool:    nestedTestPool,
+			Outputs: []string{"out"},
+		})
+	})
+
+	if want := "pool g.pctx_test.nestedTestPool\n    depth = 7\n"; !strings.Contains(out, want) {
+		t.Errorf("missing %q in output:\n%s", want, out)
+	}
+	if strings.Contains(out, "pool g.pctx_test.compositeTestPool\n") {
+		t.Errorf("unexpected definition of an unused child pool in output:\n%s", out)
+	}
+}
+
+func TestRuleArgChecks(t *testing.T) {
+	for _, tc := range []struct {
+		args map[string]string
+		err  string
+	}{
+		{map[string]string{"mode": "32", "flags": "-O2"}, ""},
+		{map[string]string{"mode": "32"}, ""},
+		{map[string]string{"flags": "-O2"},
+			`missing required argument "mode" of rule github.com/google/blueprint/pctx_test.validatedRule`},
+		{map[string]string{"mode": "32", "flags": ""},
+			`invalid value "" for argument "flags" of rule ` +
+				`github.com/google/blueprint/pctx_test.validatedRule: must not be empty`},
+	} {
+		_, errs := runPctxTest(t, nil, func(ctx ModuleContext) {
+			ctx.Build(pctxTest, BuildParams{
+				Rule:    validatedRule,
+				Outputs: []string{"out"},
+				Args:    tc.args,
+			})
+		})
+		if tc.err == "" {
+			if len(errs) > 0 {
+				t.Errorf("%v: unexpected errors: %v", tc.args, errs)
+			}
+			continue
+		}
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), tc.err) {
+			t.Errorf("%v: expected error %q, got %v", tc.args, tc.err, errs)
+		}
+	}
+
+	if err, ok := requireDefaultPanic.(error); !ok ||
+		!strings.Contains(err.Error(), `argument "opt" of rule `+
+			`github.com/google/blueprint/pctx_test.pctxTestDefaultsRule has a default value`) {
+		t.Errorf("expected a panic requiring an argument with a default, got %v", requireDefaultPanic)
+	}
+
+	defer func() {
+		r := recover()
+		if err, ok := r.(error); !ok || !strings.Contains(err.Error(), `has no argument "missing"`) {
+			t.Errorf("expected a panic for an unknown argument, got %v", r)
+		}
+	}()
+	argChecksFor(validatedRule, "missing")
+}
+
+func TestUnknownArgs(t *testing.T) {
+	for _, tc := range []struct {
+		rule Rule
+		args map[string]string
+		err  string
+	}{
+		{validatedRule, map[string]string{"flag": "-O2", "mode": "arm"},
+			`unknown argument "flag" for rule github.com/google/blueprint/pctx_test.validatedRule, ` +
+				`its arguments are ["flags" "mode"]`},
+		{pctxTestRule, map[string]string{"flags": "-O2"},
+			`unknown argument "flags" for rule github.com/google/blueprint/pctx_test.pctxTestRule, ` +
+				`which has no arguments`},
+	} {
+		_, errs := runPctxTest(t, nil, func(ctx ModuleContext) {
+			ctx.Build(pctxTest, BuildParams{
+				Rule:    tc.rule,
+				Outputs: []string{"out"},
+				Args:    tc.args,
+			})
+		})
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), tc.err) {
+			t.Errorf("%s: expected error %q, got %v", tc.rule, tc.err, errs)
+		}
+	}
+}
+
+func TestExclusiveArgs(t *testing.T) {
+	const rule = "github.com/google/blueprint/pctx_test.linkRule"
+	for _, tc := range []struct {
+		args map[string]string
+		err  string
+	}{
+		{map[string]string{"static": "-static", "flags": "-s"}, ""},
+		{map[string]string{"shared": "-shared", "pie": "-pie"}, ""},
+		{map[string]string{"static": "-static", "shared": "-shared"},
+			`arguments ["static" "shared"] of rule ` + rule + ` are mutually exclusive`},
+		{map[string]string{"static": "-static", "shared": "-shared", "pie": "-pie"},
+			`arguments ["static" "shared"] of rule ` + rule + ` are mutually exclusive`},
+		{map[string]string{"static": "-static", "pie": "-pie"},
+			`arguments ["static" "pie"] of rule ` + rule + ` are mutually exclusive`},
+	} {
+		_, errs := runPctxTest(t, nil, func(ctx ModuleContext) {
+			ctx.Build(pctxTest, BuildParams{
+				Rule:    linkRule,
+				Outputs: []string{"out"},
+				Args:    tc.args,
+			})
+		})
+		if tc.err == "" {
+			if len(errs) > 0 {
+				t.Errorf("%v: unexpected errors: %v", tc.args, errs)
+			}
+			continue
+		}
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), tc.err) {
+			t.Errorf("%v: expected error %q, got %v", tc.args, tc.err, errs)
+		}
+	}
+
+	for i, want := range []string{
+		`exclusive arguments of rule ` + rule + ` must have at least two arguments, got ["static"]`,
+		`exclusive arguments of rule ` + rule + ` list "static" more than once`,
+		`argument "opt" of rule github.com/google/blueprint/pctx_test.pctxTestDefaultsRule ` +
+			`has a default value and cannot be exclusive`,
+	} {
+		if err, ok := exclusivePanics[i].(error); !ok || err.Error() != want {
+			t.Errorf("%d: expected panic %q, got %v", i, want, exclusivePanics[i])
+		}
+	}
+}
+
+func TestFileVariable(t *testing.T) {
+	defer os.Remove(fileVarPath)
+	os.Remove(fileVarPath)
+
+	_, err := fileVar.value(nil)
+	if err == nil || !strings.Contains(err.Error(), "error reading variable "+
+		"github.com/google/blueprint/pctx_file_test.fileVar") {
+		t.Errorf("expected an error reading a missing file, got %v", err)
+	}
+
+	for contents, want := range map[string]string{
+		"1.2.3\n":            "1.2.3",
+		"1.2.3\r\n":          "1.2.3",
+		"1.2.3":              "1.2.3",
+		"${fileVarBase}.1\n": "${g.pctx_file_test.fileVarBase}.1",
+	} {
+		err := ioutil.WriteFile(fileVarPath, []byte(contents), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := fileVar.value(nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		pkgNames := map[*packageContext]string{
+			pctxFileTest.(*packageContext): "pctx_file_test",
+		}
+		if g := value.Value(pkgNames); g != want {
+			t.Errorf("incorrect value for %q, want %q, got %q", contents, want, g)
+		}
+	}
+
+	if deps := pctxFileTest.(*packageContext).ninjaFileDeps; !reflect.DeepEqual(deps, []string{fileVarPath}) {
+		t.Errorf("expected Ninja file deps %q, got %q", fileVarPath, deps)
+	}
+}
+
+// pctxTestSingleton is a singleton whose build actions are supplied by the test.
+type pctxTestSingleton struct {
+	generate func(ctx SingletonContext)
+}
+
+func (s *pctxTestSingleton) GenerateBuildActions(ctx SingletonContext) {
+	s.generate(ctx)
+}
+
+func TestConfigFinalizer(t *testing.T) {
+	config := &finalizeTestConfig{value: "early"}
+
+	ctx := NewContext()
+	ctx.RegisterPreSingletonType("pre", func() Singleton {
+		return &pctxTestSingleton{func(ctx SingletonContext) {
+			ctx.Build(pctxTest, BuildParams{
+				Rule:    pctxTestPoolRule,
+				Outputs: []string{"pre"},
+				Inputs:  []string{"${finalizedVar}"},
+			})
+			ctx.Build(pctxTest, BuildParams{
+				Rule:    finalizedToolRule,
+				Outputs: []string{"pre_tool"},
+				Args: map[string]string{
+					"flags": "-O2",
+				},
+			})
+		}}
+	})
+	ctx.RegisterSingletonType("post", func() Singleton {
+		return &pctxTestSingleton{func(ctx SingletonContext) {
+			if value, _ := ctx.Eval(pctxTest, "${finalizedVar}"); value != "final" {
+				t.Errorf("expected the finalized value in the generate phase, got %q", value)
+			}
+		}}
+	})
+
+	var calls []string
+	ctx.RegisterConfigFinalizer(func(config interface{}) error {
+		calls = append(calls, "first")
+		config.(*finalizeTestConfig).value = "final"
+		return nil
+	})
+	ctx.RegisterConfigFinalizer(func(config interface{}) error {
+		calls = append(calls, "second")
+		return nil
+	})
+
+	_, errs := ctx.ResolveDependencies(config)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+	if len(calls) != 0 {
+		t.Errorf("expected no finalizer calls before PrepareBuildActions, got %q", calls)
+	}
+
+	_, errs = ctx.PrepareBuildActions(config)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if want := []string{"first", "second"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("expected finalizer calls %q, got %q", want, calls)
+	}
+
+	buf := &bytes.Buffer{}
+	err := ctx.WriteBuildFile(buf)
+	if err != nil {
+		t.Fatalf("unexpected error writing build file: %s", err)
+	}
+	if want := "g.pctx_test.finalizedVar = final\n"; !strings.Contains(buf.String(), want) {
+		t.Errorf("missing %q in output:\n%s", want, buf)
+	}
+
+	// The presingleton build uses the rule selected for the finalized config,
+	// and the rule selected before is not written.
+	if def := ctx.preSingletonInfo[0].actionDefs.buildDefs[1]; def.Rule != clangRule {
+		t.Errorf("expected the presingleton build to use %s, got %s", clangRule, def.Rule)
+	}
+	checkNinjaStatements(t, buf.String(), map[string]string{
+		"rule g.pctx_test.clangRule": "rule g.pctx_test.clangRule\n" +
+			"    command = clang ${flags} -o ${out} ${in}\n",
+		"rule g.pctx_test.gccRule": "",
+	})
+
+	ctx = NewContext()
+	ctx.RegisterConfigFinalizer(func(interface{}) error {
+		return errors.New("incomplete config")
+	})
+	_, errs = ctx.PrepareBuildActions(config)
+	if want := "error finalizing config: incomplete config"; len(errs) != 1 || errs[0].Error() != want {
+		t.Errorf("expected error %q, got %v", want, errs)
+	}
+}
+
+func TestOverrideVariable(t *testing.T) {
+	for _, v := range []Variable{overriddenVar, overriddenFunc} {
+		value, err := v.value(nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if g, w := value.strings[0], "overridden"; !strings.HasPrefix(g, w) {
+			t.Errorf("incorrect value for %s, want prefix %q, got %q", v, w, g)
+		}
+	}
+
+	value, _ := overriddenVar.value(nil)
+	if w := []Variable{dynBase}; !reflect.DeepEqual(value.variables, w) {
+		t.Errorf("incorrect variables, want %v, got %v", w, value.variables)
+	}
+}
+
+func TestRuleDefaultPool(t *testing.T) {
+	_, out := writePctxTest(t, nil, func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestPoolRule,
+			Outputs: []string{"default"},
+		})
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestPoolRule,
+			Pool:    Console,
+			Outputs: []string{"console"},
+		})
+	})
+
+	for _, want := range []string{
+		"pool g.pctx_test.pctxTestPool\n    depth = 2\n",
+		"rule g.pctx_test.pctxTestPoolRule\n    pool = g.pctx_test.pctxTestPool\n",
+		"build default: g.pctx_test.pctxTestPoolRule\n",
+		"build console: g.pctx_test.pctxTestPoolRule\n    pool = console\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in output:\n%s", want, out)
+		}
+	}
+}
+
+func TestTouchRule(t *testing.T) {
+	_, out := writePctxTest(t, nil, func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    Touch,
+			Outputs: []string{"stamp"},
+		})
+	})
+
+	for _, want := range []string{
+		"rule touch\n    command = touch ${out}\n    description = touch ${out}\n",
+		"build stamp: touch\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in output:\n%s", want, out)
+		}
+	}
+}
+
+func TestReservedRuleNames(t *testing.T) {
+	_, out := writePctxTest(t, nil, func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    Touch,
+			Outputs: []string{"stamp"},
+		})
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestTouchRule,
+			Outputs: []string{"other"},
+		})
+	})
+
+	for _, want := range []string{
+		"rule touch\n    command = touch ${out}\n",
+		"rule g.pctx_test.touch\n    command = touch -c ${out}\n",
+		"build other: g.pctx_test.touch\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in output:\n%s", want, out)
+		}
+	}
+
+	for _, name := range []string{"phony", "touch"} {
+		func() {
+			defer func() {
+				if _, ok := recover().(*InvalidNameError); !ok {
+					t.Errorf("expected an *InvalidNameError creating the built-in rule %q", name)
+				}
+			}()
+			NewBuiltinRule(name)
+		}()
+	}
+}
+
+func TestConsolePool(t *testing.T) {
+	_, out := writePctxTest(t, nil, func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestRule,
+			Pool:    Console,
+			Outputs: []string{"out"},
+		})
+	})
+
+	want := "build out: g.pctx_test.pctxTestRule\n    pool = console\n"
+	if !strings.Contains(out, want) {
+		t.Errorf("missing %q in output:\n%s", want, out)
+	}
+	if strings.Contains(out, "pool console") {
+		t.Errorf("unexpected definition of the console pool in output:\n%s", out)
+	}
+
+	if err := validatePoolName("console"); err == nil {
+		t.Errorf("expected an error for reserved pool name %q", "console")
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("expected a panic defining a pool named console")
+		}
+	}()
+	NewTestPackage("example.com/consolepkg").AddStaticPool("console", PoolParams{Depth: 1})
+}
+
+func TestImportCycle(t *testing.T) {
+	err := pctxCycleC.(*packageContext).addImport("pctx_cycle_a", pctxCycleA.(*packageContext))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	want := "import cycle detected: " +
+		"github.com/google/blueprint/pctx_cycle_c -> " +
+		"github.com/google/blueprint/pctx_cycle_a -> " +
+		"github.com/google/blueprint/pctx_cycle_b -> " +
+		"github.com/google/blueprint/pctx_cycle_c"
+	if err.Error() != want {
+		t.Errorf("expected error %q, got %q", want, err)
+	}
+	if importErr, ok := err.(*ImportError); !ok ||
+		importErr.PkgPath != "github.com/google/blueprint/pctx_cycle_a" {
+		t.Errorf("expected an *ImportError for pctx_cycle_a, got %#v", err)
+	}
+}
+
+func TestTryDefinitions(t *testing.T) {
+	if len(tryErrs) != 7 {
+		t.Fatalf("expected 7 results, got %d", len(tryErrs))
+	}
+	if tryErrs[0] != nil {
+		t.Errorf("unexpected error: %s", tryErrs[0])
+	}
+
+	var dupErr *DuplicateNameError
+	if !errors.As(tryErrs[1], &dupErr) || dupErr.Kind != "variable" || dupErr.Name != "tryVar" {
+		t.Errorf("expected a *DuplicateNameError for variable tryVar, got %#v", tryErrs[1])
+	}
+	if !errors.Is(tryErrs[1], ErrNameCollision) || errors.Is(tryErrs[1], ErrInvalidName) {
+		t.Errorf("expected %v to be ErrNameCollision only", tryErrs[1])
+	}
+
+	for _, i := range []int{2, 3, 6} {
+		var nameErr *InvalidNameError
+		if !errors.As(tryErrs[i], &nameErr) {
+			t.Errorf("%d: expected an *InvalidNameError, got %#v", i, tryErrs[i])
+		}
+		if !errors.Is(tryErrs[i], ErrInvalidName) || errors.Is(tryErrs[i], ErrNameCollision) {
+			t.Errorf("%d: expected %v to be ErrInvalidName only", i, tryErrs[i])
+		}
+	}
+
+	if err := tryErrs[4]; err == nil || !strings.Contains(err.Error(), "pool depth must be at least 1") {
+		t.Errorf("expected a pool depth error, got %v", err)
+	}
+
+	var importErr *ImportError
+	if !errors.As(tryErrs[5], &importErr) ||
+		importErr.PkgPath != "github.com/google/blueprint/pctx_missing" {
+		t.Errorf("expected an *ImportError for pctx_missing, got %#v", tryErrs[5])
+	}
+
+	wants := []string{
+		"",
+		`"try var func" contains an invalid Ninja name character`,
+		"is not a function",
+		"empty environment variable name",
+		`rule argument "out" cannot be part of variable "tryConcatVar"`,
+		`pool name "console" is reserved`,
+		"is not in the range (0, 1]",
+		`composite pool "tryCompositePool" has no children`,
+		"invalid argument",
+		"the base rule must be defined in the same package",
+		`rule "trySegmentedRule" has no segments with a command`,
+		`"try select rule" contains an invalid Ninja name character`,
+	}
+	if len(tryFuncErrs) != len(wants) {
+		t.Fatalf("expected %d results, got %d", len(wants), len(tryFuncErrs))
+	}
+	for i, want := range wants {
+		err := tryFuncErrs[i]
+		if want == "" {
+			if err != nil {
+				t.Errorf("%d: unexpected error: %s", i, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%d: expected an error containing %q, got %v", i, want, err)
+		}
+	}
+}
+
+func TestValidateRuleDepsParams(t *testing.T) {
+	for _, tc := range []struct {
+		params RuleParams
+		err    string
+	}{
+		{RuleParams{}, ""},
+		{RuleParams{Depfile: "$out.d"}, "Depfile is set but Deps is not"},
+		{RuleParams{Deps: DepsGCC}, "Deps is DepsGCC but Depfile is not set"},
+		{RuleParams{Deps: DepsGCC, Depfile: "$out.d"}, ""},
+		{RuleParams{Deps: DepsMSVC}, ""},
+		{RuleParams{Deps: DepsMSVC, Depfile: "$out.d"}, ""},
+	} {
+		err := validateRuleDepsParams(&tc.params)
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%+v: unexpected error: %s", tc.params, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%+v: expected an error containing %q, got %v", tc.params, tc.err, err)
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	oldContexts, oldNames := packageContexts, packageNames
+	oldArgChecks := ruleArgChecks
+	defer func() {
+		packageContexts, packageNames = oldContexts, oldNames
+		ruleArgChecks = oldArgChecks
+	}()
+
+	os.Setenv("BLUEPRINT_PCTX_TEST_ENV", "reset")
+	defer os.Unsetenv("BLUEPRINT_PCTX_TEST_ENV")
+	envVar.value(nil)
+	SetNameTransformer(strings.ToUpper)
+	SetCaseInsensitiveNames(true)
+	SetPackageNameMangler(strings.ToUpper)
+	SetGenerationFlavor("debug")
+	SetRegistrationObserver(func(kind, pkgPath, name string) {})
+	SetProfilingEnabled(true)
+	variableValuesProfile.record(time.Now())
+
+	Reset()
+
+	if len(packageContexts) != 0 || len(packageNames) != 0 {
+		t.Errorf("expected no package contexts, got %d and %d names",
+			len(packageContexts), len(packageNames))
+	}
+	if _, _, _, err := ExportedNames("github.com/google/blueprint/pctx_test"); err == nil {
+		t.Errorf("expected an error for a package removed by Reset")
+	}
+	if deps := EnvDeps(); len(deps) != 0 {
+		t.Errorf("expected no environment dependencies, got %v", deps)
+	}
+	if len(ruleArgChecks) != 0 {
+		t.Errorf("expected no argument checks, got %d", len(ruleArgChecks))
+	}
+	if nameTransformer != nil {
+		t.Errorf("expected no name transformer")
+	}
+	if caseInsensitiveNames {
+		t.Errorf("expected case-insensitive names to be disabled")
+	}
+	if g, w := packageNameMangler("a/b"), "a.b"; g != w {
+		t.Errorf("expected the default package name mangler, want %q, got %q", w, g)
+	}
+	if g := currentGenerationFlavor(); g != "" {
+		t.Errorf("expected the default generation flavor, got %q", g)
+	}
+	if registrationObserver != nil {
+		t.Errorf("expected no registration observer")
+	}
+	if profiling() {
+		t.Errorf("expected profiling to be disabled")
+	}
+	if g := ProfilingStats(); g != (GenerationProfile{}) {
+		t.Errorf("expected no profiling statistics, got %+v", g)
+	}
+}
+
+func TestCaseInsensitiveNames(t *testing.T) {
+	_, errs := NewContext().ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	SetCaseInsensitiveNames(true)
+	defer SetCaseInsensitiveNames(false)
+
+	_, errs = NewContext().ResolveDependencies(nil)
+	want := `package "github.com/google/blueprint/pctx_case_test": variable`
+	if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), want) ||
+		!strings.Contains(errs[0].Error(), "differs only in case from variable") {
+		t.Errorf("expected an error starting with %q, got %v", want, errs)
+	}
+
+	pkg := NewTestPackage("example.com/casepkg")
+	pkg.AddStaticVariable("CFLAGS", "")
+	pkg.AddStaticRule("cflags", RuleParams{Command: "true"})
+	defer func() {
+		r := recover()
+		dupErr, ok := r.(*DuplicateNameError)
+		if !ok || dupErr.Name != "cflags" || dupErr.Existing != "CFLAGS" {
+			t.Fatalf("expected a *DuplicateNameError, got %#v", r)
+		}
+		want := `variable "cflags" differs only in case from variable "CFLAGS", ` +
+			`which is already defined in this scope`
+		if dupErr.Error() != want {
+			t.Errorf("expected error %q, got %q", want, dupErr)
+		}
+	}()
+	pkg.AddStaticVariable("cflags", "")
+}
+
+func TestImportedVariableNames(t *testing.T) {
+	// A package variable may have the same name as an exported variable of a
+	// package it imports, because the imported variables are always
+	// referenced qualified by the import name.
+	lib := NewTestPackage("example.com/imported/lib")
+	libCflags := lib.AddStaticVariable("Cflags", "-Wall")
+
+	pkg := NewTestPackage("example.com/imported/pkg")
+	pkg.pctx.imports["lib"] = lib.pctx
+	err := pkg.pctx.scope.AddImport("lib", lib.pctx.scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cflags := pkg.AddStaticVariable("Cflags", "-O2")
+
+	for name, want := range map[string]Variable{
+		"Cflags":     cflags,
+		"lib.Cflags": libCflags,
+	} {
+		v, err := pkg.pctx.scope.LookupVariable(name)
+		if err != nil {
+			t.Fatalf("unexpected error looking up %q: %s", name, err)
+		}
+		if v != want {
+			t.Errorf("incorrect variable for %q, want %s, got %s", name, want, v)
+		}
+	}
+}
+
+func TestImportOptional(t *testing.T) {
+	if !importedOptional {
+		t.Errorf("expected ImportOptional to return true for a linked package")
+	}
+	if importedMissing {
+		t.Errorf("expected ImportOptional to return false for a missing package")
+	}
+
+	scope := pctxOptionalTest.(*packageContext).scope
+	v, err := scope.LookupVariable("pctx_test.ExportedTestVar")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if v != ExportedTestVar {
+		t.Errorf("expected ExportedTestVar, got %s", v)
+	}
+	if _, err := scope.LookupVariable("pctx_missing.Var"); err == nil {
+		t.Errorf("expected an error looking up a variable of a missing package")
+	}
+}
+
+func TestImportName(t *testing.T) {
+	scope := pctxImportNameTest.(*packageContext).scope
+	v, err := scope.LookupVariable("yaml_v2.YamlVar")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if v != yamlV2Var {
+		t.Errorf("expected YamlVar, got %s", v)
+	}
+
+	want := `cannot import package "github.com/google/blueprint/pctx_import_other/yaml.v2": ` +
+		`its name "yaml.v2" is not a valid Ninja name and package ` +
+		`"github.com/google/blueprint/pctx_import/yaml.v2" is already imported as "yaml_v2" ` +
+		`(use ImportAs to choose a different name)`
+	if _, ok := importNameErr.(*ImportError); !ok {
+		t.Errorf("expected an *ImportError, got %#v", importNameErr)
+	}
+	if importNameErr == nil || !strings.HasSuffix(importNameErr.Error(), want) {
+		t.Errorf("expected error ending with %q, got %v", want, importNameErr)
+	}
+}
+
+func TestPackageFingerprint(t *testing.T) {
+	const pkgPath = "github.com/google/blueprint/pctx_fingerprint_test"
+
+	fingerprint := func(config string) string {
+		t.Helper()
+		fp, err := PackageFingerprint(pkgPath, config)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return fp
+	}
+
+	a := fingerprint("a")
+	if len(a) != 64 {
+		t.Errorf("expected a hex SHA-256 hash, got %q", a)
+	}
+	if again := fingerprint("a"); again != a {
+		t.Errorf("fingerprint is not deterministic: %q != %q", again, a)
+	}
+	if b := fingerprint("b"); b == a {
+		t.Errorf("expected different fingerprints for different configs, got %q", b)
+	}
+
+	if _, err := PackageFingerprint(pkgPath, "bad"); err == nil ||
+		!strings.Contains(err.Error(), "bad config") {
+		t.Errorf("expected an error evaluating fingerprintVar, got %v", err)
+	}
+	if _, err := PackageFingerprint(pkgPath, "undefined"); err == nil ||
+		!strings.Contains(err.Error(), "error parsing RuleParams") {
+		t.Errorf("expected an error parsing fingerprintFuncRule, got %v", err)
+	}
+	if _, err := PackageFingerprint("github.com/google/blueprint/pctx_missing", nil); err == nil {
+		t.Errorf("expected an error for a package without a context")
+	}
+}
+
+func TestLookupErrors(t *testing.T) {
+	const pkg = `package "github.com/google/blueprint/pctx_import_name_test"`
+	scope := pctxImportNameTest.(*packageContext).scope
+	local := newLocalScope(scope, "local.").scope
+
+	for _, tc := range []struct {
+		scope *basicScope
+		name  string
+		err   string
+	}{
+		{scope, "missing", `undefined variable "missing" (searched ` + pkg + `)`},
+		{local, "missing", `undefined variable "missing" (searched local variables, ` + pkg + `)`},
+		{local, "other.Var", `unknown imported package "other" (missing call to ` +
+			`blueprint.Import()?) (searched the imports of local variables (no imports), ` +
+			pkg + ` (imports "yaml_v2"))`},
+		{scope, "yaml_v2.Missing", `package "yaml_v2" does not contain variable "Missing" ` +
+			`(searched package "github.com/google/blueprint/pctx_import/yaml.v2")`},
+	} {
+		_, err := tc.scope.LookupVariable(tc.name)
+		if err == nil || err.Error() != tc.err {
+			t.Errorf("%s: expected error %q, got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestStrictVariableResolution(t *testing.T) {
+	_, errs := NewContext().ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+
+	ctx := NewContext()
+	ctx.SetStrictVariableResolution(true)
+	_, errs = ctx.ResolveDependencies(nil)
+	want := "error parsing variable github.com/google/blueprint/pctx_strict_test.typoVar value: " +
+		`package "pctx_test" does not contain variable "ExportedTestVarr" ` +
+		`(searched package "github.com/google/blueprint/pctx_test")`
+	if len(errs) != 1 || errs[0].Error() != want {
+		t.Errorf("expected error %q, got %v", want, errs)
+	}
+}
+
+func TestDefinitionOrder(t *testing.T) {
+	value, err := resolveVariable(importedVar, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if w := "x"; value != w {
+		t.Errorf("incorrect value for %s, want %q, got %q", importedVar, w, value)
+	}
+}
+
+func TestRspfileThreshold(t *testing.T) {
+	_, out := writePctxTest(t, nil, func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestRspRule,
+			Inputs:  []string{"a.o"},
+			Outputs: []string{"short"},
+		})
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestRspRule,
+			Inputs:  []string{"a.o", "b.o", "c.o"},
+			Outputs: []string{"long"},
+		})
+	})
+
+	for _, want := range []string{
+		"rule g.pctx_test.pctxTestRspRule\n    command = ld ${in} -o ${out}\n",
+		"rule g.pctx_test.pctxTestRspRule.rsp\n    command = ld @${out}.rsp -o ${out}\n" +
+			"    rspfile = ${out}.rsp\n    rspfile_content = ${in}\n",
+		"build short: g.pctx_test.pctxTestRspRule a.o\n",
+		"build long: g.pctx_test.pctxTestRspRule.rsp a.o b.o c.o\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in output:\n%s", want, out)
+		}
+	}
+
+	_, errs := runPctxTest(t, nil, func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestRspCollisionRule,
+			Inputs:  []string{"a.o"},
+			Outputs: []string{"other"},
+		})
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestRspCollidingRule,
+			Inputs:  []string{"a.o", "b.o"},
+			Outputs: []string{"long"},
+		})
+	})
+	want := "rule github.com/google/blueprint/pctx_test.pctxTestRspCollidingRule.rsp " +
+		"has the name of the response file variant of rule " +
+		"github.com/google/blueprint/pctx_test.pctxTestRspCollidingRule, " +
+		"which has an RspfileThreshold"
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), want) {
+		t.Errorf("expected error %q, got %v", want, errs)
+	}
+}
+
+func TestRuleArgUsage(t *testing.T) {
+	generate := func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestArgsRule,
+			Outputs: []string{"out"},
+		})
+	}
+
+	// The unused arguments are only reported on request.
+	_, errs := runPctxTest(t, nil, generate)
+	if len(errs) > 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+
+	ctx := parsePctxTest(t, generate)
+	ctx.SetCheckUnusedRuleArgs(true)
+	_, errs = ctx.PrepareBuildActions(nil)
+	want := "invalid arguments for rule " +
+		`github.com/google/blueprint/pctx_test.pctxTestArgsRule: unused arguments ["unused"]`
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), want) {
+		t.Errorf("expected error %q, got %v", want, errs)
+	}
+}
+
+func TestDerivedRule(t *testing.T) {
+	_, out := writePctxTest(t, nil, func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestDerivedRule,
+			Inputs:  []string{"in"},
+			Outputs: []string{"out"},
+			Args: map[string]string{
+				"mode": "+x",
+			},
+		})
+	})
+
+	for _, want := range []string{
+		"rule g.pctx_test.pctxTestDerivedRule\n" +
+			"    command = cp ${in} ${out} && chmod ${mode} ${out}\n" +
+			"    restat = true\n",
+		"build out: g.pctx_test.pctxTestDerivedRule in\n    mode = +x\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in output:\n%s", want, out)
+		}
+	}
+}
+
+func TestNameTransformer(t *testing.T) {
+	SetNameTransformer(func(name string) string { return "p1_" + name })
+	defer SetNameTransformer(nil)
+
+	_, out := writePctxTest(t, nil, func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestPoolRule,
+			Inputs:  []string{"${dynBase}"},
+			Outputs: []string{"out"},
+		})
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    Phony,
+			Inputs:  []string{"out"},
+			Outputs: []string{"all"},
+		})
+	})
+
+	for _, want := range []string{
+		"p1_g.pctx_test.dynBase = -O2\n",
+		"pool p1_g.pctx_test.pctxTestPool\n",
+		"rule p1_g.pctx_test.pctxTestPoolRule\n    pool = p1_g.pctx_test.pctxTestPool\n",
+		"build out: p1_g.pctx_test.pctxTestPoolRule ${p1_g.pctx_test.dynBase}\n",
+		"build all: phony out\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in output:\n%s", want, out)
+		}
+	}
+
+	SetNameTransformer(func(name string) string { return name + "!" })
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("expected a panic for an invalid transformed name")
+		}
+	}()
+	transformNinjaName("g.pctx_test.dynBase")
+}
+
+func TestTestPackage(t *testing.T) {
+	pkg := NewTestPackage("example.com/testpkg")
+
+	flags := pkg.AddStaticVariable("flags", "-O2")
+	cflags := pkg.AddStaticVariable("cflags", "${flags} -Wall")
+	pool := pkg.AddStaticPool("testPool", PoolParams{Depth: 2})
+	rule := pkg.AddStaticRule("cc", RuleParams{
+		Command: "cc ${cflags} ${extra} -c $in -o $out",
+		Pool:    pool,
+	}, "extra")
+
+	value, err := pkg.VariableValue(cflags, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if value != "-O2 -Wall" {
+		t.Errorf("incorrect value for %s: want %q, got %q", cflags, "-O2 -Wall", value)
+	}
+
+	bindings, err := pkg.RuleBindings(rule, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := map[string]string{
+		"command": "cc ${g.example.com.testpkg.cflags} ${extra} -c ${in} -o ${out}",
+		"pool":    "g.example.com.testpkg.testPool",
+	}
+	if !reflect.DeepEqual(bindings, want) {
+		t.Errorf("incorrect bindings:\nwant: %v\n got: %v", want, bindings)
+	}
+
+	// Test packages are isolated, so the same path and names may be reused.
+	NewTestPackage("example.com/testpkg").AddStaticVariable("flags", "-O0")
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("expected a panic for a duplicate variable %s", flags)
+		}
+	}()
+	pkg.AddStaticVariable("flags", "-O0")
+}
+
+func TestDefiningPackage(t *testing.T) {
+	const pkgPath = "github.com/google/blueprint/pctx_test"
+
+	for _, tc := range []struct {
+		name    string
+		get     func() (string, bool)
+		pkgPath string
+		ok      bool
+	}{
+		{"static variable", func() (string, bool) { return VariablePackage(dynBase) }, pkgPath, true},
+		{"variable func", func() (string, bool) { return VariablePackage(dynArch) }, pkgPath, true},
+		{"arg variable", func() (string, bool) {
+			return VariablePackage(&argVariable{"out"})
+		}, "", false},
+		{"static rule", func() (string, bool) { return RulePackage(pctxTestPoolRule) }, pkgPath, true},
+		{"builtin rule", func() (string, bool) { return RulePackage(Phony) }, "", false},
+		{"static pool", func() (string, bool) { return PoolPackage(pctxTestPool) }, pkgPath, true},
+		{"builtin pool", func() (string, bool) { return PoolPackage(Console) }, "", false},
+	} {
+		gotPkgPath, gotOk := tc.get()
+		if gotPkgPath != tc.pkgPath || gotOk != tc.ok {
+			t.Errorf("%s: want (%q, %v), got (%q, %v)", tc.name, tc.pkgPath, tc.ok,
+				gotPkgPath, gotOk)
+		}
+	}
+}
+
+func TestRuleDescriptionReferences(t *testing.T) {
+	pkg := NewTestPackage("example.com/description")
+	pkg.AddStaticVariable("tool", "cc")
+	good := pkg.AddStaticRule("good", RuleParams{
+		Command:     "${tool} $flags -o $out $in",
+		Description: "${tool} $flags $out",
+	}, "flags")
+	bindings, err := pkg.RuleBindings(good, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if g, w := bindings["description"], "${g.example.com.description.tool} ${flags} ${out}"; g != w {
+		t.Errorf("incorrect description, want %q, got %q", w, g)
+	}
+
+	bad := pkg.AddStaticRule("bad", RuleParams{
+		Command:     "cc -o $out $in",
+		Description: "cc $flagz $out",
+	})
+	defer func() {
+		r := recover()
+		err, ok := r.(error)
+		if !ok || !strings.Contains(err.Error(), "example.com/description.bad") ||
+			!strings.Contains(err.Error(), "Description") {
+			t.Errorf("expected a panic naming the rule and Description, got %v", r)
+		}
+	}()
+	pkg.RuleBindings(bad, nil)
+}
+
+func TestRuleArgDefaults(t *testing.T) {
+	_, out := writePctxTest(t, nil, func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestDefaultsRule,
+			Inputs:  []string{"in"},
+			Outputs: []string{"default"},
+		})
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestDefaultsRule,
+			Inputs:  []string{"in"},
+			Outputs: []string{"set"},
+			Args:    map[string]string{"opt": "-O0", "extra": "-v"},
+		})
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestDerivedDefaultsRule,
+			Inputs:  []string{"in"},
+			Outputs: []string{"derived"},
+		})
+	})
+
+	for _, want := range []string{
+		"build default: g.pctx_test.pctxTestDefaultsRule in\n" +
+			"    g.pctx_test.dynBase = ${g.pctx_test.dynBase} -g\n    opt = -O2\n",
+		"build set: g.pctx_test.pctxTestDefaultsRule in\n" +
+			"    extra = -v\n    g.pctx_test.dynBase = ${g.pctx_test.dynBase} -g\n    opt = -O0\n",
+		"build derived: g.pctx_test.pctxTestDerivedDefaultsRule in\n" +
+			"    g.pctx_test.dynBase = ${g.pctx_test.dynBase} -g\n    opt = -O3\n",
+		"g.pctx_test.dynBase = -O2\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in output:\n%s", want, out)
+		}
+	}
+}
+
+func TestParseArgNames(t *testing.T) {
+	names, defaults, err := parseArgNames([]string{"a", "b=", "c=x=${y}"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if w := []string{"a", "b", "c"}; !reflect.DeepEqual(names, w) {
+		t.Errorf("incorrect names: want %q, got %q", w, names)
+	}
+	if w := map[string]string{"b": "", "c": "x=${y}"}; !reflect.DeepEqual(defaults, w) {
+		t.Errorf("incorrect defaults: want %q, got %q", w, defaults)
+	}
+
+	for _, argNames := range [][]string{{"a=${"}, {"=x"}, {"in=x"}} {
+		if _, _, err := parseArgNames(argNames); err == nil {
+			t.Errorf("expected an error for %q", argNames)
+		}
+	}
+}
+
+func TestBuildLocalVariables(t *testing.T) {
+	_, out := writePctxTest(t, nil, func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:           pctxTestDefaultsRule,
+			Inputs:         []string{"in"},
+			Outputs:        []string{"out"},
+			Args:           map[string]string{"extra": "${listVar}"},
+			LocalVariables: map[string]string{"listVar": "-O0 ${ExportedTestVar}"},
+		})
+	})
+
+	want := "build out: g.pctx_test.pctxTestDefaultsRule in\n" +
+		"    extra = ${g.pctx_test.listVar}\n" +
+		"    g.pctx_test.dynBase = ${g.pctx_test.dynBase} -g\n" +
+		"    g.pctx_test.listVar = -O0 ${g.pctx_test.ExportedTestVar}\n" +
+		"    opt = -O2\n"
+	if !strings.Contains(out, want) {
+		t.Errorf("missing %q in output:\n%s", want, out)
+	}
+	if !strings.Contains(out, "g.pctx_test.ExportedTestVar = ") {
+		t.Errorf("missing the definition of ExportedTestVar in output:\n%s", out)
+	}
+
+	for _, tc := range []struct {
+		rule  Rule
+		name  string
+		value string
+		err   string
+	}{
+		{pctxTestDefaultsRule, "extra", "-g", `local variable "extra" is an argument of rule`},
+		{pctxTestDefaultsRule, "dynBase", "-g", `local variable "dynBase" is an argument of rule`},
+		{pctxTestRule, "missingVar", "-g", `error looking up local variable "missingVar"`},
+		{pctxTestRule, "dynBase", "${missingVar}", `error parsing local variable "dynBase"`},
+	} {
+		_, errs := runPctxTest(t, nil, func(ctx ModuleContext) {
+			ctx.Build(pctxTest, BuildParams{
+				Rule:           tc.rule,
+				Outputs:        []string{"out"},
+				LocalVariables: map[string]string{tc.name: tc.value},
+			})
+		})
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), tc.err) {
+			t.Errorf("%s = %q: expected an error containing %q, got %v", tc.name,
+				tc.value, tc.err, errs)
+		}
+	}
+}
+
+// calledFromInitClosure is set by a closure that is called to initialize a
+// package-scoped variable, which checkCalledFromInit must accept.
+var calledFromInitClosure = func() bool {
+	checkCalledFromInit()
+	return true
+}()
+
+func TestCheckCalledFromInit(t *testing.T) {
+	for name, want := range map[string]bool{
+		"init":          true,
+		"init.0":        true,
+		"init·1":        true,
+		"init.ializers": true,
+		"init.func1":    true,
+		"initialize":    false,
+		"Test.init":     false,
+	} {
+		if g := isInitFuncName(name); g != want {
+			t.Errorf("isInitFuncName(%q): want %v, got %v", name, want, g)
+		}
+	}
+
+	pkgPath, funcName, ok := splitFuncName("github.com/google/blueprint.init.0")
+	if !ok || pkgPath != "github.com/google/blueprint" || funcName != "init.0" {
+		t.Errorf("incorrect split: got %q, %q, %v", pkgPath, funcName, ok)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("expected a panic when not called from an init func")
+		}
+	}()
+	checkCalledFromInit()
+}
+
+func TestPackageNamespace(t *testing.T) {
+	_, out := writePctxTest(t, nil, func(ctx ModuleContext) {
+		ctx.Build(pctxNsArm, BuildParams{
+			Rule:    nsRule,
+			Inputs:  []string{"in"},
+			Outputs: []string{"out"},
+		})
+		ctx.Build(pctxNsX86, BuildParams{
+			Rule:    Phony,
+			Outputs: []string{"x86/${x86Flags}"},
+		})
+		ctx.Build(pctxNsShort, BuildParams{
+			Rule:    Phony,
+			Outputs: []string{"short/${nsShortVar}"},
+		})
+	})
+
+	for _, want := range []string{
+		"g.pctx_ns.armFlags = -marm\n",
+		"g.pctx_ns.x86Flags = -m32\n",
+		"rule g.pctx_ns.nsRule\n    command = cc ${g.pctx_ns.armFlags} ${in} -o ${out}\n",
+		"build out: g.pctx_ns.nsRule in\n",
+		"build x86/${g.pctx_ns.x86Flags}: phony\n",
+		"g.github.com.google.blueprint.other.pctx_ns.nsShortVar = short\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in output:\n%s", want, out)
+		}
+	}
+
+	// Define armFlags in the other package of the namespace too.
+	x86 := pctxNsX86.(*packageContext)
+	x86.addStaticVariable(&staticVariable{pctx: x86, name_: "armFlags"})
+	defer delete(x86.scope.variables, "armFlags")
+
+	want := `packages "github.com/google/blueprint/pctx_ns/arm" and ` +
+		`"github.com/google/blueprint/pctx_ns/x86" share the Ninja namespace ` +
+		`"pctx_ns" and both define the variable "armFlags"`
+	errs := checkPackageNamespaces()
+	if len(errs) != 1 || errs[0].Error() != want {
+		t.Errorf("incorrect errors:\nwant: [%s]\n got: %v", want, errs)
+	}
+}
+
+func TestBuildSummary(t *testing.T) {
+	if _, err := NewContext().BuildSummary(); err != ErrBuildActionsNotReady {
+		t.Errorf("want %v, got %v", ErrBuildActionsNotReady, err)
+	}
+
+	ctx, _ := writePctxTest(t, nil, func(ctx ModuleContext) {
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestPoolRule,
+			Inputs:  []string{"${dynBase}"},
+			Outputs: []string{"out/b"},
+		})
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestRule,
+			Outputs: []string{"out/${dynBase}"},
+		})
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    Phony,
+			Inputs:  []string{"out/b"},
+			Outputs: []string{"all"},
+		})
+		ctx.Variable(pctxTest, "localDir", "gen")
+		ctx.Build(pctxTest, BuildParams{
+			Rule:    pctxTestRule,
+			Outputs: []string{"${localDir}/x"},
+		})
+	})
+
+	summary, err := ctx.BuildSummary()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := &BuildSummary{
+		Packages: []PackageSummary{{
+			PkgPath:   "github.com/google/blueprint/pctx_test",
+			Variables: []string{"g.pctx_test.dynBase"},
+			Pools:     []string{"g.pctx_test.pctxTestPool"},
+			Rules:     []string{"g.pctx_test.pctxTestPoolRule", "g.pctx_test.pctxTestRule"},
+			Builds:    3,
+		}},
+		Builds:  4,
+		Outputs: []string{"all", "gen/x", "out/-O2", "out/b"},
+	}
+	if !reflect.DeepEqual(summary, want) {
+		t.Errorf("incorrect summary:\nwant: %+v\n got: %+v", want, summary)
+	}
+}
+
+func TestResolvingVariableFunc(t *testing.T) {
+	for config, want := range map[Variable]string{
+		dynBase:       "-O2 -g",
+		nsArmFlags:    "-marm -g",
+		deprecatedRef: "old/ref -g",
+	} {
+		value, err := resolvingVar.value(config)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if g := value.Value(nil); g != want {
+			t.Errorf("incorrect value resolving %s, want %q, got %q", config, want, g)
+		}
+	}
+
+	if _, err := resolvingVar.value(&argVariable{"out"}); err != errVariableIsArg {
+		t.Errorf("want %v, got %v", errVariableIsArg, err)
+	}
+
+	_, err := resolvingVar.value(resolvingVar)
+	if err == nil || !strings.Contains(err.Error(), "detected variable reference cycle") {
+		t.Errorf("expected a reference cycle error, got %v", err)
+	}
+}
+
+func TestRuleRestat(t *testing.T) {
+	pkg := NewTestPackage("example.com/restatpkg")
+	for _, tc := range []struct {
+		params RuleParams
+		want   map[string]string
+	}{
+		{
+			params: RuleParams{Command: "gen $out", Restat: true},
+			want:   map[string]string{"command": "gen ${out}", "restat": "true"},
+		},
+		{
+			params: RuleParams{Command: "gen $out", Restat: true, Generator: true},
+			want: map[string]string{"command": "gen ${out}", "restat": "true",
+				"generator": "true"},
+		},
+		{
+			params: RuleParams{Command: "gen $out"},
+			want:   map[string]string{"command": "gen ${out}"},
+		},
+	} {
+		rule := pkg.AddStaticRule("restat"+strconv.Itoa(len(tc.want)), tc.params)
+		bindings, err := pkg.RuleBindings(rule, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !reflect.DeepEqual(bindings, tc.want) {
+			t.Errorf("incorrect bindings for %+v:\nwant: %v\n got: %v", tc.params,
+				tc.want, bindings)
+		}
+	}
+}
+
+func TestGeneratorRule(t *testing.T) {
+	pkg := NewTestPackage("example.com/generatorpkg")
+	rule := pkg.AddStaticRule("regen", RuleParams{
+		Command:   "regen -o $out $in",
+		Generator: true,
+	})
+
+	bindings, err := pkg.RuleBindings(rule, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := map[string]string{"command": "regen -o ${out} ${in}", "generator": "true"}
+	if !reflect.DeepEqual(bindings, want) {
+		t.Errorf("incorrect bindings:\nwant: %v\n got: %v", want, bindings)
+	}
+}
+
+func TestWriteBuildManifest(t *testing.T) {
+	ctx, _ := writePctxTest(t, nil, func(ctx ModuleContext) {
+		ctx.Variable(pctxTest, "objDir", "obj/${dynBase}")
+		ctx.Build(pctxTest, BuildParams{
+			Rule:      validatedRule,
+			Outputs:   []string{"out file", "${objDir}/a.o"},
+			Inputs:    []string{"a.c", "a$$b.c"},
+			OrderOnly: []string{"gen"},
+			Args: map[string]string{
+				"flags": "-O2",
+				"mode":  "arm",
+			},
+			Optional: true,
+		})
+		ctx.Build(pctxTest, BuildParams{
+			Rule:        pctxTestRule,
+			Description: "lint",
+			Outputs:     []string{"lint"},
+		})
+	})
+
+	buf := &bytes.Buffer{}
+	err := ctx.WriteBuildManifest(buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := []manifestEntry{
+		{
+			Module: "A",
+			buildStatement: &buildStatement{
+				Rule:      "g.pctx_test.validatedRule",
+				Outputs:   []string{"out file", "obj/-O2/a.o"},
+				Inputs:    []string{"a.c", "a$b.c"},
+				OrderOnly: []string{"gen"},
+				Args:      map[string]string{"flags": "-O2", "mode": "arm"},
+			},
+		},
+		{
+			Module: "A",
+			buildStatement: &buildStatement{
+				Rule:      "g.pctx_test.pctxTestRule",
+				Outputs:   []string{"lint"},
+				Variables: map[string]string{"description": "lint"},
+				Default:   true,
+			},
+		},
+	}
+	wantJSON, err := json.MarshalIndent(want, "", "  ")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if g, w := buf.String(), string(wantJSON)+"\n"; g != w {
+		t.Errorf("incorrect manifest:\nwant: %s\n got: %s", w, g)
+	}
+
+	err = NewContext().WriteBuildManifest(ioutil.Discard)
+	if err != ErrBuildActionsNotReady {
+		t.Errorf("expected ErrBuildActionsNotReady, got %v", err)
+	}
+}
+
+func TestPackageDefaultPool(t *testing.T) {
+	_, out := writePctxTest(t, nil, func(ctx ModuleContext) {
+		for i, rule := range []Rule{defaultPoolRule, defaultPoolFuncRule, otherPoolRule,
+			generatorRule, generatorFuncRule} {
+			ctx.Build(pctxDefaultPoolTest, BuildParams{
+				Rule:    rule,
+				Outputs: []string{"out" + strconv.Itoa(i)},
+				Inputs:  []string{"in"},
+			})
+		}
+		ctx.Build(pctxDefaultPoolTest, BuildParams{
+			Rule:    defaultPoolRule,
+			Pool:    otherPool,
+			Outputs: []string{"out5"},
+			Inputs:  []string{"in"},
+		})
+	})
+
+	for _, want := range []string{
+		"rule g.pctx_default_pool_test.defaultPoolRule\n" +
+			"    pool = g.pctx_default_pool_test.defaultPool\n" +
+			"    command = cp ${in} ${out}\n",
+		"rule g.pctx_default_pool_test.defaultPoolFuncRule\n" +
+			"    pool = g.pctx_default_pool_test.defaultPool\n" +
+			"    command = cp ${in} ${out}\n",
+		"rule g.pctx_default_pool_test.otherPoolRule\n" +
+			"    pool = g.pctx_default_pool_test.otherPool\n" +
+			"    command = cp ${in} ${out}\n",
+		"rule g.pctx_default_pool_test.generatorRule\n" +
+			"    command = cp ${in} ${out}\n" +
+			"    generator = true\n",
+		"rule g.pctx_default_pool_test.generatorFuncRule\n" +
+			"    command = cp ${in} ${out}\n" +
+			"    generator = true\n",
+		"build out5: g.pctx_default_pool_test.defaultPoolRule in\n" +
+			"    pool = g.pctx_default_pool_test.otherPool\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in output:\n%s", want, out)
+		}
+	}
+
+	if err, ok := defaultPoolPanic.(error); !ok ||
+		!strings.Contains(err.Error(), "is not defined by the package or by a package it imports") {
+		t.Errorf("expected a panic for a default pool that is not imported, got %v", defaultPoolPanic)
+	}
+}
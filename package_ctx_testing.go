@@ -0,0 +1,123 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A TestPackage is an isolated package scope for unit testing Ninja variable,
+// rule, and pool definitions.  Unlike a PackageContext it may be used outside
+// of a Go package's initialization, and it is not registered with the other
+// package contexts, so it is never written to a Ninja file and any number of
+// TestPackages may share the same package path.
+//
+// A TestPackage must only be used from tests.
+type TestPackage struct {
+	pctx *packageContext
+}
+
+// NewTestPackage returns a new TestPackage for the given package path.
+func NewTestPackage(pkgPath string) *TestPackage {
+	pkgName := packageNameMangler(pkgPath)
+	err := validateNinjaName(pkgName)
+	if err != nil {
+		panic(err)
+	}
+
+	i := strings.LastIndex(pkgPath, "/")
+
+	p := &packageContext{
+		fullName:  pkgName,
+		shortName: pkgPath[i+1:],
+		pkgPath:   pkgPath,
+		scope:     newScope(nil),
+		imports:   make(map[string]*packageContext),
+		overrides: make(map[Variable]*staticVariable),
+	}
+	p.scope.desc = fmt.Sprintf("test package %q", pkgPath)
+
+	return &TestPackage{p}
+}
+
+// AddStaticVariable adds a variable to the package as
+// PackageContext.StaticVariable does.  It panics if the variable is invalid.
+func (t *TestPackage) AddStaticVariable(name, value string) Variable {
+	v, err := t.pctx.addStaticVariable(&staticVariable{
+		pctx:   t.pctx,
+		name_:  name,
+		value_: value,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// AddStaticRule adds a rule to the package as PackageContext.StaticRule does.
+// It panics if the rule is invalid.
+func (t *TestPackage) AddStaticRule(name string, params RuleParams,
+	argNames ...string) Rule {
+
+	r, err := t.pctx.addStaticRule(name, params, argNames)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// AddStaticPool adds a pool to the package as PackageContext.StaticPool does.
+// It panics if the pool is invalid.
+func (t *TestPackage) AddStaticPool(name string, params PoolParams) Pool {
+	pool, err := t.pctx.addStaticPool(name, params)
+	if err != nil {
+		panic(err)
+	}
+	return pool
+}
+
+// VariableValue returns the value of v for config with all the Ninja variables
+// it references expanded.
+func (t *TestPackage) VariableValue(v Variable, config interface{}) (string,
+	error) {
+
+	return resolveVariable(v, config, nil)
+}
+
+// RuleBindings returns the bindings that the rule r would be written to the
+// Ninja file with for config.  The values are returned as they would appear in
+// the Ninja file, with the variables they reference left unexpanded and the
+// package's variables and pools qualified with its full Ninja name.
+func (t *TestPackage) RuleBindings(r Rule, config interface{}) (
+	map[string]string, error) {
+
+	def, err := r.def(config)
+	if err != nil {
+		return nil, err
+	}
+
+	pkgNames := map[*packageContext]string{t.pctx: t.pctx.fullName}
+
+	bindings := make(map[string]string)
+	if def.Pool != nil {
+		bindings["pool"] = def.Pool.fullName(pkgNames)
+	}
+	for name, value := range def.writtenVariables() {
+		bindings[name] = value.Value(pkgNames)
+	}
+
+	return bindings, nil
+}
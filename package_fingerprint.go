@@ -0,0 +1,138 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// PackageFingerprint returns a hash of the definitions of the variables, rules,
+// and pools defined by the package with the given path, evaluated for config.
+// The hash only depends on the definitions as they would be written to the
+// Ninja file, with the variables they reference left unexpanded, so it does not
+// change when the package's definitions are reordered or when the values of
+// variables defined by other packages change.  An error is returned if the
+// package has no package context or if one of its definitions cannot be
+// evaluated for config, including when evaluating it panics.
+//
+// Definitions that were made visible in the package by ReExport are not
+// included, they are part of the fingerprint of the package that defined them.
+func PackageFingerprint(pkgPath string, config interface{}) (fingerprint string, err error) {
+	// Some definitions, like rules with invalid RuleParams, panic when they are
+	// evaluated.
+	defer func() {
+		if r := recover(); r != nil {
+			fingerprint = ""
+			err = newPanicErrorf(r, "PackageFingerprint for package %q", pkgPath)
+		}
+	}()
+
+	pctx, ok := packageContexts[pkgPath]
+	if !ok {
+		return "", fmt.Errorf("package %q has no context", pkgPath)
+	}
+
+	// Use the full names of the packages so that the fingerprint does not
+	// depend on which other packages are part of the same Ninja file.
+	pkgNames := make(map[*packageContext]string, len(packageContexts))
+	for _, p := range packageContexts {
+		pkgNames[p] = p.fullName
+	}
+
+	var entries []string
+	buf := &bytes.Buffer{}
+	nw := newNinjaWriter(buf)
+
+	scope := pctx.scope
+	for _, v := range scope.variables {
+		if v.packageContext() != pctx {
+			continue
+		}
+		value, err := v.value(config)
+		if err != nil {
+			return "", fmt.Errorf("error evaluating variable %s: %s", v, err)
+		}
+		err = nw.Assign(v.fullName(pkgNames), value.Value(pkgNames))
+		if err != nil {
+			return "", err
+		}
+		entries = append(entries, "variable "+buf.String())
+		buf.Reset()
+	}
+
+	for _, p := range scope.pools {
+		if p.packageContext() != pctx {
+			continue
+		}
+		def, err := p.def(config)
+		if err != nil {
+			return "", fmt.Errorf("error evaluating pool %s: %s", p, err)
+		}
+		err = def.WriteTo(nw, p.fullName(pkgNames))
+		if err != nil {
+			return "", err
+		}
+		entries = append(entries, "pool "+buf.String())
+		buf.Reset()
+	}
+
+	for _, r := range scope.rules {
+		if r.packageContext() != pctx {
+			continue
+		}
+		if sr, ok := r.(*selectedRule); ok {
+			// A selected rule has no definition of its own, only the name of
+			// the rule that it selects.
+			rule, err := sr.Select(config)
+			if err != nil {
+				return "", fmt.Errorf("error selecting rule for %s: %s", r, err)
+			}
+			entries = append(entries, "select "+r.fullName(pkgNames)+" "+
+				rule.fullName(pkgNames))
+			continue
+		}
+		def, err := r.def(config)
+		if err != nil {
+			return "", fmt.Errorf("error evaluating rule %s: %s", r, err)
+		}
+		err = def.WriteTo(nw, r.fullName(pkgNames), pkgNames)
+		if err != nil {
+			return "", err
+		}
+		argDefaults := make([]string, 0, len(def.ArgDefaults))
+		for argVar, value := range def.ArgDefaults {
+			argDefaults = append(argDefaults, argVar.name()+" = "+value.Value(pkgNames))
+		}
+		sort.Strings(argDefaults)
+		for _, argDefault := range argDefaults {
+			buf.WriteString("# default " + argDefault + "\n")
+		}
+		entries = append(entries, "rule "+buf.String())
+		buf.Reset()
+	}
+
+	sort.Strings(entries)
+
+	h := sha256.New()
+	for _, entry := range entries {
+		fmt.Fprintf(h, "%d:%s", len(entry), entry)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
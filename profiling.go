@@ -0,0 +1,108 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// A ProfilingStat is the number of calls to an operation and their cumulative
+// duration.
+type ProfilingStat struct {
+	Count    int64
+	Duration time.Duration
+}
+
+// A GenerationProfile contains the statistics recorded while profiling is
+// enabled, see SetProfilingEnabled.  The durations overlap: the evaluation of a variable or
+// a rule includes the parsing of the Ninja strings it does, and a variable
+// whose value is computed from other variables includes their evaluation.
+type GenerationProfile struct {
+	VariableValues    ProfilingStat // The evaluations of the live variables.
+	RuleDefs          ProfilingStat // The evaluations of the live rules.
+	PoolDefs          ProfilingStat // The evaluations of the live pools.
+	NinjaStringParses ProfilingStat // The parsing of all Ninja strings.
+}
+
+type profilingCounter struct {
+	count    int64
+	duration int64
+}
+
+var (
+	profilingEnabled int32
+
+	variableValuesProfile    profilingCounter
+	ruleDefsProfile          profilingCounter
+	poolDefsProfile          profilingCounter
+	ninjaStringParsesProfile profilingCounter
+)
+
+// SetProfilingEnabled enables or disables the recording of the time spent
+// evaluating variables, rules, and pools and parsing Ninja strings while
+// generating build actions, which is disabled by default.  Enabling it resets
+// the statistics returned by ProfilingStats.  When it is disabled the only
+// cost is a check of the setting on each operation.  It may be called
+// concurrently with the generation of build actions.
+func SetProfilingEnabled(enabled bool) {
+	if !enabled {
+		atomic.StoreInt32(&profilingEnabled, 0)
+		return
+	}
+
+	resetProfilingStats()
+	atomic.StoreInt32(&profilingEnabled, 1)
+}
+
+// resetProfilingStats clears the statistics returned by ProfilingStats.
+func resetProfilingStats() {
+	for _, counter := range []*profilingCounter{&variableValuesProfile,
+		&ruleDefsProfile, &poolDefsProfile, &ninjaStringParsesProfile} {
+
+		atomic.StoreInt64(&counter.count, 0)
+		atomic.StoreInt64(&counter.duration, 0)
+	}
+}
+
+// ProfilingStats returns the statistics recorded since profiling was last
+// enabled.
+func ProfilingStats() GenerationProfile {
+	return GenerationProfile{
+		VariableValues:    variableValuesProfile.stat(),
+		RuleDefs:          ruleDefsProfile.stat(),
+		PoolDefs:          poolDefsProfile.stat(),
+		NinjaStringParses: ninjaStringParsesProfile.stat(),
+	}
+}
+
+// profiling returns true if profiling is enabled.
+func profiling() bool {
+	return atomic.LoadInt32(&profilingEnabled) != 0
+}
+
+// record adds an operation that started at start to c.  It is meant to be
+// deferred, as in "defer c.record(time.Now())".
+func (c *profilingCounter) record(start time.Time) {
+	atomic.AddInt64(&c.count, 1)
+	atomic.AddInt64(&c.duration, int64(time.Since(start)))
+}
+
+func (c *profilingCounter) stat() ProfilingStat {
+	return ProfilingStat{
+		Count:    atomic.LoadInt64(&c.count),
+		Duration: time.Duration(atomic.LoadInt64(&c.duration)),
+	}
+}
@@ -16,7 +16,10 @@ package blueprint
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"unicode"
 	"unicode/utf8"
 )
@@ -54,26 +57,81 @@ type Rule interface {
 	String() string
 }
 
+// A RuleSet is a Rule that stands for one of several rules, chosen based on the
+// config.  Build statements that invoke a RuleSet invoke the rule that it
+// selects instead.
+type RuleSet interface {
+	Rule
+
+	// Select returns the rule selected for config.
+	Select(config interface{}) (Rule, error)
+}
+
 type basicScope struct {
 	parent    *basicScope
 	variables map[string]Variable
 	pools     map[string]Pool
 	rules     map[string]Rule
 	imports   map[string]*basicScope
+
+	// foldedNames maps the lower-case variable, pool, and rule names, see
+	// foldedNameKey, to the first name that was added, for
+	// SetCaseInsensitiveNames.
+	foldedNames map[string]string
+
+	// desc describes the scope in the errors for unknown variables.
+	desc string
+}
+
+// caseInsensitiveNames is set by SetCaseInsensitiveNames.  It is read when
+// names are added to the scopes of modules and singletons, so it is guarded by
+// caseInsensitiveNamesLock.
+var (
+	caseInsensitiveNamesLock sync.RWMutex
+	caseInsensitiveNames     bool
+)
+
+// SetCaseInsensitiveNames enables or disables treating variable, pool, and
+// rule names that differ only in case as collisions, which is disabled by
+// default.  Such names can collide when they end up in file names on a
+// case-insensitive file system.  While enabled, adding a name that differs only
+// in case from a name in the same scope fails, and
+// Context.ResolveDependencies reports the names of the packages' scopes that
+// collide, including the ones defined before it was enabled.
+//
+// It should be called before the Context methods that generate build actions.
+func SetCaseInsensitiveNames(insensitive bool) {
+	caseInsensitiveNamesLock.Lock()
+	defer caseInsensitiveNamesLock.Unlock()
+	caseInsensitiveNames = insensitive
+}
+
+// caseInsensitiveNamesEnabled returns the setting of SetCaseInsensitiveNames.
+func caseInsensitiveNamesEnabled() bool {
+	caseInsensitiveNamesLock.RLock()
+	defer caseInsensitiveNamesLock.RUnlock()
+	return caseInsensitiveNames
+}
+
+// foldedNameKey returns the key of a name of the given kind in foldedNames.
+func foldedNameKey(kind, name string) string {
+	return kind + " " + strings.ToLower(name)
 }
 
 func newScope(parent *basicScope) *basicScope {
 	return &basicScope{
-		parent:    parent,
-		variables: make(map[string]Variable),
-		pools:     make(map[string]Pool),
-		rules:     make(map[string]Rule),
-		imports:   make(map[string]*basicScope),
+		parent:      parent,
+		variables:   make(map[string]Variable),
+		pools:       make(map[string]Pool),
+		rules:       make(map[string]Rule),
+		imports:     make(map[string]*basicScope),
+		foldedNames: make(map[string]string),
 	}
 }
 
 func makeRuleScope(parent *basicScope, argNames map[string]bool) *basicScope {
 	scope := newScope(parent)
+	scope.desc = "rule arguments"
 	for argName := range argNames {
 		_, err := scope.LookupVariable(argName)
 		if err != nil {
@@ -115,8 +173,7 @@ func (s *basicScope) LookupVariable(name string) (Variable, error) {
 		pkgName := name[:dotIndex]
 		varName := name[dotIndex+1:]
 
-		first, _ := utf8.DecodeRuneInString(varName)
-		if !unicode.IsUpper(first) {
+		if !isExportedName(varName) {
 			return nil, fmt.Errorf("cannot refer to unexported name %q", name)
 		}
 
@@ -127,21 +184,56 @@ func (s *basicScope) LookupVariable(name string) (Variable, error) {
 
 		v, ok := importedScope.variables[varName]
 		if !ok {
-			return nil, fmt.Errorf("package %q does not contain variable %q",
-				pkgName, varName)
+			return nil, fmt.Errorf("package %q does not contain variable %q "+
+				"(searched %s)", pkgName, varName, importedScope.desc)
 		}
 
 		return v, nil
 	} else {
 		// The variable name has no package part; just "var"
-		for ; s != nil; s = s.parent {
-			v, ok := s.variables[name]
+		for scope := s; scope != nil; scope = scope.parent {
+			v, ok := scope.variables[name]
 			if ok {
 				return v, nil
 			}
 		}
-		return nil, fmt.Errorf("undefined variable %q", name)
+		return nil, fmt.Errorf("undefined variable %q (searched %s)", name,
+			s.searchedScopes())
+	}
+}
+
+// searchedScopes describes s and its parents, in lookup order.
+func (s *basicScope) searchedScopes() string {
+	var descs []string
+	for ; s != nil; s = s.parent {
+		descs = append(descs, s.desc)
 	}
+	return strings.Join(descs, ", ")
+}
+
+// searchedImports describes the imports of s and its parents, in lookup order.
+func (s *basicScope) searchedImports() string {
+	var descs []string
+	for ; s != nil; s = s.parent {
+		if len(s.imports) == 0 {
+			descs = append(descs, s.desc+" (no imports)")
+			continue
+		}
+		names := make([]string, 0, len(s.imports))
+		for name := range s.imports {
+			names = append(names, strconv.Quote(name))
+		}
+		sort.Strings(names)
+		descs = append(descs, s.desc+" (imports "+strings.Join(names, ", ")+")")
+	}
+	return strings.Join(descs, ", ")
+}
+
+// isExportedName returns true if name can be referenced from other packages.
+// Like in Go, capitalized names are exported.
+func isExportedName(name string) bool {
+	first, _ := utf8.DecodeRuneInString(name)
+	return unicode.IsUpper(first)
 }
 
 func (s *basicScope) IsRuleVisible(rule Rule) bool {
@@ -195,20 +287,21 @@ func (s *basicScope) IsPoolVisible(pool Pool) bool {
 }
 
 func (s *basicScope) lookupImportedScope(pkgName string) (*basicScope, error) {
-	for ; s != nil; s = s.parent {
-		importedScope, ok := s.imports[pkgName]
+	for scope := s; scope != nil; scope = scope.parent {
+		importedScope, ok := scope.imports[pkgName]
 		if ok {
 			return importedScope, nil
 		}
 	}
 	return nil, fmt.Errorf("unknown imported package %q (missing call to "+
-		"blueprint.Import()?)", pkgName)
+		"blueprint.Import()?) (searched the imports of %s)", pkgName,
+		s.searchedImports())
 }
 
 func (s *basicScope) AddImport(name string, importedScope *basicScope) error {
 	_, present := s.imports[name]
 	if present {
-		return fmt.Errorf("import %q is already defined in this scope", name)
+		return &DuplicateNameError{Kind: "import", Name: name}
 	}
 	s.imports[name] = importedScope
 	return nil
@@ -218,7 +311,11 @@ func (s *basicScope) AddVariable(v Variable) error {
 	name := v.name()
 	_, present := s.variables[name]
 	if present {
-		return fmt.Errorf("variable %q is already defined in this scope", name)
+		return &DuplicateNameError{Kind: "variable", Name: name}
+	}
+	err := s.addFoldedName("variable", name)
+	if err != nil {
+		return err
 	}
 	s.variables[name] = v
 	return nil
@@ -228,7 +325,11 @@ func (s *basicScope) AddPool(p Pool) error {
 	name := p.name()
 	_, present := s.pools[name]
 	if present {
-		return fmt.Errorf("pool %q is already defined in this scope", name)
+		return &DuplicateNameError{Kind: "pool", Name: name}
+	}
+	err := s.addFoldedName("pool", name)
+	if err != nil {
+		return err
 	}
 	s.pools[name] = p
 	return nil
@@ -238,21 +339,43 @@ func (s *basicScope) AddRule(r Rule) error {
 	name := r.name()
 	_, present := s.rules[name]
 	if present {
-		return fmt.Errorf("rule %q is already defined in this scope", name)
+		return &DuplicateNameError{Kind: "rule", Name: name}
+	}
+	err := s.addFoldedName("rule", name)
+	if err != nil {
+		return err
 	}
 	s.rules[name] = r
 	return nil
 }
 
+// addFoldedName records a name of the given kind in foldedNames.  It returns
+// an error if case-insensitive names are enabled and a name that differs only
+// in case was already added.
+func (s *basicScope) addFoldedName(kind, name string) error {
+	key := foldedNameKey(kind, name)
+	other, present := s.foldedNames[key]
+	if !present {
+		s.foldedNames[key] = name
+		return nil
+	}
+	if caseInsensitiveNamesEnabled() {
+		return &DuplicateNameError{Kind: kind, Name: name, Existing: other}
+	}
+	return nil
+}
+
 type localScope struct {
 	namePrefix string
 	scope      *basicScope
 }
 
 func newLocalScope(parent *basicScope, namePrefix string) *localScope {
+	scope := newScope(parent)
+	scope.desc = "local variables"
 	return &localScope{
 		namePrefix: namePrefix,
-		scope:      newScope(parent),
+		scope:      scope,
 	}
 }
 
@@ -363,7 +486,7 @@ func (l *localVariable) name() string {
 }
 
 func (l *localVariable) fullName(pkgNames map[*packageContext]string) string {
-	return l.namePrefix + l.name_
+	return transformNinjaName(l.namePrefix + l.name_)
 }
 
 func (l *localVariable) value(interface{}) (*ninjaString, error) {
@@ -391,7 +514,7 @@ func (l *localRule) name() string {
 }
 
 func (l *localRule) fullName(pkgNames map[*packageContext]string) string {
-	return l.namePrefix + l.name_
+	return transformNinjaName(l.namePrefix + l.name_)
 }
 
 func (l *localRule) def(interface{}) (*ruleDef, error) {
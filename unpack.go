@@ -155,52 +155,22 @@ func unpackStructValue(namePrefix string, structValue reflect.Value,
 
 		// To make testing easier we validate the struct field's type regardless
 		// of whether or not the property was specified in the parsed string.
-		// TODO(ccross): we don't validate types inside nil struct pointers
-		// Move type validation to a function that runs on each factory once
-		switch kind := fieldValue.Kind(); kind {
-		case reflect.Bool, reflect.String, reflect.Struct:
-			// Do nothing
-		case reflect.Slice:
-			elemType := field.Type.Elem()
-			if elemType.Kind() != reflect.String {
-				if !proptools.HasTag(field, "blueprint", "mutated") {
-					panic(fmt.Errorf("field %s is a non-string slice", propertyName))
-				}
-			}
-		case reflect.Interface:
-			if fieldValue.IsNil() {
-				panic(fmt.Errorf("field %s contains a nil interface", propertyName))
-			}
-			fieldValue = fieldValue.Elem()
-			elemType := fieldValue.Type()
-			if elemType.Kind() != reflect.Ptr {
-				panic(fmt.Errorf("field %s contains a non-pointer interface", propertyName))
-			}
-			fallthrough
-		case reflect.Ptr:
-			switch ptrKind := fieldValue.Type().Elem().Kind(); ptrKind {
-			case reflect.Struct:
-				if fieldValue.IsNil() && (propertyIsSet || field.Anonymous) {
-					// Instantiate nil struct pointers
-					// Set into origFieldValue in case it was an interface, in which case
-					// fieldValue points to the unsettable pointer inside the interface
-					fieldValue = reflect.New(fieldValue.Type().Elem())
-					origFieldValue.Set(fieldValue)
-				}
-				fieldValue = fieldValue.Elem()
-			case reflect.Bool, reflect.Int64, reflect.String:
-				// Nothing
-			default:
-				panic(fmt.Errorf("field %s contains a pointer to %s", propertyName, ptrKind))
-			}
+		// The types inside nil struct pointers are only validated by
+		// RegisterModuleTypeChecked, once for each factory.
+		fieldValue, err := checkPropertyField(field, fieldValue, propertyName)
+		if err != nil {
+			panic(err)
+		}
 
-		case reflect.Int, reflect.Uint:
-			if !proptools.HasTag(field, "blueprint", "mutated") {
-				panic(fmt.Errorf(`int field %s must be tagged blueprint:"mutated"`, propertyName))
+		if fieldValue.Kind() == reflect.Ptr && fieldValue.Type().Elem().Kind() == reflect.Struct {
+			if fieldValue.IsNil() && (propertyIsSet || field.Anonymous) {
+				// Instantiate nil struct pointers
+				// Set into origFieldValue in case it was an interface, in which case
+				// fieldValue points to the unsettable pointer inside the interface
+				fieldValue = reflect.New(fieldValue.Type().Elem())
+				origFieldValue.Set(fieldValue)
 			}
-
-		default:
-			panic(fmt.Errorf("unsupported kind for field %s: %s", propertyName, kind))
+			fieldValue = fieldValue.Elem()
 		}
 
 		if field.Anonymous && fieldValue.Kind() == reflect.Struct {
@@ -398,3 +368,128 @@ func HasFilter(field reflect.StructTag) (k, v string, err error) {
 
 	return "", "", nil
 }
+
+// validatePropertyStructs checks that every exported field of the property
+// structs returned by a module factory has a kind that can be unpacked from a
+// Blueprints file, including fields of nested structs and of nil pointers to
+// structs.
+func validatePropertyStructs(propertyStructs []interface{}) error {
+	for _, properties := range propertyStructs {
+		propertiesValue := reflect.ValueOf(properties)
+		if propertiesValue.Kind() != reflect.Ptr ||
+			propertiesValue.Elem().Kind() != reflect.Struct {
+
+			return fmt.Errorf("properties must be a pointer to a struct, got %T", properties)
+		}
+
+		err := validatePropertyStructValue("", propertiesValue.Elem(),
+			make(map[reflect.Type]bool))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validatePropertyStructValue(namePrefix string, structValue reflect.Value,
+	visiting map[reflect.Type]bool) error {
+
+	structType := structValue.Type()
+
+	for i := 0; i < structValue.NumField(); i++ {
+		field := structType.Field(i)
+		fieldValue := structValue.Field(i)
+
+		if field.PkgPath != "" {
+			// This is an unexported field, so just skip it.
+			continue
+		}
+
+		propertyName := namePrefix + proptools.PropertyNameForField(field.Name)
+
+		nestedPrefix := propertyName + "."
+		if field.Anonymous {
+			nestedPrefix = namePrefix
+		}
+
+		fieldValue, err := checkPropertyField(field, fieldValue, propertyName)
+		if err != nil {
+			return err
+		}
+
+		switch fieldValue.Kind() {
+		case reflect.Struct:
+			err = validatePropertyStructValue(nestedPrefix, fieldValue, visiting)
+			if err != nil {
+				return err
+			}
+		case reflect.Ptr:
+			elemType := fieldValue.Type().Elem()
+			if elemType.Kind() != reflect.Struct {
+				continue
+			}
+			if fieldValue.IsNil() {
+				if visiting[elemType] {
+					// A recursive struct type, its fields are already
+					// being checked.
+					continue
+				}
+				fieldValue = reflect.Zero(elemType)
+			} else {
+				fieldValue = fieldValue.Elem()
+			}
+
+			visiting[elemType] = true
+			err = validatePropertyStructValue(nestedPrefix, fieldValue, visiting)
+			delete(visiting, elemType)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkPropertyField returns an error if the kind of the property struct field
+// cannot be unpacked from a Blueprints file.  Otherwise it returns the value of
+// the field, or the pointer inside it if the field is an interface.
+func checkPropertyField(field reflect.StructField, fieldValue reflect.Value,
+	propertyName string) (reflect.Value, error) {
+
+	switch kind := fieldValue.Kind(); kind {
+	case reflect.Bool, reflect.String, reflect.Struct:
+		// Nothing
+	case reflect.Slice:
+		if field.Type.Elem().Kind() != reflect.String &&
+			!proptools.HasTag(field, "blueprint", "mutated") {
+
+			return fieldValue, fmt.Errorf("field %s is a non-string slice", propertyName)
+		}
+	case reflect.Interface:
+		if fieldValue.IsNil() {
+			return fieldValue, fmt.Errorf("field %s contains a nil interface", propertyName)
+		}
+		fieldValue = fieldValue.Elem()
+		if fieldValue.Kind() != reflect.Ptr {
+			return fieldValue, fmt.Errorf("field %s contains a non-pointer interface", propertyName)
+		}
+		fallthrough
+	case reflect.Ptr:
+		switch ptrKind := fieldValue.Type().Elem().Kind(); ptrKind {
+		case reflect.Struct, reflect.Bool, reflect.Int64, reflect.String:
+			// Nothing
+		default:
+			return fieldValue, fmt.Errorf("field %s contains a pointer to %s", propertyName, ptrKind)
+		}
+	case reflect.Int, reflect.Uint:
+		if !proptools.HasTag(field, "blueprint", "mutated") {
+			return fieldValue, fmt.Errorf(`int field %s must be tagged blueprint:"mutated"`, propertyName)
+		}
+	default:
+		return fieldValue, fmt.Errorf("unsupported kind for field %s: %s", propertyName, kind)
+	}
+
+	return fieldValue, nil
+}